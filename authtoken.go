@@ -0,0 +1,85 @@
+package awsauth
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// BuildRDSAuthToken returns a token to connect to an RDS or Aurora database
+// with IAM database authentication, used as the password of the database
+// user. The endpoint is the host and port of the database, such as
+// mydb.123456789012.us-east-1.rds.amazonaws.com:3306. The token is a
+// presigned rds-db:connect request and is valid for 15 minutes.
+func BuildRDSAuthToken(endpoint, region, dbUser string, credentials ...Credentials) (string, error) {
+	params := url.Values{"Action": {"connect"}, "DBUser": {dbUser}}
+	return presignedToken("https://"+endpoint+"/?"+params.Encode(), region, "rds-db", authTokenExpiry, credentials)
+}
+
+// BuildElastiCacheAuthToken returns a token for a user to connect to an
+// ElastiCache for Redis or Valkey replication group or serverless cache with
+// IAM authentication, used as the user's password in the AUTH command. The
+// cache is named by its ID, in lower case. The token is valid for 15 minutes.
+func BuildElastiCacheAuthToken(cacheName, userID, region string, serverless bool, credentials ...Credentials) (string, error) {
+	params := url.Values{"Action": {"connect"}, "User": {userID}}
+	if serverless {
+		params.Set("ResourceType", "ServerlessCache")
+	}
+	return presignedToken("http://"+cacheName+"/?"+params.Encode(), region, "elasticache", authTokenExpiry, credentials)
+}
+
+// BuildMemoryDBAuthToken returns a token for a user to connect to a MemoryDB
+// cluster with IAM authentication, like BuildElastiCacheAuthToken.
+func BuildMemoryDBAuthToken(clusterName, userID, region string, credentials ...Credentials) (string, error) {
+	params := url.Values{"Action": {"connect"}, "User": {userID}}
+	return presignedToken("http://"+clusterName+"/?"+params.Encode(), region, "memorydb", authTokenExpiry, credentials)
+}
+
+// BuildEKSToken returns a bearer token for a Kubernetes client to
+// authenticate to an EKS cluster with, as aws-iam-authenticator and
+// aws eks get-token make them: a presigned sts:GetCallerIdentity request bound
+// to the cluster, which EKS sends on to learn who signed it. EKS accepts the
+// token for 15 minutes after it is made.
+func BuildEKSToken(clusterName string, credentials ...Credentials) (string, error) {
+	params := url.Values{"Action": {"GetCallerIdentity"}, "Version": {stsVersion}}
+	request, err := http.NewRequest("GET", "https://"+stsEndpoint()+"/?"+params.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("X-K8s-Aws-Id", clusterName)
+
+	presigned, err := PresignURL4WithHeaders(request, eksTokenExpiry, []string{"X-K8s-Aws-Id"}, credentials...)
+	if err != nil {
+		return "", err
+	}
+	return eksTokenPrefix + base64.RawURLEncoding.EncodeToString([]byte(presigned)), nil
+}
+
+// presignedToken presigns a GET request to the URL for the region and
+// service, and returns the presigned URL without its scheme, as the database
+// and cache authentication tokens are.
+func presignedToken(rawURL, region, service string, expires time.Duration, credentials []Credentials) (string, error) {
+	request, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	meta := new(metadata)
+	meta.region, meta.service = region, service
+	presigned, err := presignURL4(request, meta, expires, nil, credentials)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(presigned, request.URL.Scheme+"://"), nil
+}
+
+// authTokenExpiry is how long database and cache authentication tokens are
+// valid for.
+const authTokenExpiry = 15 * time.Minute
+
+const (
+	eksTokenPrefix = "k8s-aws-v1."
+	eksTokenExpiry = time.Minute
+)
@@ -0,0 +1,97 @@
+package awsauth
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRDSAuthToken(t *testing.T) {
+	Convey("Given an RDS database endpoint", t, func() {
+		defer test_mockNowV4("20230101T000000Z")()
+
+		token, err := BuildRDSAuthToken("mydb.123456789012.us-east-1.rds.amazonaws.com:3306", "us-east-1", "jane_doe", *testCredV4)
+		So(err, ShouldBeNil)
+
+		Convey("The token should be a presigned connect URL without its scheme", func() {
+			So(token, ShouldStartWith, "mydb.123456789012.us-east-1.rds.amazonaws.com:3306/?Action=connect&DBUser=jane_doe&X-Amz-Algorithm=AWS4-HMAC-SHA256")
+			query := test_queryOf("https://" + token)
+			So(query.Get("X-Amz-Credential"), ShouldEqual, "AKIDEXAMPLE/20230101/us-east-1/rds-db/aws4_request")
+			So(query.Get("X-Amz-Expires"), ShouldEqual, "900")
+		})
+
+		Convey("The token should be signed for the host and port of the database", func() {
+			request, _ := http.NewRequest("GET", "https://"+token, nil)
+			err := Verify4(request, func(string) (string, bool) {
+				return testCredV4.SecretAccessKey, true
+			})
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
+func TestCacheAuthTokens(t *testing.T) {
+	Convey("Given an ElastiCache replication group", t, func() {
+		defer test_mockNowV4("20230101T000000Z")()
+
+		Convey("The token should be a presigned connect URL for the user", func() {
+			token, err := BuildElastiCacheAuthToken("my-cache", "iam-user", "eu-west-1", false, *testCredV4)
+			So(err, ShouldBeNil)
+			So(token, ShouldStartWith, "my-cache/?Action=connect&User=iam-user&X-Amz-Algorithm=AWS4-HMAC-SHA256")
+			So(test_queryOf("http://"+token).Get("X-Amz-Credential"), ShouldEqual, "AKIDEXAMPLE/20230101/eu-west-1/elasticache/aws4_request")
+			So(test_queryOf("http://"+token).Get("X-Amz-Expires"), ShouldEqual, "900")
+		})
+
+		Convey("The token for a serverless cache should name its resource type", func() {
+			token, err := BuildElastiCacheAuthToken("my-cache", "iam-user", "eu-west-1", true, *testCredV4)
+			So(err, ShouldBeNil)
+			So(test_queryOf("http://"+token).Get("ResourceType"), ShouldEqual, "ServerlessCache")
+		})
+	})
+
+	Convey("Given a MemoryDB cluster", t, func() {
+		token, err := BuildMemoryDBAuthToken("my-cluster", "iam-user", "us-east-1", *testCredV4)
+
+		Convey("The token should be presigned for MemoryDB", func() {
+			So(err, ShouldBeNil)
+			So(token, ShouldStartWith, "my-cluster/?Action=connect&User=iam-user&")
+			So(test_queryOf("http://"+token).Get("X-Amz-Credential"), ShouldEndWith, "/us-east-1/memorydb/aws4_request")
+		})
+	})
+}
+
+func TestEKSToken(t *testing.T) {
+	Convey("Given an EKS cluster", t, func() {
+		defer test_mockNowV4("20230101T000000Z")()
+
+		token, err := BuildEKSToken("my-cluster", *testCredV4)
+		So(err, ShouldBeNil)
+
+		Convey("The token should be a presigned GetCallerIdentity URL", func() {
+			So(token, ShouldStartWith, "k8s-aws-v1.")
+			presigned, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, "k8s-aws-v1."))
+			So(err, ShouldBeNil)
+			So(string(presigned), ShouldStartWith, "https://sts.amazonaws.com/?Action=GetCallerIdentity&Version=2011-06-15&")
+
+			query := test_queryOf(string(presigned))
+			So(query.Get("X-Amz-Credential"), ShouldEqual, "AKIDEXAMPLE/20230101/us-east-1/sts/aws4_request")
+			So(query.Get("X-Amz-Expires"), ShouldEqual, "60")
+			So(query.Get("X-Amz-SignedHeaders"), ShouldEqual, "host;x-k8s-aws-id")
+		})
+
+		Convey("The token should only be good for that cluster", func() {
+			presigned, _ := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, "k8s-aws-v1."))
+			lookup := func(string) (string, bool) { return testCredV4.SecretAccessKey, true }
+
+			request, _ := http.NewRequest("GET", string(presigned), nil)
+			request.Header.Set("X-K8s-Aws-Id", "my-cluster")
+			So(Verify4(request, lookup), ShouldBeNil)
+
+			request.Header.Set("X-K8s-Aws-Id", "other-cluster")
+			So(Verify4(request, lookup), ShouldEqual, ErrInvalidSignature)
+		})
+	})
+}
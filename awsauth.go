@@ -1,8 +1,16 @@
 // Package awsauth implements AWS request signing using Signed Signature Version 2,
 // Signed Signature Version 3, and Signed Signature Version 4. Supports S3 and STS.
+//
+// Requests may be signed from many goroutines at once. The credentials,
+// signing keys and other state they share are guarded internally; the
+// package's configuration variables should be set before signing starts.
 package awsauth
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 	"time"
@@ -20,22 +28,73 @@ type Credentials struct {
 // Sign signs a request bound for AWS. It automatically chooses the best
 // authentication scheme based on the service the request is going to. It
 // assumes region and service based on segments of request host domain.
+// The request's Host field takes precedence over the host in its URL, so
+// requests sent through a proxy or load balancer are signed for the AWS
+// endpoint named in Host.
 func Sign(request *http.Request, credentials ...Credentials) *http.Request {
-	service, _ := serviceAndRegion(request.URL.Host)
-	signVersion := awsSignVersion[service]
+	return SignForRegion(request, "", "", credentials...)
+}
 
-	switch signVersion {
-	case 2:
-		return Sign2(request, credentials...)
-	case 3:
-		return Sign3(request, credentials...)
-	case 4:
-		return Sign4(request, credentials...)
-	case -1:
-		return SignS3(request, credentials...)
+// SignCtx is like Sign, but when no credentials are passed in it looks them up
+// with the context, so that a slow or unreachable source of credentials such
+// as the EC2 instance metadata service can be given up on. If none can be
+// found, the request is returned unsigned along with the reason.
+func SignCtx(ctx context.Context, request *http.Request, credentials ...Credentials) (*http.Request, error) {
+	if len(credentials) == 0 {
+		service, region := serviceAndRegion(requestHost(request))
+		keys, err := lookupCredentials(ctx, request, signVersion(service, region), service, region)
+		if err != nil {
+			return request, err
+		}
+		credentials = append(credentials, keys)
 	}
 
-	return nil
+	return Sign(request, credentials...), nil
+}
+
+// SignE is like Sign, but returns the reason when no credentials can be found
+// for the request rather than leaving it unsigned, or signed with empty keys,
+// without a word. The errors are ErrNoCredentials, or ErrMetadataUnavailable
+// and ErrMetadataDecode wrapping what went wrong, or one from
+// CredentialsForRequest.
+func SignE(request *http.Request, credentials ...Credentials) (*http.Request, error) {
+	return SignCtx(context.Background(), request, credentials...)
+}
+
+// Sign4E is like Sign4, but returns the reason when no credentials can be
+// found for the request, as SignE does.
+func Sign4E(request *http.Request, credentials ...Credentials) (*http.Request, error) {
+	if len(credentials) == 0 {
+		service, region := serviceAndRegion(requestHost(request))
+		keys, err := lookupCredentials(context.Background(), request, Version4, service, region)
+		if err != nil {
+			return request, err
+		}
+		credentials = append(credentials, keys)
+	}
+
+	return Sign4(request, credentials...), nil
+}
+
+// lookupCredentials finds the credentials to sign a request with when none
+// are passed in: those CredentialsForRequest picks for Version 4 requests, if
+// it is set, or else the current credentials.
+func lookupCredentials(ctx context.Context, request *http.Request, version int, service, region string) (Credentials, error) {
+	if keys, ok := CredentialsFromContext(ctx); ok {
+		return keys, nil
+	}
+	if keys, ok := CredentialsFromContext(request.Context()); ok {
+		return keys, nil
+	}
+	if version == Version4 && CredentialsForRequest != nil {
+		return CredentialsForRequest(request, service, region)
+	}
+
+	keys, err := CurrentCredentialsCtx(ctx)
+	if err != nil && !(err == ErrNoCredentials && AllowAnonymous) {
+		return keys, err
+	}
+	return keys, nil
 }
 
 // SignForRegion signs a request bound for AWS, for an explicit
@@ -43,68 +102,398 @@ func Sign(request *http.Request, credentials ...Credentials) *http.Request {
 // determine them from the domain. It automatically chooses the best
 // authentication scheme based on the service the request is going to.
 func SignForRegion(request *http.Request, region, service string, credentials ...Credentials) *http.Request {
+	hostService, hostRegion := serviceAndRegion(requestHost(request))
 	if service == "" {
-		service, _ = serviceAndRegion(request.URL.Host)
+		service = hostService
+	}
+	version := signVersion(service, hostRegion)
+	if region != "" {
+		version = signVersion(service, region)
 	}
-	signVersion := awsSignVersion[service]
 
-	switch signVersion {
-	case 2:
+	return signWithVersion(request, version, region, service, credentials...)
+}
+
+// SignWithVersion signs a request with the given signature version (one of
+// Version2, Version3, Version4 or VersionS3), overriding the choice Sign
+// would make for the service the request is going to.
+func SignWithVersion(request *http.Request, version int, credentials ...Credentials) *http.Request {
+	return signWithVersion(request, version, "", "", credentials...)
+}
+
+func signWithVersion(request *http.Request, version int, region, service string, credentials ...Credentials) *http.Request {
+	switch version {
+	case Version2:
 		return Sign2(request, credentials...)
-	case 3:
+	case Version3:
 		return Sign3(request, credentials...)
-	case 4:
+	case Version4:
 		return Sign4ForRegion(request, region, service, credentials...)
-	case -1:
+	case VersionS3:
 		return SignS3(request, credentials...)
 	}
 
 	return nil
 }
 
+// signWithMeta signs a request with a signature version, or with the one its
+// service expects in its region if zero, applying the region, service and
+// headers to sign in meta to Version 4 signatures.
+func signWithMeta(request *http.Request, version int, meta *metadata, credentials []Credentials) *http.Request {
+	if version == 0 {
+		version = signVersion(requestScope(request, meta))
+	}
+	if version == Version4 {
+		return sign4(request, meta, credentials)
+	}
+	return signWithVersion(request, version, meta.region, meta.service, credentials...)
+}
+
+// requestScope returns the service and region a request is signed for: the
+// ones in meta, or else the ones its host names.
+func requestScope(request *http.Request, meta *metadata) (service, region string) {
+	service, region = serviceAndRegion(requestHost(request))
+	if meta.service != "" {
+		service = meta.service
+	}
+	if meta.region != "" {
+		region = meta.region
+	}
+	return service, region
+}
+
+// SignWithOptions signs a request in place with the options NewTransport and
+// NewSigner take, such as WithVersion, WithRegion, WithService,
+// WithSignedHeaders and WithCredentials, without keeping a transport or
+// signer around. Like Sign, it signs with the version the service expects
+// unless WithVersion says otherwise, so WithVersion(Version4) signs as Sign4
+// does and WithVersion(VersionS3) as SignS3 does. Without WithCredentials,
+// credentials are looked up as SignCtx looks them up, with the request's
+// context, and the reason is returned if none can be found.
+func SignWithOptions(request *http.Request, opts ...Option) (*http.Request, error) {
+	settings := applyOptions(opts)
+	meta := settings.meta()
+	version := settings.Version
+	if version == 0 {
+		version = signVersion(requestScope(request, meta))
+	}
+
+	keys, err := settings.keys(request, version, meta)
+	if err != nil {
+		return request, err
+	}
+	if signWithMeta(request, version, meta, []Credentials{keys}) == nil {
+		return request, fmt.Errorf("awsauth: unknown signature version %d", version)
+	}
+	return request, nil
+}
+
+// PresignURL4WithOptions is like PresignURL4, with the options NewTransport
+// and NewSigner take: the URL is presigned for the region and service given
+// by WithRegion and WithService, for hosts that don't name them such as
+// Lambda function URLs, also signs the headers named by WithSignedHeaders,
+// signs the payload hash given by WithPayloadHash rather than the service's
+// default, and is signed with the credentials of WithCredentials.
+func PresignURL4WithOptions(request *http.Request, expires time.Duration, opts ...Option) (string, error) {
+	settings := applyOptions(opts)
+	meta := settings.meta()
+	keys, err := settings.keys(request, Version4, meta)
+	if err != nil {
+		return "", err
+	}
+	return presignURL4(request, meta, expires, settings.SignedHeaders, []Credentials{keys})
+}
+
+// signVersion returns the signature version a service expects in a region.
+// Services missing from awsSignVersion are assumed to support Version 4, as
+// are all services in regions launched since Version 4 was introduced.
+func signVersion(service, region string) int {
+	if version, ok := awsSignVersion[service]; ok && legacyRegions[region] {
+		return version
+	}
+	return Version4
+}
+
 // Sign4 signs a request with Signed Signature Version 4.
+// Headers such as Content-Type are signed as they are at the time of the
+// call, so they must be set beforehand; changing them afterwards invalidates
+// the signature.
+//
+// The body is read into memory to be hashed. To send a large or streamed body
+// over HTTPS without that, set X-Amz-Content-Sha256 to UNSIGNED-PAYLOAD before
+// signing, and the body is left unread and unsigned.
 func Sign4(request *http.Request, credentials ...Credentials) *http.Request {
 	return Sign4ForRegion(request, "", "", credentials...)
 }
 
 // Sign4ForRegion signs a request with Signed Signature Version 4, for an explicit region/service.
 func Sign4ForRegion(request *http.Request, region, service string, credentials ...Credentials) *http.Request {
-	keys := chooseKeys(credentials)
+	meta := new(metadata)
+	meta.region = region
+	meta.service = service
 
-	// Add the X-Amz-Security-Token header when using STS
-	if keys.SecurityToken != "" {
-		request.Header.Set("X-Amz-Security-Token", keys.SecurityToken)
+	return sign4(request, meta, credentials)
+}
+
+// Sign4WithHeaders signs a request with Signed Signature Version 4, signing
+// exactly the named headers instead of choosing them automatically. Host and
+// X-Amz-Date, which every Version 4 signature covers, are always signed too.
+// Use it when something between you and AWS adds headers after signing, or
+// when the receiving end expects a particular set of headers to be signed.
+func Sign4WithHeaders(request *http.Request, headers []string, credentials ...Credentials) *http.Request {
+	meta := new(metadata)
+	meta.headersToSign = append([]string{"host", "x-amz-date"}, headers...)
+
+	return sign4(request, meta, credentials)
+}
+
+// Sign4Debug signs a request like Sign4 and also returns the trace of the
+// signature, to compare against the canonical request and string to sign AWS
+// reports when it answers SignatureDoesNotMatch. The trace is empty if the
+// request was left unsigned.
+func Sign4Debug(request *http.Request, credentials ...Credentials) (*http.Request, SigningTrace) {
+	meta := new(metadata)
+	sign4(request, meta, credentials)
+	return request, meta.trace()
+}
+
+// CanonicalRequest4 returns the canonical request and string to sign Sign4
+// would sign for a request, the headers it would sign, and the timestamp,
+// region and service it would sign at and for, without signing or changing
+// the request, for tools that inspect or check signatures. The headers are
+// the ones the request has: a request without X-Amz-Date is dated now, as
+// Sign4 dates it, and X-Amz-Security-Token is only covered if already set.
+// The body is hashed as Sign4 hashes it; one that can't be rewound is read
+// into a copy, so the request's own body is drained but never swapped. An
+// X-Amz-Date that isn't a 20060102T150405Z timestamp is an error.
+func CanonicalRequest4(request *http.Request) (SigningTrace, error) {
+	clone, err := cloneRequest(request.Clone(request.Context()))
+	if err != nil {
+		return SigningTrace{}, err
 	}
+	canonicalizeHeaders(clone.Header)
+	if date := clone.Header.Get("X-Amz-Date"); date != "" {
+		if _, err := time.Parse(timeFormatV4, date); err != nil {
+			return SigningTrace{}, fmt.Errorf("awsauth: cannot parse X-Amz-Date: %w", err)
+		}
+	}
+	prepareRequestV4(clone)
 
-	prepareRequestV4(request)
 	meta := new(metadata)
-	meta.region = region
-	meta.service = service
+	meta.stringToSign = stringToSignV4(clone, hashedCanonicalRequestV4(clone, meta), meta)
+	return meta.trace(), nil
+}
+
+// StringToSign4 returns the string to sign for a canonical request made at
+// timestamp, in the X-Amz-Date format (20150830T123600Z), for a region and
+// service. Its HMAC with the signing key of the credentials is the signature.
+func StringToSign4(canonicalRequest, timestamp, region, service string) string {
+	date := timestamp
+	if len(date) > 8 {
+		date = tsDateV4(date)
+	}
+	scope := concat("/", date, region, service, "aws4_request")
+	return concat("\n", "AWS4-HMAC-SHA256", timestamp, scope, hashSHA256([]byte(canonicalRequest)))
+}
+
+// Signed4 signs a copy of a request with Signed Signature Version 4 and
+// returns the copy, leaving the original request unsigned. The body of the
+// copy is independent of the original's, which can still be sent or signed
+// again, for example with other credentials.
+func Signed4(request *http.Request, credentials ...Credentials) (*http.Request, error) {
+	return signed4(request, new(metadata), credentials)
+}
+
+func signed4(request *http.Request, meta *metadata, credentials []Credentials) (*http.Request, error) {
+	signed, err := cloneRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := credentialsV4(signed, meta, credentials)
+	if err != nil {
+		return nil, err
+	}
+	return sign4(signed, meta, []Credentials{keys}), nil
+}
+
+func sign4(request *http.Request, meta *metadata, credentials []Credentials) *http.Request {
+	start := time.Now()
+	keys, err := credentialsV4(request, meta, credentials)
+	if err != nil || anonymous(keys) {
+		return request
+	}
+	canonicalizeHeaders(request.Header)
+
+	// Add the X-Amz-Security-Token header when using STS
+	setSecurityToken(request.Header, keys)
+
+	if meta.clockOffset != 0 && !datedV4(request) {
+		request.Header.Set("X-Amz-Date", now().Add(meta.clockOffset).Format(timeFormatV4))
+	}
+	prepareRequestV4(request)
 
 	// Task 1
 	hashedCanonReq := hashedCanonicalRequestV4(request, meta)
 
 	// Task 2
 	stringToSign := stringToSignV4(request, hashedCanonReq, meta)
+	traceV4(meta, stringToSign)
 
 	// Task 3
-	signingKey := signingKeyV4(keys.SecretAccessKey, meta.date, meta.region, meta.service)
-	signature := signatureV4(signingKey, stringToSign)
+	signingKey := keyCache.signingKey(keys.SecretAccessKey, meta.date, meta.region, meta.service)
+	meta.signature = signatureV4(signingKey, stringToSign)
+
+	request.Header.Set("Authorization", buildAuthHeaderV4(meta.signature, meta, keys))
+	observeSign(meta.algorithm, meta.service, meta.region, false, start)
+
+	return request
+}
+
+// Sign4WithPayloadHash signs a request with Signed Signature Version 4 like
+// Sign4, with the hex-encoded SHA-256 hash of its body given rather than
+// computed, so that the body is left unread. Setting the X-Amz-Content-Sha256
+// header to the hash before signing does the same.
+func Sign4WithPayloadHash(request *http.Request, payloadHash string, credentials ...Credentials) *http.Request {
+	meta := new(metadata)
+	meta.payloadHash = payloadHash
+	return sign4(request, meta, credentials)
+}
+
+// Sign4Streaming signs a request with Signed Signature Version 4 for a chunked
+// upload to S3, so that the body is signed as it is sent rather than read up
+// front to be hashed. The body is wrapped in a reader that encodes it as
+// aws-chunked, signing each chunk of chunkSize bytes (64 KiB if zero or less),
+// and the request's headers and ContentLength are set to match. The length of
+// the body must be known.
+func Sign4Streaming(request *http.Request, chunkSize int, credentials ...Credentials) (*http.Request, error) {
+	return sign4Streaming(request, new(metadata), chunkSize, credentials)
+}
+
+// Sign4StreamingChecksum is like Sign4Streaming, but also computes a checksum of
+// the body as it is sent and sends it, signed, in a trailer after the last
+// chunk, for S3 to check the object against. The algorithm is one of CRC32,
+// CRC32C, SHA1 and SHA256, otherwise ErrUnknownChecksum is returned.
+func Sign4StreamingChecksum(request *http.Request, chunkSize int, algorithm string, credentials ...Credentials) (*http.Request, error) {
+	meta := new(metadata)
+	meta.checksum = algorithm
+	return sign4Streaming(request, meta, chunkSize, credentials)
+}
+
+// Sign4EventStream signs a request that opens an event stream, such as a
+// Transcribe streaming transcription, with Signed Signature Version 4, and
+// returns the signer of the messages then sent on the stream.
+func Sign4EventStream(request *http.Request, credentials ...Credentials) (*EventStreamSigner, error) {
+	return sign4EventStream(request, new(metadata), credentials)
+}
+
+// Sign4A signs a request with Signature Version 4A, the asymmetric variant of
+// Version 4 that multi-region endpoints such as S3 Multi-Region Access Points
+// require. The signature is valid in every region. Headers such as
+// Content-Type must be set beforehand, as with Sign4.
+func Sign4A(request *http.Request, credentials ...Credentials) *http.Request {
+	return sign4A(request, new(metadata), credentials)
+}
+
+func sign4A(request *http.Request, meta *metadata, credentials []Credentials) *http.Request {
+	start := time.Now()
+	keys, err := credentialsV4(request, meta, credentials)
+	if err != nil || anonymous(keys) {
+		return request
+	}
+
+	signingKey, err := signingKeyV4A(keys.AccessKeyID, keys.SecretAccessKey)
+	if err != nil {
+		return request
+	}
+	canonicalizeHeaders(request.Header)
+
+	// Add the X-Amz-Security-Token header when using STS
+	setSecurityToken(request.Header, keys)
+	request.Header.Set("X-Amz-Region-Set", regionSetV4A)
+
+	prepareRequestV4(request)
+
+	// Task 1
+	hashedCanonReq := hashedCanonicalRequestV4(request, meta)
+
+	// Task 2
+	stringToSign := stringToSignV4A(request, hashedCanonReq, meta)
+	traceV4(meta, stringToSign)
+
+	// Task 3
+	signature, err := signatureV4A(signingKey, stringToSign)
+	if err != nil {
+		return request
+	}
 
 	request.Header.Set("Authorization", buildAuthHeaderV4(signature, meta, keys))
+	observeSign(meta.algorithm, meta.service, meta.region, false, start)
 
 	return request
 }
 
+// PresignURL4 returns a URL for the request that carries a Signed Signature
+// Version 4 signature in its query string, so that it can be used without
+// credentials until it expires. Only the host header is signed. The URL must
+// expire in between one second and seven days, otherwise ErrInvalidExpiry is
+// returned rather than a URL that AWS would reject.
+func PresignURL4(request *http.Request, expires time.Duration, credentials ...Credentials) (string, error) {
+	return PresignURL4WithHeaders(request, expires, nil, credentials...)
+}
+
+// PresignURL4WithHeaders is like PresignURL4, but also signs the named
+// headers with the values they have on the request. Whoever uses the URL
+// must send those headers unchanged.
+func PresignURL4WithHeaders(request *http.Request, expires time.Duration, headers []string, credentials ...Credentials) (string, error) {
+	return presignURL4(request, new(metadata), expires, headers, credentials)
+}
+
+func presignURL4(request *http.Request, meta *metadata, expires time.Duration, headers []string, credentials []Credentials) (string, error) {
+	if expires < time.Second || expires > maxExpiryV4 {
+		return "", ErrInvalidExpiry
+	}
+
+	keys, err := credentialsV4(request, meta, credentials)
+	if err != nil {
+		return "", err
+	}
+	if anonymous(keys) {
+		return request.URL.String(), nil
+	}
+
+	return presignURLV4(request, meta, expires, headers, keys), nil
+}
+
+// SignS3PostPolicy signs a policy for browser-based uploads to S3 with Signed
+// Signature Version 4, for the region in AWS_REGION, AWS_DEFAULT_REGION or the
+// shared config file, or us-east-1, and returns the fields to put in the HTML
+// form along with the file: policy, x-amz-algorithm, x-amz-credential,
+// x-amz-date, x-amz-signature and, with temporary credentials,
+// x-amz-security-token. The policy is a JSON document with an expiration and
+// conditions; conditions on the fields of the signature are added to it if it
+// doesn't have them.
+func SignS3PostPolicy(policy []byte, credentials ...Credentials) (map[string]string, error) {
+	return SignS3PostPolicyForRegion(policy, fallbackRegion(), credentials...)
+}
+
+// SignS3PostPolicyForRegion is like SignS3PostPolicy, for uploads to a bucket
+// in the given region.
+func SignS3PostPolicyForRegion(policy []byte, region string, credentials ...Credentials) (map[string]string, error) {
+	return postPolicyV4(policy, region, chooseKeys(credentials))
+}
+
 // Sign3 signs a request with Signed Signature Version 3.
 // If the service you're accessing supports Version 4, use that instead.
 func Sign3(request *http.Request, credentials ...Credentials) *http.Request {
-	keys := chooseKeys(credentials)
+	start := time.Now()
+	keys := requestKeys(request, credentials)
+	if anonymous(keys) {
+		return request
+	}
+	canonicalizeHeaders(request.Header)
 
 	// Add the X-Amz-Security-Token header when using STS
-	if keys.SecurityToken != "" {
-		request.Header.Set("X-Amz-Security-Token", keys.SecurityToken)
-	}
+	setSecurityToken(request.Header, keys)
 
 	prepareRequestV3(request)
 
@@ -116,32 +505,44 @@ func Sign3(request *http.Request, credentials ...Credentials) *http.Request {
 
 	// Task 3
 	request.Header.Set("X-Amzn-Authorization", buildAuthHeaderV3(signature, keys))
+	observeSign("AWS3-HTTPS", "", "", false, start)
 
 	return request
 }
 
 // Sign2 signs a request with Signed Signature Version 2.
 // If the service you're accessing supports Version 4, use that instead.
+// The parameters of POST requests with a form-encoded body are signed in the
+// body. Requests are signed with HMAC-SHA256 unless their SignatureMethod
+// parameter is already set to HmacSHA1.
 func Sign2(request *http.Request, credentials ...Credentials) *http.Request {
-	keys := chooseKeys(credentials)
+	start := time.Now()
+	keys := requestKeys(request, credentials)
+	if anonymous(keys) {
+		return request
+	}
 
 	// Add the SecurityToken parameter when using STS
 	// This must be added before the signature is calculated
 	if keys.SecurityToken != "" {
 		values := url.Values{}
 		values.Set("SecurityToken", keys.SecurityToken)
-		augmentRequestQuery(request, values)
+		augmentRequestParamsV2(request, values)
 	}
 
 	prepareRequestV2(request, keys)
 
 	stringToSign := stringToSignV2(request)
 	signature := signatureV2(stringToSign, keys)
+	if paramsV2(request).Get("SignatureMethod") == "HmacSHA1" {
+		signature = signatureV2SHA1(stringToSign, keys)
+	}
 
 	values := url.Values{}
 	values.Set("Signature", signature)
 
-	augmentRequestQuery(request, values)
+	augmentRequestParamsV2(request, values)
+	observeSign("SignatureVersion2", "", "", false, start)
 
 	return request
 }
@@ -149,12 +550,15 @@ func Sign2(request *http.Request, credentials ...Credentials) *http.Request {
 // SignS3 signs a request bound for Amazon S3 using their custom
 // HTTP authentication scheme.
 func SignS3(request *http.Request, credentials ...Credentials) *http.Request {
-	keys := chooseKeys(credentials)
+	start := time.Now()
+	keys := requestKeys(request, credentials)
+	if anonymous(keys) {
+		return request
+	}
+	canonicalizeHeaders(request.Header)
 
 	// Add the X-Amz-Security-Token header when using STS
-	if keys.SecurityToken != "" {
-		request.Header.Set("X-Amz-Security-Token", keys.SecurityToken)
-	}
+	setSecurityToken(request.Header, keys)
 
 	prepareRequestS3(request)
 
@@ -163,6 +567,7 @@ func SignS3(request *http.Request, credentials ...Credentials) *http.Request {
 
 	authHeader := "AWS " + keys.AccessKeyID + ":" + signature
 	request.Header.Set("Authorization", authHeader)
+	observeSign("AWS", "", "", false, start)
 
 	return request
 }
@@ -172,12 +577,18 @@ func SignS3(request *http.Request, credentials ...Credentials) *http.Request {
 // specify an expiration date for these signed requests. After that date,
 // a request signed with this method will be rejected by S3.
 func SignS3Url(request *http.Request, expire time.Time, credentials ...Credentials) *http.Request {
-	keys := chooseKeys(credentials)
+	keys := requestKeys(request, credentials)
+	if anonymous(keys) {
+		return request
+	}
 
-	stringToSign := stringToSignS3Url("GET", expire, request.URL.Path)
+	stringToSign := stringToSignS3Url("GET", expire, keys.SecurityToken, normuri(request.URL.Path))
 	signature := signatureS3(stringToSign, keys)
 
 	query := request.URL.Query()
+	if keys.SecurityToken != "" {
+		query.Set("x-amz-security-token", keys.SecurityToken)
+	}
 	query.Set("AWSAccessKeyId", keys.AccessKeyID)
 	query.Set("Signature", signature)
 	query.Set("Expires", timeToUnixEpochString(expire))
@@ -186,31 +597,204 @@ func SignS3Url(request *http.Request, expire time.Time, credentials ...Credentia
 	return request
 }
 
-// expired checks to see if the temporary credentials from an IAM role are
-// within 4 minutes of expiration (The IAM documentation says that new keys
-// will be provisioned 5 minutes before the old keys expire). Credentials
-// that do not have an Expiration cannot expire.
-func (this *Credentials) expired() bool {
+// PresignURLS3 returns a URL for the request that carries a legacy S3
+// signature (AWSAccessKeyId, Expires and Signature) in its query string, for
+// S3-compatible services that don't support Version 4. Unlike SignS3Url it
+// works for any method, leaves the request untouched, and signs the
+// Content-Md5, Content-Type and X-Amz-* headers set on the request, which
+// whoever uses the URL must then send unchanged. ErrInvalidExpiry is returned
+// if the URL would already have expired.
+func PresignURLS3(request *http.Request, expires time.Time, credentials ...Credentials) (string, error) {
+	if !expires.After(now()) {
+		return "", ErrInvalidExpiry
+	}
+
+	keys := requestKeys(request, credentials)
+	if anonymous(keys) {
+		return request.URL.String(), nil
+	}
+
+	return presignURLS3(request, expires, keys), nil
+}
+
+// expiresWithin reports whether the credentials expire within d of now.
+func (this *Credentials) expiresWithin(d time.Duration) bool {
+	return d > 0 && !this.Expiration.IsZero() && this.Expiration.Add(-d).Before(now())
+}
+
+// Expired checks to see if temporary credentials, such as those from an IAM
+// role, are within 4 minutes of expiration (The IAM documentation says that
+// new keys will be provisioned 5 minutes before the old keys expire), after
+// which they are no longer signed with. Credentials that do not have an
+// Expiration cannot expire.
+func (this *Credentials) Expired() bool {
 	if this.Expiration.IsZero() {
 		// Credentials with no expiration can't expire
 		return false
 	}
 	expireTime := this.Expiration.Add(-4 * time.Minute)
 	// if t - 4 mins is before now, true
-	if expireTime.Before(time.Now()) {
+	if expireTime.Before(now()) {
 		return true
 	} else {
 		return false
 	}
 }
 
+// SigningTrace holds the intermediate results of signing a request with
+// Signed Signature Version 4. When AWS answers SignatureDoesNotMatch, it
+// includes the canonical request and string to sign it computed, which can be
+// compared against these. Neither the secret key nor the signature is kept.
+type SigningTrace struct {
+	CanonicalRequest string
+	StringToSign     string
+	CredentialScope  string
+	SignedHeaders    string
+
+	// Timestamp, Region and Service are what the request was signed at and
+	// for, the timestamp in the X-Amz-Date format.
+	Timestamp string
+	Region    string
+	Service   string
+}
+
+// DebugSigning, if set, is called with the trace of every request that is
+// signed or presigned with Signed Signature Version 4. It is meant for
+// debugging signature mismatches and should be left nil otherwise.
+var DebugSigning func(SigningTrace)
+
+// CredentialsForRequest, if set, picks the credentials that Signed Signature
+// Version 4 requests are signed with when none are passed in, instead of
+// looking them up in the environment or the instance metadata. It is called
+// with the service and region the request is signed for, so that requests can
+// be signed for a different account per region, for example. If it returns an
+// error the request is left unsigned; Signed4, PresignURL4 and SigningTransport
+// return the error.
+var CredentialsForRequest func(request *http.Request, service, region string) (Credentials, error)
+
+// AllowAnonymous makes the signing functions leave requests unsigned, rather
+// than sign them with empty keys, when the credentials they are given or find
+// have neither an access key ID nor a secret access key. Turn it on to send
+// requests that AWS accepts without credentials, such as reads of public S3
+// objects, STS AssumeRoleWithWebIdentity calls or unauthenticated Cognito
+// flows. Leave it off otherwise, so that missing credentials show up as
+// signed requests that AWS rejects rather than as anonymous ones.
+var AllowAnonymous = false
+
+// AnonymousCredentials are credentials that leave requests unsigned, with no
+// Authorization header or signature added, whatever AllowAnonymous is set
+// to. Pass them to the signing functions, or give them to NewTransport or
+// NewSigner with WithCredentials, to send requests to public resources, such
+// as public S3 buckets, through the same pipeline as signed ones.
+var AnonymousCredentials = Credentials{AccessKeyID: anonymousAccessKeyID}
+
+// anonymousAccessKeyID marks AnonymousCredentials; it is no valid key ID.
+const anonymousAccessKeyID = "(anonymous)"
+
+// setSecurityToken sets the X-Amz-Security-Token header to the session token
+// of temporary credentials, or removes it for long-term ones, so that a
+// request signed again isn't sent with a token left from before.
+func setSecurityToken(header http.Header, keys Credentials) {
+	if keys.SecurityToken != "" {
+		header.Set("X-Amz-Security-Token", keys.SecurityToken)
+	} else {
+		header.Del("X-Amz-Security-Token")
+	}
+}
+
+// anonymous reports whether a request should be left unsigned because the
+// credentials are AnonymousCredentials, or are empty and AllowAnonymous is on.
+func anonymous(keys Credentials) bool {
+	if keys.AccessKeyID == anonymousAccessKeyID && keys.SecretAccessKey == "" {
+		return true
+	}
+	return AllowAnonymous && keys.AccessKeyID == "" && keys.SecretAccessKey == ""
+}
+
+// UnmarshalJSON decodes credentials in the form returned by the EC2 instance
+// metadata service, whose Expiration is an ISO 8601 timestamp such as
+// 2023-01-01T00:00:00Z. An empty or missing Expiration means the credentials
+// do not expire.
+func (this *Credentials) UnmarshalJSON(data []byte) error {
+	type credentials Credentials
+	var decoded struct {
+		credentials
+		Expiration string
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	*this = Credentials(decoded.credentials)
+	this.Expiration = time.Time{}
+	if decoded.Expiration != "" {
+		expiration, err := time.Parse(time.RFC3339, decoded.Expiration)
+		if err != nil {
+			return fmt.Errorf("awsauth: cannot parse credentials expiration: %w", err)
+		}
+		this.Expiration = expiration
+	}
+	return nil
+}
+
+// blank reports whether the credentials are missing a key.
+func (this *Credentials) blank() bool {
+	return this.AccessKeyID == "" || this.SecretAccessKey == ""
+}
+
 type metadata struct {
 	algorithm       string
 	credentialScope string
 	signedHeaders   string
 	date            string
+	timestamp       string
 	region          string
 	service         string
+
+	canonicalRequest string
+	stringToSign     string
+
+	// headersToSign, if set, names the headers to sign instead of choosing
+	// them automatically.
+	headersToSign []string
+
+	// includeHeaders and excludeHeaders name headers to sign, or not to
+	// sign, besides or instead of those chosen automatically.
+	includeHeaders []string
+	excludeHeaders []string
+
+	// clockOffset is added to the local time requests are signed at.
+	clockOffset time.Duration
+
+	// payloadHash, if set, is signed in place of the hash of the body,
+	// which is then left unread.
+	payloadHash string
+
+	// signature is the signature the request was signed with.
+	signature string
+
+	// checksum, if set, names the algorithm of the checksum a streaming
+	// upload sends as a trailer after its body.
+	checksum string
+
+	// unsignedToken makes presigned URLs carry the security token without
+	// signing it, added after the signature, as AWS IoT expects.
+	unsignedToken bool
+
+	// rawPath makes the path be signed as it is, without removing empty and
+	// dot segments, as it is for S3.
+	rawPath bool
+
+	// singleEncode makes the path be encoded once when it is signed, rather
+	// than the path as sent being encoded again, as it is for S3.
+	singleEncode bool
+
+	// escapedPath makes the path be signed exactly as it is sent, neither
+	// decoded nor encoded again.
+	escapedPath bool
+
+	// logger, if set, receives the log messages about the signature.
+	logger Logger
 }
 
 const (
@@ -219,9 +803,100 @@ const (
 	envSecretKey       = "AWS_SECRET_KEY"
 	envSecretAccessKey = "AWS_SECRET_ACCESS_KEY"
 	envSecurityToken   = "AWS_SECURITY_TOKEN"
+	envSessionToken    = "AWS_SESSION_TOKEN"
+
+	envEC2MetadataDisabled     = "AWS_EC2_METADATA_DISABLED"
+	envEC2MetadataV1Disabled   = "AWS_EC2_METADATA_V1_DISABLED"
+	envEC2MetadataEndpoint     = "AWS_EC2_METADATA_SERVICE_ENDPOINT"
+	envEC2MetadataEndpointMode = "AWS_EC2_METADATA_SERVICE_ENDPOINT_MODE"
+
+	envRoleARN              = "AWS_ROLE_ARN"
+	envWebIdentityTokenFile = "AWS_WEB_IDENTITY_TOKEN_FILE"
+	envRoleSessionName      = "AWS_ROLE_SESSION_NAME"
+
+	envContainerRelativeURI       = "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"
+	envContainerFullURI           = "AWS_CONTAINER_CREDENTIALS_FULL_URI"
+	envContainerAuthorization     = "AWS_CONTAINER_AUTHORIZATION_TOKEN"
+	envContainerAuthorizationFile = "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"
+	envRegion                     = "AWS_REGION"
+	envDefaultRegion              = "AWS_DEFAULT_REGION"
+	envSTSRegionalEndpoints       = "AWS_STS_REGIONAL_ENDPOINTS"
+	envProfile                    = "AWS_PROFILE"
+	envConfigFile                 = "AWS_CONFIG_FILE"
+	envSharedCredentialsFile      = "AWS_SHARED_CREDENTIALS_FILE"
+	envEndpointURL                = "AWS_ENDPOINT_URL"
+	envIgnoreEndpointURLs         = "AWS_IGNORE_CONFIGURED_ENDPOINT_URLS"
+)
+
+// Errors returned when credentials cannot be found. Underlying errors are
+// wrapped, so check for these with errors.Is.
+var (
+	// ErrNoCredentials means that no credentials were found in the
+	// environment or from an IAM role.
+	ErrNoCredentials = errors.New("awsauth: no credentials found")
+
+	// ErrMetadataUnavailable means that the EC2 instance metadata service,
+	// or the container credentials endpoint, could not be reached or
+	// returned an error.
+	ErrMetadataUnavailable = errors.New("awsauth: credentials metadata unavailable")
+
+	// ErrMetadataDecode means that the role credentials returned by the EC2
+	// instance metadata service, or the container credentials endpoint,
+	// could not be decoded.
+	ErrMetadataDecode = errors.New("awsauth: cannot decode metadata credentials")
+)
+
+// credentialsError is an error of one of the kinds above, caused by another
+// error. errors.Is matches both.
+type credentialsError struct {
+	kind error
+	err  error
+}
+
+// wrapCredentialsError returns an error of the given kind caused by err.
+func wrapCredentialsError(kind, err error) error {
+	return &credentialsError{kind: kind, err: err}
+}
+
+func (e *credentialsError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+func (e *credentialsError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *credentialsError) Unwrap() error {
+	return e.err
+}
+
+// ErrInvalidExpiry is returned when asked for a Version 4 presigned URL that
+// expires in less than a second or in more than seven days, or for a legacy S3
+// presigned URL that has already expired.
+var ErrInvalidExpiry = errors.New("awsauth: presigned URL expiry is out of range")
+
+// ErrUnknownLength is returned when asked to sign a streaming upload whose
+// body is of unknown length.
+var ErrUnknownLength = errors.New("awsauth: streaming upload has a body of unknown length")
+
+// ErrUnknownChecksum is returned when asked to send a checksum computed with an
+// algorithm S3 doesn't support.
+var ErrUnknownChecksum = errors.New("awsauth: unknown checksum algorithm")
+
+// Signature versions that a request can be signed with.
+const (
+	Version2  = 2
+	Version3  = 3
+	Version4  = 4
+	VersionS3 = -1 // the custom S3 authentication scheme
 )
 
 var (
+	// awsSignVersion maps the service name found in a request's host to the
+	// signature version Sign uses for it. Legacy query APIs (EC2, SimpleDB,
+	// ElastiCache, Import/Export) use Version 2, Route 53 and SES use
+	// Version 3, and everything else, including unlisted services, uses
+	// Version 4.
 	awsSignVersion = map[string]int{
 		"autoscaling":          4,
 		"cloudfront":           4,
@@ -249,4 +924,19 @@ var (
 		"elasticloadbalancing": 4,
 		"email":                3,
 	}
+
+	// legacyRegions are the regions that still accept the signature
+	// versions older than 4. Every region launched since, such as
+	// eu-central-1 and ap-northeast-2, only accepts Version 4.
+	legacyRegions = map[string]bool{
+		"us-east-1":      true,
+		"us-west-1":      true,
+		"us-west-2":      true,
+		"eu-west-1":      true,
+		"ap-northeast-1": true,
+		"ap-southeast-1": true,
+		"ap-southeast-2": true,
+		"sa-east-1":      true,
+		"us-gov-west-1":  true,
+	}
 )
@@ -1,6 +1,7 @@
 package awsauth
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -67,6 +68,7 @@ func TestIntegration(t *testing.T) {
 			request := newRequest("POST", "https://sqs.us-west-2.amazonaws.com", url.Values{
 				"Action": []string{"ListQueues"},
 			})
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
 
 			if !credentialsSet() {
 				SkipSo(http.StatusOK, ShouldEqual, http.StatusOK)
@@ -217,26 +219,316 @@ func TestSign(t *testing.T) {
 	})
 }
 
+func TestSignVersionSelection(t *testing.T) {
+	Convey("Each service should be mapped to the signature version it expects", t, func() {
+		services := map[string]int{
+			"ec2":         Version2,
+			"sdb":         Version2,
+			"elasticache": Version2,
+			"route53":     Version3,
+			"email":       Version3,
+			"iam":         Version4,
+			"s3":          Version4,
+			"sqs":         Version4,
+			"dynamodb":    Version4,
+			"lambda":      Version4,
+		}
+		for service, version := range services {
+			So(signVersion(service, "us-east-1"), ShouldEqual, version)
+		}
+	})
+
+	Convey("Services in regions that only accept Version 4 should be signed with it", t, func() {
+		So(signVersion("ec2", "eu-central-1"), ShouldEqual, Version4)
+		So(signVersion("route53", "ap-northeast-2"), ShouldEqual, Version4)
+		So(signVersion("sdb", "ap-south-1"), ShouldEqual, Version4)
+
+		request := newRequest("GET", "https://ec2.eu-central-1.amazonaws.com/?Action=DescribeInstances", url.Values{})
+		signedReq := Sign(request, *testCredV4)
+		So(signedReq.URL.Query().Get("SignatureVersion"), ShouldBeBlank)
+		So(signedReq.Header.Get("Authorization"), ShouldContainSubstring, "/eu-central-1/ec2/aws4_request")
+	})
+
+	Convey("Requests to services that are not listed should be signed with Version 4", t, func() {
+		request := newRequest("GET", "https://lambda.us-west-2.amazonaws.com/2015-03-31/functions/", url.Values{})
+		signedReq := Sign(request, *testCredV4)
+		So(signedReq, ShouldNotBeNil)
+		So(signedReq.Header.Get("Authorization"), ShouldStartWith, "AWS4-HMAC-SHA256 ")
+	})
+
+	Convey("The chosen signature version should be able to be overridden", t, func() {
+		request := newRequest("GET", "https://ec2.amazonaws.com/?Action=DescribeInstances", url.Values{})
+		signedReq := SignWithVersion(request, Version4, *testCredV4)
+		So(signedReq.URL.Query().Get("SignatureVersion"), ShouldBeBlank)
+		So(signedReq.Header.Get("Authorization"), ShouldContainSubstring, "/ec2/aws4_request")
+
+		request = newRequest("GET", "https://johnsmith.s3.amazonaws.com/photos/puppy.jpg", url.Values{})
+		signedReq = SignWithVersion(request, VersionS3, *testCredS3)
+		So(signedReq.Header.Get("Authorization"), ShouldStartWith, "AWS "+testCredS3.AccessKeyID+":")
+	})
+}
+
+func TestSignWithOptions(t *testing.T) {
+	Convey("Given options for a single signature", t, func() {
+		Convey("The request should be signed with the version the service expects", func() {
+			request := newRequest("GET", "https://ec2.amazonaws.com/?Action=DescribeInstances", url.Values{})
+			signedReq, err := SignWithOptions(request, WithCredentials(*testCredV2))
+			So(err, ShouldBeNil)
+			So(signedReq.URL.Query().Get("SignatureVersion"), ShouldEqual, "2")
+		})
+
+		Convey("WithVersion should sign as Sign4 and SignS3 do", func() {
+			request := newRequest("GET", "https://ec2.amazonaws.com/?Action=DescribeInstances", url.Values{})
+			signedReq, err := SignWithOptions(request, WithVersion(Version4), WithCredentials(*testCredV4))
+			So(err, ShouldBeNil)
+			So(signedReq.Header.Get("Authorization"), ShouldContainSubstring, "/us-east-1/ec2/aws4_request")
+
+			request = newRequest("GET", "https://johnsmith.s3.amazonaws.com/photos/puppy.jpg", url.Values{})
+			signedReq, err = SignWithOptions(request, WithVersion(VersionS3), WithCredentials(*testCredS3))
+			So(err, ShouldBeNil)
+			So(signedReq.Header.Get("Authorization"), ShouldStartWith, "AWS "+testCredS3.AccessKeyID+":")
+		})
+
+		Convey("The region, service and headers to sign should be the ones given", func() {
+			request := newRequest("POST", "https://vpce-0123.execute-api.us-east-1.vpce.amazonaws.com/prod", url.Values{})
+			request.Header.Set("X-Api-Tenant", "acme")
+			signedReq, err := SignWithOptions(request, WithRegion("eu-west-1"), WithService("execute-api"), WithSignedHeaders("X-Api-Tenant"), WithCredentials(*testCredV4))
+			So(err, ShouldBeNil)
+			So(signedReq.Header.Get("Authorization"), ShouldContainSubstring, "/eu-west-1/execute-api/aws4_request")
+			So(signedReq.Header.Get("Authorization"), ShouldContainSubstring, ";x-api-tenant,")
+		})
+
+		Convey("The payload hash should be the one given, with the body left unread", func() {
+			request := newRequest("PUT", "https://examplebucket.s3.amazonaws.com/upload", url.Values{"Key": {"value"}})
+			signedReq, err := SignWithOptions(request, WithPayloadHash(unsignedPayload), WithCredentials(*testCredV4))
+			So(err, ShouldBeNil)
+			So(signedReq.Header.Get("X-Amz-Content-Sha256"), ShouldEqual, unsignedPayload)
+		})
+
+		Convey("An unknown version should be refused", func() {
+			request := newRequest("GET", "https://ec2.amazonaws.com/", url.Values{})
+			_, err := SignWithOptions(request, WithVersion(7), WithCredentials(*testCredV4))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A URL should be presigned for the region and service given", func() {
+			request, _ := http.NewRequest("GET", "https://example.com/speech", nil)
+			presigned, err := PresignURL4WithOptions(request, time.Minute, WithRegion("us-west-2"), WithService("polly"), WithCredentials(*testCredV4))
+			So(err, ShouldBeNil)
+			So(test_queryOf(presigned).Get("X-Amz-Credential"), ShouldEndWith, "/us-west-2/polly/aws4_request")
+		})
+	})
+}
+
+func TestSecurityTokenPlacement(t *testing.T) {
+	Convey("Given temporary credentials", t, func() {
+		keys := *testCredV4WithSTS
+		token := keys.SecurityToken
+		object := "https://johnsmith.s3.amazonaws.com/photos/puppy.jpg"
+
+		Convey("Version 2 should send the token as the SecurityToken parameter", func() {
+			request := Sign2(newRequest("GET", "https://ec2.amazonaws.com", url.Values{"Action": {"DescribeInstances"}}), keys)
+			So(request.URL.Query().Get("SecurityToken"), ShouldEqual, token)
+		})
+
+		Convey("Versions 3 and 4 and the S3 scheme should send it as a header", func() {
+			for _, sign := range []func(*http.Request, ...Credentials) *http.Request{Sign3, Sign4, Sign4A, SignS3} {
+				request, _ := http.NewRequest("GET", object, nil)
+				So(sign(request, keys).Header.Get("X-Amz-Security-Token"), ShouldEqual, token)
+			}
+		})
+
+		Convey("Presigned URLs should carry it in the query string", func() {
+			request, _ := http.NewRequest("GET", object, nil)
+			presigned, _ := PresignURL4(request, time.Hour, keys)
+			So(test_queryOf(presigned).Get("X-Amz-Security-Token"), ShouldEqual, token)
+
+			presigned, _ = PresignURLS3(request, now().Add(time.Hour), keys)
+			So(test_queryOf(presigned).Get("x-amz-security-token"), ShouldEqual, token)
+
+			So(SignS3Url(request, now().Add(time.Hour), keys).URL.Query().Get("x-amz-security-token"), ShouldEqual, token)
+		})
+
+		Convey("The S3 scheme should sign the token once, however its header was set", func() {
+			request, _ := http.NewRequest("GET", object, nil)
+			request.Header["x-amz-security-token"] = []string{"stale"}
+			SignS3(request, keys)
+			So(strings.Count(stringToSignS3(request), "x-amz-security-token:"), ShouldEqual, 1)
+			So(stringToSignS3(request), ShouldContainSubstring, "x-amz-security-token:"+token+"\n")
+		})
+
+		Convey("Requests signed again with long-term credentials should drop the token", func() {
+			for _, sign := range []func(*http.Request, ...Credentials) *http.Request{Sign3, Sign4, Sign4A, SignS3} {
+				request, _ := http.NewRequest("GET", object, nil)
+				sign(request, keys)
+				So(sign(request, *testCredV4).Header.Get("X-Amz-Security-Token"), ShouldBeBlank)
+			}
+		})
+	})
+
+	Convey("Given a session token in AWS_SESSION_TOKEN", t, func() {
+		t.Setenv(envAccessKeyID, "ASIAEXAMPLE")
+		t.Setenv(envSecretAccessKey, "secret")
+		t.Setenv(envSessionToken, "session-token")
+		t.Setenv(envSecurityToken, "legacy-token")
+
+		Convey("It should be preferred to AWS_SECURITY_TOKEN", func() {
+			So(envCredentials().SecurityToken, ShouldEqual, "session-token")
+		})
+	})
+}
+
+// test_queryOf returns the query string parameters of a URL.
+func test_queryOf(rawURL string) url.Values {
+	parsed, _ := url.Parse(rawURL)
+	return parsed.Query()
+}
+
+func TestAnonymous(t *testing.T) {
+	Convey("Given anonymous requests are allowed", t, func() {
+		AllowAnonymous = true
+		defer func() { AllowAnonymous = false }()
+
+		Convey("Requests with empty credentials should be left unsigned", func() {
+			request := newRequest("GET", "https://johnsmith.s3.amazonaws.com/photos/puppy.jpg", url.Values{})
+			Sign(request, Credentials{})
+			So(request.Header, ShouldBeEmpty)
+
+			request = newRequest("GET", "https://ec2.amazonaws.com/?Action=DescribeInstances", url.Values{})
+			Sign(request, Credentials{})
+			So(request.URL.RawQuery, ShouldEqual, "Action=DescribeInstances")
+
+			request = newRequest("GET", "https://route53.amazonaws.com", url.Values{})
+			Sign(request, Credentials{})
+			So(request.Header, ShouldBeEmpty)
+
+			request = newRequest("GET", "https://johnsmith.s3.amazonaws.com/photos/puppy.jpg", url.Values{})
+			SignS3(request, Credentials{})
+			So(request.Header, ShouldBeEmpty)
+		})
+
+		Convey("Presigned URLs for empty credentials should carry no signature", func() {
+			request := newRequest("GET", "https://johnsmith.s3.amazonaws.com/photos/puppy.jpg", url.Values{})
+			presigned, err := PresignURL4(request, time.Hour, Credentials{})
+			So(err, ShouldBeNil)
+			So(presigned, ShouldEqual, "https://johnsmith.s3.amazonaws.com/photos/puppy.jpg")
+		})
+
+		Convey("Requests with credentials should still be signed", func() {
+			request := newRequest("GET", "https://johnsmith.s3.amazonaws.com/photos/puppy.jpg", url.Values{})
+			Sign(request, *testCredV4)
+			So(request.Header.Get("Authorization"), ShouldNotBeBlank)
+		})
+	})
+
+	Convey("Given anonymous credentials", t, func() {
+		Convey("Requests should be left unsigned even though anonymous requests aren't allowed", func() {
+			request := newRequest("GET", "https://johnsmith.s3.amazonaws.com/photos/puppy.jpg", url.Values{})
+			Sign(request, AnonymousCredentials)
+			So(request.Header, ShouldBeEmpty)
+
+			request = newRequest("GET", "https://ec2.amazonaws.com/?Action=DescribeInstances", url.Values{})
+			Sign(request, AnonymousCredentials)
+			So(request.URL.RawQuery, ShouldEqual, "Action=DescribeInstances")
+		})
+
+		Convey("Presigned URLs should carry no signature", func() {
+			request := newRequest("GET", "https://johnsmith.s3.amazonaws.com/photos/puppy.jpg", url.Values{})
+			presigned, err := PresignURL4(request, time.Hour, AnonymousCredentials)
+			So(err, ShouldBeNil)
+			So(presigned, ShouldEqual, "https://johnsmith.s3.amazonaws.com/photos/puppy.jpg")
+		})
+	})
+
+	Convey("Given anonymous requests are not allowed", t, func() {
+		Convey("Requests with empty credentials should still be signed", func() {
+			request := newRequest("GET", "https://johnsmith.s3.amazonaws.com/photos/puppy.jpg", url.Values{})
+			Sign(request, Credentials{})
+			So(request.Header.Get("Authorization"), ShouldNotBeBlank)
+		})
+	})
+}
+
 func TestExpiration(t *testing.T) {
 	var credentials = &Credentials{}
 
+	saved := now
+	now = func() time.Time { return time.Now().UTC() }
+	defer func() { now = saved }()
+
 	Convey("Credentials without an expiration can't expire", t, func() {
-		So(credentials.expired(), ShouldBeFalse)
+		So(credentials.Expired(), ShouldBeFalse)
 	})
 
 	Convey("Credentials that expire in 5 minutes aren't expired", t, func() {
 		credentials.Expiration = time.Now().Add(5 * time.Minute)
-		So(credentials.expired(), ShouldBeFalse)
+		So(credentials.Expired(), ShouldBeFalse)
 	})
 
 	Convey("Credentials that expire in 1 minute are expired", t, func() {
 		credentials.Expiration = time.Now().Add(1 * time.Minute)
-		So(credentials.expired(), ShouldBeTrue)
+		So(credentials.Expired(), ShouldBeTrue)
 	})
 
 	Convey("Credentials that expired 2 hours ago are expired", t, func() {
 		credentials.Expiration = time.Now().Add(-2 * time.Hour)
-		So(credentials.expired(), ShouldBeTrue)
+		So(credentials.Expired(), ShouldBeTrue)
+	})
+}
+
+func TestMetadataCredentials(t *testing.T) {
+	Convey("Given credentials from the EC2 metadata service", t, func() {
+		saved := now
+		now = func() time.Time { return time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC) }
+		defer func() { now = saved }()
+
+		document := func(expiration string) string {
+			return `{
+				"Code": "Success",
+				"LastUpdated": "2022-12-31T23:00:00Z",
+				"Type": "AWS-HMAC",
+				"AccessKeyId": "ASIAEXAMPLE",
+				"SecretAccessKey": "secret",
+				"Token": "token",
+				"Expiration": "` + expiration + `"
+			}`
+		}
+
+		Convey("They should be decoded with their expiration", func() {
+			var credentials Credentials
+			err := json.Unmarshal([]byte(document("2023-01-01T06:00:00Z")), &credentials)
+
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "ASIAEXAMPLE")
+			So(credentials.SecretAccessKey, ShouldEqual, "secret")
+			So(credentials.SecurityToken, ShouldEqual, "token")
+			So(credentials.Expiration, ShouldEqual, time.Date(2023, time.January, 1, 6, 0, 0, 0, time.UTC))
+		})
+
+		Convey("They should not be expired more than 4 minutes before they expire", func() {
+			var credentials Credentials
+			json.Unmarshal([]byte(document("2023-01-01T00:04:01Z")), &credentials)
+			So(credentials.Expired(), ShouldBeFalse)
+		})
+
+		Convey("They should be expired less than 4 minutes before they expire", func() {
+			var credentials Credentials
+			json.Unmarshal([]byte(document("2023-01-01T00:03:59Z")), &credentials)
+			So(credentials.Expired(), ShouldBeTrue)
+		})
+
+		Convey("They should not expire without an expiration", func() {
+			var credentials Credentials
+			err := json.Unmarshal([]byte(document("")), &credentials)
+			So(err, ShouldBeNil)
+			So(credentials.Expired(), ShouldBeFalse)
+		})
+
+		Convey("A malformed expiration should be an error", func() {
+			var credentials Credentials
+			err := json.Unmarshal([]byte(document("tomorrow")), &credentials)
+			So(err, ShouldNotBeNil)
+		})
 	})
 }
 
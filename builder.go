@@ -0,0 +1,161 @@
+package awsauth
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RequestBuilder builds a request from its parts and signs it last, once
+// nothing is left to change, so that no part of it is set after the
+// signature was made. The host and content length are taken from the
+// endpoint and body.
+//
+//	request, err := awsauth.NewRequestBuilder("PUT", "https://examplebucket.s3.amazonaws.com/notes.txt").
+//		Header("Content-Type", "text/plain").
+//		Body(strings.NewReader("hello")).
+//		Build(ctx)
+type RequestBuilder struct {
+	method   string
+	endpoint string
+	query    url.Values
+	header   http.Header
+	body     io.Reader
+}
+
+// NewRequestBuilder returns a builder for a request with the given method to
+// the endpoint, a URL that may already hold a path and query string.
+func NewRequestBuilder(method, endpoint string) *RequestBuilder {
+	return &RequestBuilder{method: method, endpoint: endpoint, query: url.Values{}, header: http.Header{}}
+}
+
+// Param adds a query string parameter.
+func (b *RequestBuilder) Param(key, value string) *RequestBuilder {
+	b.query.Add(key, value)
+	return b
+}
+
+// Header adds a header. A Host header sets the host the request is signed
+// for and sent with, as when going through a proxy.
+func (b *RequestBuilder) Header(key, value string) *RequestBuilder {
+	b.header.Add(key, value)
+	return b
+}
+
+// Body sets the body. Its length is taken from bytes.Buffer, bytes.Reader and
+// strings.Reader bodies, and from the unread part of other io.Seekers, which
+// are sought back to send the request again; other bodies are read into
+// memory first.
+func (b *RequestBuilder) Body(body io.Reader) *RequestBuilder {
+	b.body = body
+	return b
+}
+
+// Build builds the request and signs it as SignCtx does, with the given
+// credentials or else ones looked up with the context, which the request
+// also carries.
+func (b *RequestBuilder) Build(ctx context.Context, credentials ...Credentials) (*http.Request, error) {
+	request, err := b.request(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return SignCtx(ctx, request, credentials...)
+}
+
+// BuildWithSigner builds the request and signs it with the signer.
+func (b *RequestBuilder) BuildWithSigner(ctx context.Context, signer *Signer) (*http.Request, error) {
+	request, err := b.request(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return signer.Sign(request)
+}
+
+// request builds the unsigned request.
+func (b *RequestBuilder) request(ctx context.Context) (*http.Request, error) {
+	endpoint, err := url.Parse(b.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	query := endpoint.Query()
+	for key, values := range b.query {
+		query[key] = append(query[key], values...)
+	}
+	endpoint.RawQuery = query.Encode()
+
+	body, err := knownLengthBody(b.body)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, b.method, endpoint.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range b.header {
+		if key == "Host" {
+			request.Host = values[len(values)-1]
+			continue
+		}
+		request.Header[key] = append([]string(nil), values...)
+	}
+
+	if seeker, ok := body.(*seekerBody); ok && seeker.length > 0 {
+		request.ContentLength = seeker.length
+		request.Body = seeker
+		request.GetBody = seeker.rewind
+	} else if ok {
+		request.Body = http.NoBody
+	}
+	return request, nil
+}
+
+// knownLengthBody returns a body whose length http.NewRequest or the builder
+// can tell, reading it into memory if need be.
+func knownLengthBody(body io.Reader) (io.Reader, error) {
+	switch seeker := body.(type) {
+	case nil, *bytes.Buffer, *bytes.Reader, *strings.Reader:
+		return body, nil
+	case io.ReadSeeker:
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return &seekerBody{ReadSeeker: seeker, start: start, length: end - start}, nil
+	}
+
+	payload, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(payload), nil
+}
+
+// seekerBody is a seekable body, sent from where it was when the request was
+// built.
+type seekerBody struct {
+	io.ReadSeeker
+	start, length int64
+}
+
+func (s *seekerBody) rewind() (io.ReadCloser, error) {
+	if _, err := s.Seek(s.start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close leaves the body open, to be sought back and sent again.
+func (s *seekerBody) Close() error {
+	return nil
+}
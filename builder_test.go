@@ -0,0 +1,105 @@
+package awsauth
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRequestBuilder(t *testing.T) {
+	Convey("Given a request built from its parts", t, func() {
+		request, err := NewRequestBuilder("POST", "https://sqs.us-east-1.amazonaws.com/123456789012/queue?Action=SendMessage").
+			Param("MessageBody", "hello world").
+			Header("Content-Type", "application/x-www-form-urlencoded").
+			Header("X-Amz-Meta-Note", "built").
+			Body(strings.NewReader("payload")).
+			Build(context.Background(), *testCredV4)
+		So(err, ShouldBeNil)
+
+		Convey("It should carry every part", func() {
+			So(request.Method, ShouldEqual, "POST")
+			So(request.URL.Query().Get("Action"), ShouldEqual, "SendMessage")
+			So(request.URL.Query().Get("MessageBody"), ShouldEqual, "hello world")
+			So(request.Header.Get("X-Amz-Meta-Note"), ShouldEqual, "built")
+			So(request.Host, ShouldEqual, "sqs.us-east-1.amazonaws.com")
+			So(request.ContentLength, ShouldEqual, 7)
+		})
+
+		Convey("It should be signed as it is sent", func() {
+			So(request.Header.Get("Authorization"), ShouldContainSubstring, "/us-east-1/sqs/aws4_request")
+			So(request.Header.Get("X-Amz-Content-Sha256"), ShouldEqual, hashSHA256([]byte("payload")))
+			So(Verify4(request, func(string) (string, bool) { return testCredV4.SecretAccessKey, true }), ShouldBeNil)
+		})
+	})
+
+	Convey("Given a Host header", t, func() {
+		request, err := NewRequestBuilder("GET", "https://proxy.internal/orders").
+			Header("Host", "abc123.execute-api.us-east-1.amazonaws.com").
+			Build(context.Background(), *testCredV4)
+		So(err, ShouldBeNil)
+
+		Convey("The request should be sent and signed for that host", func() {
+			So(request.Host, ShouldEqual, "abc123.execute-api.us-east-1.amazonaws.com")
+			So(request.Header.Get("Authorization"), ShouldContainSubstring, "/us-east-1/execute-api/aws4_request")
+		})
+	})
+
+	Convey("Given a file body that was partly read", t, func() {
+		path := filepath.Join(t.TempDir(), "body")
+		os.WriteFile(path, []byte("skip:payload"), 0600)
+		file, _ := os.Open(path)
+		defer file.Close()
+		file.Seek(5, io.SeekStart)
+
+		request, err := NewRequestBuilder("PUT", "https://examplebucket.s3.amazonaws.com/notes.txt").
+			Body(file).
+			Build(context.Background(), *testCredV4)
+		So(err, ShouldBeNil)
+
+		Convey("Its unread part should be sent, and could be sent again", func() {
+			So(request.ContentLength, ShouldEqual, 7)
+			payload, _ := io.ReadAll(request.Body)
+			So(string(payload), ShouldEqual, "payload")
+
+			body, err := request.GetBody()
+			So(err, ShouldBeNil)
+			payload, _ = io.ReadAll(body)
+			So(string(payload), ShouldEqual, "payload")
+		})
+	})
+
+	Convey("Given a body of unknown length", t, func() {
+		request, err := NewRequestBuilder("PUT", "https://examplebucket.s3.amazonaws.com/notes.txt").
+			Body(io.MultiReader(strings.NewReader("pay"), strings.NewReader("load"))).
+			Build(context.Background(), *testCredV4)
+		So(err, ShouldBeNil)
+
+		Convey("Its length should be found by reading it", func() {
+			So(request.ContentLength, ShouldEqual, 7)
+			So(request.GetBody, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a signer", t, func() {
+		signer := NewSigner(nil, WithCredentials(Credentials{AccessKeyID: "AKIDSIGNER", SecretAccessKey: "secret"}))
+
+		Convey("The request should be signed with its credentials", func() {
+			request, err := NewRequestBuilder("GET", "https://sqs.us-east-1.amazonaws.com/").BuildWithSigner(context.Background(), signer)
+			So(err, ShouldBeNil)
+			So(request.Header.Get("Authorization"), ShouldContainSubstring, "Credential=AKIDSIGNER/")
+		})
+	})
+
+	Convey("Given a malformed endpoint", t, func() {
+		_, err := NewRequestBuilder("GET", "://nowhere").Build(context.Background(), *testCredV4)
+
+		Convey("No request should be built", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,114 @@
+package awsauth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CloudFrontSigner signs URLs and cookies that grant access to private
+// content served by CloudFront, with a CloudFront key pair or the key of a
+// trusted key group. Access is granted by a policy: a canned one, which only
+// sets when access expires, or a custom one, which may also set when it
+// starts, the IP addresses it is granted to and wildcards in the resource.
+// Info: https://docs.aws.amazon.com/AmazonCloudFront/latest/DeveloperGuide/PrivateContent.html
+type CloudFrontSigner struct {
+	keyPairID string
+	key       *rsa.PrivateKey
+}
+
+// NewCloudFrontSigner returns a signer for the public key with the given ID,
+// as registered with CloudFront, whose private key is given.
+func NewCloudFrontSigner(keyPairID string, privateKey *rsa.PrivateKey) *CloudFrontSigner {
+	return &CloudFrontSigner{keyPairID: keyPairID, key: privateKey}
+}
+
+// CloudFrontPolicy returns a custom policy that grants access to a resource,
+// which may contain * and ? wildcards, until it expires.
+func CloudFrontPolicy(resource string, expires time.Time) []byte {
+	return []byte(`{"Statement":[{"Resource":` + strconv.Quote(resource) +
+		`,"Condition":{"DateLessThan":{"AWS:EpochTime":` + timeToUnixEpochString(expires) + `}}}]}`)
+}
+
+// SignURL returns the URL signed with a canned policy that grants access to it
+// until it expires.
+func (s *CloudFrontSigner) SignURL(rawURL string, expires time.Time) (string, error) {
+	signature, err := s.sign(CloudFrontPolicy(rawURL, expires))
+	if err != nil {
+		return "", err
+	}
+	return withQueryCloudFront(rawURL, "Expires="+timeToUnixEpochString(expires)+"&Signature="+signature+"&Key-Pair-Id="+s.keyPairID), nil
+}
+
+// SignURLWithPolicy returns the URL signed with a custom policy, which is sent
+// along in the URL.
+func (s *CloudFrontSigner) SignURLWithPolicy(rawURL string, policy []byte) (string, error) {
+	signature, err := s.sign(policy)
+	if err != nil {
+		return "", err
+	}
+	return withQueryCloudFront(rawURL, "Policy="+encodeCloudFront(policy)+"&Signature="+signature+"&Key-Pair-Id="+s.keyPairID), nil
+}
+
+// SignCookies returns the CloudFront-Expires, CloudFront-Signature and
+// CloudFront-Key-Pair-Id cookies, signed with a canned policy that grants
+// access to the resource until it expires. Set them with the domain and path
+// of the content they are for.
+func (s *CloudFrontSigner) SignCookies(resource string, expires time.Time) ([]*http.Cookie, error) {
+	signature, err := s.sign(CloudFrontPolicy(resource, expires))
+	if err != nil {
+		return nil, err
+	}
+	return s.cookies("CloudFront-Expires", timeToUnixEpochString(expires), signature), nil
+}
+
+// SignCookiesWithPolicy returns the CloudFront-Policy, CloudFront-Signature and
+// CloudFront-Key-Pair-Id cookies, signed with a custom policy.
+func (s *CloudFrontSigner) SignCookiesWithPolicy(policy []byte) ([]*http.Cookie, error) {
+	signature, err := s.sign(policy)
+	if err != nil {
+		return nil, err
+	}
+	return s.cookies("CloudFront-Policy", encodeCloudFront(policy), signature), nil
+}
+
+func (s *CloudFrontSigner) cookies(name, value, signature string) []*http.Cookie {
+	return []*http.Cookie{
+		{Name: name, Value: value, Secure: true, HttpOnly: true},
+		{Name: "CloudFront-Signature", Value: signature, Secure: true, HttpOnly: true},
+		{Name: "CloudFront-Key-Pair-Id", Value: s.keyPairID, Secure: true, HttpOnly: true},
+	}
+}
+
+// sign signs a policy with RSA-SHA1, as CloudFront requires, and encodes the
+// signature to be sent in a URL or cookie.
+func (s *CloudFrontSigner) sign(policy []byte) (string, error) {
+	hashed := sha1.Sum(policy)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA1, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	return encodeCloudFront(signature), nil
+}
+
+// encodeCloudFront encodes data in base64 with the characters that are
+// invalid in URLs and cookies replaced the way CloudFront expects.
+func encodeCloudFront(data []byte) string {
+	return cloudFrontReplacer.Replace(base64.StdEncoding.EncodeToString(data))
+}
+
+var cloudFrontReplacer = strings.NewReplacer("+", "-", "=", "_", "/", "~")
+
+// withQueryCloudFront appends parameters to a URL, after any it already has.
+func withQueryCloudFront(rawURL, params string) string {
+	if strings.Contains(rawURL, "?") {
+		return rawURL + "&" + params
+	}
+	return rawURL + "?" + params
+}
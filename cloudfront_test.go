@@ -0,0 +1,78 @@
+package awsauth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCloudFrontSigning(t *testing.T) {
+	Convey("Given a CloudFront key pair", t, func() {
+		key, _ := rsa.GenerateKey(rand.Reader, 1024)
+		signer := NewCloudFrontSigner("APKAEXAMPLE", key)
+		expires := time.Unix(1357034400, 0)
+		resource := "https://d111111abcdef8.cloudfront.net/horizon.jpg?size=large&license=yes"
+
+		test_verify := func(policy []byte, signature string) error {
+			decoded, _ := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(signature))
+			hashed := sha1.Sum(policy)
+			return rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, hashed[:], decoded)
+		}
+
+		Convey("The canned policy should be the one CloudFront rebuilds", func() {
+			So(string(CloudFrontPolicy(resource, expires)), ShouldEqual,
+				`{"Statement":[{"Resource":"https://d111111abcdef8.cloudfront.net/horizon.jpg?size=large&license=yes","Condition":{"DateLessThan":{"AWS:EpochTime":1357034400}}}]}`)
+		})
+
+		Convey("A URL signed with a canned policy should carry its expiry and signature", func() {
+			signed, err := signer.SignURL(resource, expires)
+			So(err, ShouldBeNil)
+			So(signed, ShouldStartWith, resource+"&Expires=1357034400&Signature=")
+			So(signed, ShouldEndWith, "&Key-Pair-Id=APKAEXAMPLE")
+
+			query, _ := url.ParseQuery(signed[strings.Index(signed, "?")+1:])
+			So(test_verify(CloudFrontPolicy(resource, expires), query.Get("Signature")), ShouldBeNil)
+		})
+
+		Convey("A URL signed with a custom policy should carry the policy", func() {
+			policy := CloudFrontPolicy("https://d111111abcdef8.cloudfront.net/training/*", expires)
+			signed, err := signer.SignURLWithPolicy("https://d111111abcdef8.cloudfront.net/training/orientation.avi", policy)
+			So(err, ShouldBeNil)
+
+			query, _ := url.Parse(signed)
+			So(query.Query().Get("Policy"), ShouldEqual, encodeCloudFront(policy))
+			So(query.Query().Get("Key-Pair-Id"), ShouldEqual, "APKAEXAMPLE")
+			So(test_verify(policy, query.Query().Get("Signature")), ShouldBeNil)
+		})
+
+		Convey("Cookies signed with a canned policy should carry its expiry", func() {
+			cookies, err := signer.SignCookies(resource, expires)
+			So(err, ShouldBeNil)
+			So(cookies, ShouldHaveLength, 3)
+			So(cookies[0].Name, ShouldEqual, "CloudFront-Expires")
+			So(cookies[0].Value, ShouldEqual, "1357034400")
+			So(cookies[1].Name, ShouldEqual, "CloudFront-Signature")
+			So(test_verify(CloudFrontPolicy(resource, expires), cookies[1].Value), ShouldBeNil)
+			So(cookies[2].Name, ShouldEqual, "CloudFront-Key-Pair-Id")
+			So(cookies[2].Value, ShouldEqual, "APKAEXAMPLE")
+		})
+
+		Convey("Cookies signed with a custom policy should carry the policy", func() {
+			policy := CloudFrontPolicy("https://d111111abcdef8.cloudfront.net/*", expires)
+			cookies, err := signer.SignCookiesWithPolicy(policy)
+			So(err, ShouldBeNil)
+			So(cookies[0].Name, ShouldEqual, "CloudFront-Policy")
+			So(cookies[0].Value, ShouldEqual, encodeCloudFront(policy))
+			So(cookies[0].Value, ShouldNotContainSubstring, "=")
+			So(test_verify(policy, cookies[1].Value), ShouldBeNil)
+		})
+	})
+}
@@ -3,18 +3,23 @@ package awsauth
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -23,66 +28,559 @@ import (
 // serviceAndRegion parsers a hostname to find out which ones it is.
 // http://docs.aws.amazon.com/general/latest/gr/rande.html
 func serviceAndRegion(host string) (service string, region string) {
+	if service, region, ok := endpointScope(host); ok {
+		return service, region
+	}
+
+	labels, defaultRegion, globalRegion := splitHost(host)
+
 	// These are the defaults if the hostname doesn't suggest something else
-	region = "us-east-1"
+	region = defaultRegion
 	service = "s3"
 
-	parts := strings.Split(host, ".")
-	if len(parts) == 4 {
-		// Either service.region.amazonaws.com or virtual-host.region.amazonaws.com
-		if parts[1] == "s3" {
-			service = "s3"
-		} else if strings.HasPrefix(parts[1], "s3-") {
-			region = parts[1][3:]
-			service = "s3"
-		} else {
-			service = parts[0]
-			region = parts[1]
-		}
-	} else if len(parts) == 5 {
-		service = parts[2]
-		region = parts[1]
+	// Virtual-hosted S3 buckets may have dots in their names, so S3 hosts are
+	// recognised by their last labels whatever comes in front of them
+	n := len(labels)
+	last := labels[n-1]
+	if last == "s3-global" {
+		// name.mrap.accesspoint.s3-global, a multi-region access point that
+		// is in no particular region
+		service = "s3"
+	} else if last == "s3" {
+		// [bucket.]s3, in the partition's default region
+		service = "s3"
+	} else if last == "s3-accelerate" {
+		// bucket.s3-accelerate, which serves buckets in any region
+		service = "s3"
+		region = fallbackRegion()
+	} else if strings.HasPrefix(last, "s3-") && serviceLabels[last] == "" {
+		// [bucket.]s3-region
+		service = "s3"
+		region = last[3:]
+	} else if n >= 2 && serviceLabels[labels[n-2]] != "" {
+		// [prefix.]label.region, where label names the service
+		service = serviceLabels[labels[n-2]]
+		region = labels[n-1]
+	} else if n >= 3 && trailingServiceLabels[last] != "" {
+		// cluster.cluster-id.region.label, as Neptune's are
+		service = trailingServiceLabels[last]
+		region = labels[n-2]
+	} else if n == 2 {
+		service = labels[0]
+		region = labels[1]
+	} else if n == 3 {
+		service = labels[2]
+		region = labels[1]
 	} else {
-		// Either service.amazonaws.com or s3-region.amazonaws.com
-		if strings.HasPrefix(parts[0], "s3-") {
-			region = parts[0][3:]
-		} else {
-			service = parts[0]
-		}
+		service = labels[0]
+	}
+
+	if signingName, ok := hostSigningNames[service]; ok {
+		service = signingName
 	}
 
 	if region == "external-1" {
 		region = "us-east-1"
+	} else if globalServices[service] && globalRegion != "" {
+		region = globalRegion
+		if strings.HasPrefix(labels[len(labels)-1], "us-gov") {
+			region = "us-gov-west-1"
+		}
 	}
 
 	return
 }
 
+// requestHost returns the host a request is bound for: its Host field if set,
+// which may differ from the URL when going through a proxy, or else the host
+// in its URL, opaque ones included. Requests with neither, as some servers
+// and HTTP/2 frameworks make them, fall back to their Host or :authority
+// header. An empty port is dropped, as Go's client drops it when sending.
+func requestHost(request *http.Request) string {
+	host := request.Host
+	if host == "" && request.URL != nil {
+		host = request.URL.Host
+		if host == "" && strings.HasPrefix(request.URL.Opaque, "//") {
+			host, _, _ = strings.Cut(request.URL.Opaque[2:], "/")
+		}
+	}
+	if host == "" {
+		host = request.Header.Get("Host")
+	}
+	if host == "" {
+		host = request.Header.Get(":authority")
+	}
+	return strings.TrimSuffix(host, ":")
+}
+
+// splitHost strips the port, the domain suffix and any dualstack and FIPS
+// markers from a hostname, returning the labels in front of the suffix, the
+// default region for the partition the host belongs to, and the region global
+// services are signed for in it, if they are to be signed for one. Hosts
+// outside of any partition are assumed to end in a two-label suffix; their
+// default region is the one configured in the environment.
+func splitHost(host string) (labels []string, defaultRegion, globalRegion string) {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	if suffix := registeredSuffix(host); suffix != "" {
+		partitions.RLock()
+		defaultRegion = partitions.defaultRegions[suffix]
+		partitions.RUnlock()
+		return endpointLabels(strings.TrimSuffix(host, "."+suffix)), defaultRegion, ""
+	}
+	if suffix := longestSuffix(host, awsPartitions); suffix != "" {
+		defaultRegion = awsPartitions[suffix]
+		return endpointLabels(strings.TrimSuffix(host, "."+suffix)), defaultRegion, defaultRegion
+	}
+
+	// A custom endpoint, which is signed for the configured region when its
+	// host doesn't name one
+	parts := strings.Split(host, ".")
+	if len(parts) > 2 {
+		parts = parts[:len(parts)-2]
+	} else {
+		parts = parts[:1]
+	}
+	return parts, fallbackRegion(), "us-east-1"
+}
+
+// endpointLabels splits the part of a hostname in front of its partition's
+// suffix into labels, leaving out the dualstack label and the fips label or
+// -fips suffix of endpoints that serve IPv6 or FIPS 140-2 traffic, neither of
+// which changes the service or region signed for. Interface VPC endpoints,
+// [prefix.]vpce-id.service.region.vpce, are reduced to their service and
+// region.
+func endpointLabels(host string) []string {
+	var labels []string
+	for _, label := range strings.Split(host, ".") {
+		if label == "dualstack" || label == "fips" {
+			continue
+		}
+		labels = append(labels, strings.TrimSuffix(label, "-fips"))
+	}
+	if n := len(labels); n >= 3 && labels[n-1] == "vpce" {
+		labels = labels[n-3 : n-1]
+	}
+	if len(labels) == 0 {
+		labels = []string{host}
+	}
+	return labels
+}
+
+// registeredSuffix returns the longest suffix registered with
+// RegisterPartition that a hostname ends in.
+func registeredSuffix(host string) string {
+	partitions.RLock()
+	defer partitions.RUnlock()
+	return longestSuffix(host, partitions.defaultRegions)
+}
+
+// longestSuffix returns the longest of the domain suffixes that a hostname
+// ends in, or an empty string if it ends in none.
+func longestSuffix(host string, suffixes map[string]string) string {
+	suffix := ""
+	for candidate := range suffixes {
+		if strings.HasSuffix(host, "."+candidate) && len(candidate) > len(suffix) {
+			suffix = candidate
+		}
+	}
+	return suffix
+}
+
+// awsPartitions maps the domain suffixes of the AWS partitions to their
+// default region, which their global services are signed for.
+var awsPartitions = map[string]string{
+	"amazonaws.com":                "us-east-1",
+	"api.aws":                      "us-east-1",
+	"amazonaws.com.cn":             "cn-north-1",
+	"api.amazonwebservices.com.cn": "cn-north-1",
+	"c2s.ic.gov":                   "us-iso-east-1",
+	"sc2s.sgov.gov":                "us-isob-east-1",
+	"cloud.adc-e.uk":               "eu-isoe-west-1",
+	"csp.hci.ic.gov":               "us-isof-south-1",
+}
+
+type partitionRegistry struct {
+	sync.RWMutex
+	defaultRegions map[string]string
+}
+
+var partitions = partitionRegistry{defaultRegions: map[string]string{}}
+
+// RegisterPartition teaches the library about hosts under the given domain
+// suffix, such as those of an isolated partition or an AWS-compatible private
+// cloud. Hosts ending in the suffix are read as [prefix.]service[.region]
+// followed by the suffix, and are signed for defaultRegion when they don't
+// name a region. For example, after RegisterPartition("mycloud.net", "local"),
+// s3.eu-1.mycloud.net is signed for service s3 in region eu-1.
+func RegisterPartition(suffix, defaultRegion string) {
+	partitions.Lock()
+	defer partitions.Unlock()
+
+	partitions.defaultRegions[strings.Trim(suffix, ".")] = defaultRegion
+}
+
+type endpointRegistry struct {
+	sync.RWMutex
+	scopes map[string][2]string
+}
+
+var endpoints = endpointRegistry{scopes: map[string][2]string{}}
+
+// RegisterEndpoint makes requests to a host, such as a MinIO or LocalStack
+// server, be signed for the given service and region, which can't be read
+// from hosts outside of AWS. The host may include a port, in which case only
+// requests to that port match; without one, requests to any port do. An empty
+// region stands for the configured one (see AWS_REGION).
+func RegisterEndpoint(host, service, region string) {
+	endpoints.Lock()
+	defer endpoints.Unlock()
+
+	endpoints.scopes[strings.ToLower(host)] = [2]string{service, region}
+}
+
+// endpointScope returns the service and region of a host registered with
+// RegisterEndpoint or named by an AWS_ENDPOINT_URL_<SERVICE> variable.
+func endpointScope(host string) (service, region string, ok bool) {
+	host = strings.ToLower(host)
+	hostname := host
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		hostname = name
+	}
+
+	endpoints.RLock()
+	scope, ok := endpoints.scopes[host]
+	if !ok {
+		scope, ok = endpoints.scopes[hostname]
+	}
+	endpoints.RUnlock()
+
+	if !ok {
+		scope[0], ok = envEndpointService(host)
+	}
+	if !ok {
+		return "", "", false
+	}
+	if scope[1] == "" {
+		scope[1] = fallbackRegion()
+	}
+	return scope[0], scope[1], true
+}
+
+// serviceLabels maps host labels that are followed by the region, as in
+// [prefix.]label.region.amazonaws.com, to the service name used for signing.
+// Supporting another endpoint family of that shape only needs an entry here.
+var serviceLabels = map[string]string{
+	"s3":                   "s3",
+	"s3-accesspoint":       "s3",
+	"s3-outposts":          "s3-outposts",
+	"s3-object-lambda":     "s3-object-lambda",
+	"execute-api":          "execute-api",
+	"appsync-api":          "appsync",
+	"appsync-realtime-api": "appsync",
+}
+
+// trailingServiceLabels maps host labels that follow the region, as in
+// prefix.region.label.amazonaws.com, to the service name used for signing,
+// where that differs from the label.
+var trailingServiceLabels = map[string]string{
+	"neptune": "neptune-db",
+}
+
+// hostSigningNames lists the services whose hosts don't name them the way
+// their requests are signed for.
+var hostSigningNames = map[string]string{
+	"transcribestreaming": "transcribe",
+}
+
+// globalServices lists the services with a single, global endpoint. Requests
+// to them are always signed for us-east-1, whatever the host looks like.
+var globalServices = map[string]bool{
+	"cloudfront": true,
+	"iam":        true,
+	"route53":    true,
+}
+
+// rawPathServices lists the services whose requests are signed with their
+// paths as they are, empty and dot segments included, since those are part
+// of the names of the objects they store, and encoded once rather than twice.
+var rawPathServices = map[string]bool{
+	"s3":               true,
+	"s3-outposts":      true,
+	"s3-object-lambda": true,
+	"s3express":        true,
+}
+
+// unnormalizedPathServices lists the services whose requests are signed with
+// their paths as they are, like rawPathServices, but still encoded twice.
+// OpenSearch takes document IDs literally, so an ID of "..", or one with an
+// encoded slash, must reach it, and be signed, as it was sent.
+var unnormalizedPathServices = map[string]bool{
+	"es":   true,
+	"aoss": true,
+}
+
+// emptyPayloadServices lists the services whose presigned URLs are signed
+// with the hash of an empty payload, as their SDKs presign them, rather than
+// UNSIGNED-PAYLOAD.
+var emptyPayloadServices = map[string]bool{
+	"polly":            true,
+	"lambda":           true,
+	"execute-api":      true,
+	"iotdevicegateway": true,
+}
+
 type CredentialsStore struct {
 	sync.RWMutex
 	credentials *Credentials
+
+	// providers are asked for credentials in turn; nil means the default
+	// chain. source is the one the stored credentials came from.
+	providers []CredentialProvider
+	source    CredentialProvider
+
+	// refreshing is set while the credentials are being refreshed in the
+	// background. Refreshes that fail, or find credentials that are
+	// themselves about to expire, are retried no sooner than nextRefresh,
+	// backing off with every such refresh in a row.
+	refreshing      bool
+	nextRefresh     time.Time
+	refreshFailures int
+
+	// refreshWindow is how long before they expire that the credentials are
+	// refreshed in the background: DefaultCredentialsRefreshWindow if zero,
+	// and never if negative.
+	refreshWindow time.Duration
+
+	// logger, if set, receives the log messages about looking up the
+	// credentials, instead of DefaultLogger.
+	logger Logger
+}
+
+// DefaultCredentialsRefreshWindow is how long before they expire that
+// credentials are refreshed in the background, unless set otherwise with
+// SetRefreshWindow. The current credentials keep being used until new ones
+// are retrieved, so that requests neither wait for them nor race the expiry.
+const DefaultCredentialsRefreshWindow = 15 * time.Minute
+
+const (
+	// refreshBackoff and maxRefreshBackoff bound how long to wait before
+	// trying a background refresh again.
+	refreshBackoff    = 30 * time.Second
+	maxRefreshBackoff = 5 * time.Minute
+)
+
+// SetRefreshWindow sets how long before they expire that the store's
+// credentials are refreshed in the background. Zero or less turns background
+// refreshes off.
+func (cs *CredentialsStore) SetRefreshWindow(window time.Duration) {
+	cs.Lock()
+	defer cs.Unlock()
+	if window <= 0 {
+		window = -1
+	}
+	cs.refreshWindow = window
+}
+
+// window returns how long before they expire that the credentials are
+// refreshed in the background, zero if never. The store must be locked.
+func (cs *CredentialsStore) window() time.Duration {
+	switch {
+	case cs.refreshWindow == 0:
+		return DefaultCredentialsRefreshWindow
+	case cs.refreshWindow < 0:
+		return 0
+	}
+	return cs.refreshWindow
 }
 
 func (cs *CredentialsStore) Get() Credentials {
+	credentials, _ := cs.Current()
+	return credentials
+}
+
+// Current returns the stored credentials, retrieving them first if they are
+// missing or expired. The error explains why no credentials could be found.
+func (cs *CredentialsStore) Current() (Credentials, error) {
+	return cs.CurrentCtx(context.Background())
+}
+
+// CurrentCtx is like Current, but gives up on retrieving credentials when the
+// context is done.
+func (cs *CredentialsStore) CurrentCtx(ctx context.Context) (Credentials, error) {
 	cs.RLock()
-	if cs.credentials != nil && !cs.credentials.expired() {
-		credentials := *cs.credentials
+	if cs.valid() {
+		credentials, window := *cs.credentials, cs.window()
 		cs.RUnlock()
-		return credentials
+		if credentials.blank() {
+			return credentials, ErrNoCredentials
+		}
+		if credentials.expiresWithin(window) {
+			cs.refreshAhead()
+		}
+		return credentials, nil
 	}
 	cs.RUnlock()
 
 	cs.Lock()
 	defer cs.Unlock()
 
-	cs.retrieve()
+	// Another goroutine may have retrieved them while this one waited
+	if cs.valid() {
+		if cs.credentials.blank() {
+			return *cs.credentials, ErrNoCredentials
+		}
+		return *cs.credentials, nil
+	}
+	if err := cs.retrieve(ctx); err != nil {
+		return Credentials{}, err
+	}
+	return *cs.credentials, nil
+}
+
+// valid reports whether the stored credentials can be used as they are. The
+// store must be locked.
+func (cs *CredentialsStore) valid() bool {
+	return cs.credentials != nil && !cs.credentials.Expired() && (cs.source == nil || !cs.source.IsExpired())
+}
+
+// Refresh retrieves the credentials again, whether or not the stored ones
+// have expired. A store with no providers, holding fixed credentials, keeps
+// them.
+func (cs *CredentialsStore) Refresh() error {
+	return cs.RefreshCtx(context.Background())
+}
+
+// RefreshCtx is like Refresh, but gives up on retrieving credentials when the
+// context is done.
+func (cs *CredentialsStore) RefreshCtx(ctx context.Context) error {
+	cs.Lock()
+	defer cs.Unlock()
+
+	if cs.providers != nil && len(cs.providers) == 0 {
+		return nil
+	}
+	return cs.retrieve(ctx)
+}
+
+// ReloadEnv replaces the stored credentials with those currently set in the
+// environment variables. If the environment holds no credentials, the stored
+// ones are kept and ErrNoCredentials is returned.
+func (cs *CredentialsStore) ReloadEnv() error {
+	newCredentials := envCredentials()
+	if newCredentials.blank() {
+		return ErrNoCredentials
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+
+	cs.credentials = &newCredentials
+	cs.source = nil
+	return nil
+}
+
+// retrieve asks the providers in turn for credentials and keeps the first
+// ones found. If none are, the first error other than ErrNoCredentials is
+// returned, so that a failing provider isn't mistaken for an empty one, and
+// the stored credentials are left as they were, so that the next call asks
+// again.
+func (cs *CredentialsStore) retrieve(ctx context.Context) error {
+	start := time.Now()
+	credentials, source, err := findCredentials(ctx, cs.chain(), cs.logger)
+	observeRefresh(credentials, source, false, start, err)
+	if err != nil {
+		return err
+	}
+	cs.credentials, cs.source = &credentials, source
+	return nil
+}
+
+// refreshAhead starts retrieving the credentials again in the background,
+// unless that is already under way or a refresh was tried too recently. The
+// new credentials replace the stored ones if they are found before anything
+// else does; if none are, the stored ones are kept until they expire.
+func (cs *CredentialsStore) refreshAhead() {
+	cs.Lock()
+	defer cs.Unlock()
+	if cs.refreshing || now().Before(cs.nextRefresh) {
+		return
+	}
+	cs.refreshing = true
+
+	current, providers, log := cs.credentials, cs.chain(), logger(cs.logger)
+	go func() {
+		start := time.Now()
+		credentials, source, err := findCredentials(context.Background(), providers, log)
+		observeRefresh(credentials, source, true, start, err)
+		if err != nil {
+			log.Warn("awsauth: refreshing credentials in the background failed; the current ones are kept until they expire", "error", err)
+		}
+
+		cs.Lock()
+		defer cs.Unlock()
+		cs.refreshing = false
+		if err == nil && cs.credentials == current {
+			cs.credentials, cs.source = &credentials, source
+		}
+
+		// The metadata service only hands out new credentials shortly before
+		// the old ones expire, so the same ones may well come back
+		if err != nil || credentials.expiresWithin(cs.window()) {
+			cs.refreshFailures++
+			cs.nextRefresh = now().Add(refreshDelay(cs.refreshFailures))
+		} else {
+			cs.refreshFailures, cs.nextRefresh = 0, time.Time{}
+		}
+	}()
+}
+
+// refreshDelay returns how long to wait before trying a background refresh
+// again after failures refreshes in a row came to nothing.
+func refreshDelay(failures int) time.Duration {
+	delay := refreshBackoff
+	for i := 1; i < failures && delay < maxRefreshBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRefreshBackoff {
+		delay = maxRefreshBackoff
+	}
+	return delay
+}
 
-	return *cs.credentials
+// findCredentials asks the providers in turn for credentials and returns the
+// first ones found, along with the provider they came from. Each answer is
+// logged to l.
+func findCredentials(ctx context.Context, providers []CredentialProvider, l Logger) (Credentials, CredentialProvider, error) {
+	l = logger(l)
+	err := ErrNoCredentials
+	for _, provider := range providers {
+		credentials, providerErr := retrieveCtx(ctx, provider)
+		if providerErr == nil && !credentials.blank() {
+			l.Debug("awsauth: found credentials", "provider", fmt.Sprintf("%T", provider), "access_key_id", credentials.AccessKeyID, "expiration", credentials.Expiration)
+			return credentials, provider, nil
+		}
+		l.Debug("awsauth: no credentials from provider", "provider", fmt.Sprintf("%T", provider), "error", providerErr)
+		if providerErr != nil && providerErr != ErrNoCredentials && err == ErrNoCredentials {
+			err = providerErr
+		}
+	}
+	return Credentials{}, nil, err
 }
 
-func (cs *CredentialsStore) retrieve() {
+// chain returns the providers the store asks for credentials.
+func (cs *CredentialsStore) chain() []CredentialProvider {
+	if cs.providers == nil {
+		return defaultProviders()
+	}
+	return cs.providers
+}
+
+// envCredentials reads credentials from the environment variables.
+func envCredentials() Credentials {
 	newCredentials := Credentials{}
-	// First use credentials from environment variables
 	newCredentials.AccessKeyID = os.Getenv(envAccessKeyID)
 	if newCredentials.AccessKeyID == "" {
 		newCredentials.AccessKeyID = os.Getenv(envAccessKey)
@@ -93,18 +591,52 @@ func (cs *CredentialsStore) retrieve() {
 		newCredentials.SecretAccessKey = os.Getenv(envSecretKey)
 	}
 
-	newCredentials.SecurityToken = os.Getenv(envSecurityToken)
-
-	// If there is no Access Key and you are on EC2, get the key from the role
-	if (newCredentials.AccessKeyID == "" || newCredentials.SecretAccessKey == "") && onEC2() {
-		newCredentials = getIAMRoleCredentials()
+	newCredentials.SecurityToken = os.Getenv(envSessionToken)
+	if newCredentials.SecurityToken == "" {
+		newCredentials.SecurityToken = os.Getenv(envSecurityToken)
 	}
 
-	cs.credentials = &newCredentials
+	return newCredentials
 }
 
 var gCredentialsStore CredentialsStore
 
+// CurrentCredentials returns the credentials that requests are signed with
+// when none are passed in, looking them up if necessary.
+func CurrentCredentials() (Credentials, error) {
+	return gCredentialsStore.Current()
+}
+
+// CurrentCredentialsCtx is like CurrentCredentials, but gives up on looking
+// up credentials when the context is done, for example to bound how long a
+// call to the EC2 instance metadata service may take.
+func CurrentCredentialsCtx(ctx context.Context) (Credentials, error) {
+	return gCredentialsStore.CurrentCtx(ctx)
+}
+
+// ReloadEnvCredentials replaces the credentials used for signing with those
+// currently set in the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN (or AWS_SECURITY_TOKEN) environment variables. Use it
+// after changing them, since
+// credentials are otherwise only looked up once.
+func ReloadEnvCredentials() error {
+	return gCredentialsStore.ReloadEnv()
+}
+
+// SetCredentialsRefreshWindow sets how long before they expire that the
+// credentials used for signing are refreshed in the background (15 minutes by
+// default). Zero or less turns background refreshes off. Signers take their
+// own with WithRefreshWindow.
+func SetCredentialsRefreshWindow(window time.Duration) {
+	gCredentialsStore.SetRefreshWindow(window)
+}
+
+// RefreshCredentials looks up the credentials used for signing again, even if
+// the current ones have not expired yet.
+func RefreshCredentials() error {
+	return gCredentialsStore.Refresh()
+}
+
 // checkKeys gets credentials depending on if any were passed in as an argument
 // or it makes new ones based on the environment.
 func chooseKeys(cred []Credentials) Credentials {
@@ -114,6 +646,37 @@ func chooseKeys(cred []Credentials) Credentials {
 	return cred[0]
 }
 
+// requestKeys is like chooseKeys, but prefers the credentials attached to the
+// request's context with ContextWithCredentials to the current ones.
+func requestKeys(request *http.Request, cred []Credentials) Credentials {
+	if len(cred) == 0 {
+		if keys, ok := CredentialsFromContext(request.Context()); ok {
+			return keys
+		}
+	}
+	return chooseKeys(cred)
+}
+
+type credentialsKey struct{}
+
+// ContextWithCredentials returns a copy of ctx carrying credentials. Requests
+// made with it are signed with them, by the Sign functions, transports and
+// signers alike, instead of the ones those would look up, so that one
+// transport can sign the requests of several tenants with their own keys.
+// Credentials given explicitly still take precedence: those passed to a Sign
+// function, and those of a transport or signer made with WithCredentials or a
+// provider of its own, such as the signers of a CredentialsRegistry.
+func ContextWithCredentials(ctx context.Context, credentials Credentials) context.Context {
+	return context.WithValue(ctx, credentialsKey{}, credentials)
+}
+
+// CredentialsFromContext returns the credentials attached to ctx with
+// ContextWithCredentials, if any.
+func CredentialsFromContext(ctx context.Context) (Credentials, bool) {
+	credentials, ok := ctx.Value(credentialsKey{}).(Credentials)
+	return credentials, ok
+}
+
 type location struct {
 	ec2     bool
 	checked bool
@@ -122,10 +685,40 @@ type location struct {
 
 var loc location
 
+// DisableEC2Metadata keeps the EC2 instance metadata service from being looked
+// for or asked for credentials, as setting AWS_EC2_METADATA_DISABLED to true
+// does, for programs that never run on EC2.
+var DisableEC2Metadata bool
+
+// metadataEndpoint returns where the EC2 instance metadata service is reached:
+// the endpoint in AWS_EC2_METADATA_SERVICE_ENDPOINT, or else its IPv6 address
+// if AWS_EC2_METADATA_SERVICE_ENDPOINT_MODE is IPv6, or else its IPv4 address.
+func metadataEndpoint() string {
+	if endpoint := os.Getenv(envEC2MetadataEndpoint); endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/")
+	}
+	if strings.EqualFold(os.Getenv(envEC2MetadataEndpointMode), "IPv6") {
+		return "http://[fd00:ec2::254]"
+	}
+	return "http://169.254.169.254"
+}
+
+// metadataURL returns the URL of the instance metadata of the EC2 instance.
+func metadataURL() string {
+	return metadataEndpoint() + "/latest/meta-data/"
+}
+
 // onEC2 checks to see if the program is running on an EC2 instance.
 // It does this by looking for the EC2 metadata service.
-// This caches that information in a struct so that it doesn't waste time.
-func onEC2() bool {
+// This caches that information in a struct so that it doesn't waste time,
+// unless the check was cut short by the context.
+// Setting AWS_EC2_METADATA_DISABLED to true, or DisableEC2Metadata, skips the
+// check altogether.
+func onEC2(ctx context.Context) bool {
+	if DisableEC2Metadata || strings.EqualFold(os.Getenv(envEC2MetadataDisabled), "true") {
+		return false
+	}
+
 	loc.RLock()
 	if loc.checked {
 		ec2 := loc.ec2
@@ -134,11 +727,23 @@ func onEC2() bool {
 	}
 	loc.RUnlock()
 
-	c, err := net.DialTimeout("tcp", "169.254.169.254:80", time.Millisecond*100)
+	address := metadataAddress()
+	if address == "" {
+		logger(nil).Debug("awsauth: the EC2 instance metadata service endpoint is malformed; not on EC2", "endpoint", metadataEndpoint())
+		return false
+	}
+
+	dialer := net.Dialer{Timeout: time.Millisecond * 100}
+	c, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil && ctx.Err() != nil {
+		return false
+	}
+
 	loc.Lock()
 	defer loc.Unlock()
 	loc.checked = true
 	if err != nil {
+		logger(nil).Debug("awsauth: the EC2 instance metadata service is unreachable; not on EC2", "address", address, "error", err)
 		loc.ec2 = false
 		return loc.ec2
 	}
@@ -148,46 +753,197 @@ func onEC2() bool {
 	return loc.ec2
 }
 
+// metadataAddress returns the host and port of the metadata service, to probe
+// for it, or an empty string if its endpoint is malformed.
+func metadataAddress() string {
+	endpoint, err := url.Parse(metadataEndpoint())
+	if err != nil || endpoint.Host == "" {
+		return ""
+	}
+	if endpoint.Port() != "" {
+		return endpoint.Host
+	}
+	if endpoint.Scheme == "https" {
+		return net.JoinHostPort(endpoint.Hostname(), "443")
+	}
+	return net.JoinHostPort(endpoint.Hostname(), "80")
+}
+
+// MetadataTokenTTL is how long the session tokens requested from the EC2
+// instance metadata service (IMDSv2) are valid for, and so how long one is
+// reused before a new one is requested. AWS allows at most 6 hours.
+var MetadataTokenTTL = 6 * time.Hour
+
+// CredentialsClient sends the requests made to look up credentials: to the EC2
+// instance metadata service, container credentials endpoints, STS and the IAM
+// Identity Center portal, unless the provider has a Client of its own. Set its
+// Transport to send them through a proxy, or replace it, keeping a timeout so
+// that signing doesn't hang on an endpoint that doesn't answer. Requests to
+// the metadata service time out sooner, after metadataTimeout.
+var CredentialsClient = &http.Client{Timeout: 10 * time.Second}
+
+// metadataTimeout bounds the requests made to the EC2 instance metadata
+// service, which answers quickly when it is there at all.
+const metadataTimeout = 5 * time.Second
+
+// metadataClient returns CredentialsClient with its timeout cut down to
+// metadataTimeout, for requests to the EC2 instance metadata service.
+func metadataClient() *http.Client {
+	client := *CredentialsClient
+	if client.Timeout == 0 || client.Timeout > metadataTimeout {
+		client.Timeout = metadataTimeout
+	}
+	return &client
+}
+
+// metadataTokenBuffer is how long before it expires a session token is
+// replaced, so that it doesn't expire on its way to the metadata service.
+const metadataTokenBuffer = time.Minute
+
+// metadataTokenRetryDelay is how long no session token is asked for after
+// the metadata service failed to hand one out.
+const metadataTokenRetryDelay = 10 * time.Second
+
+type sessionToken struct {
+	value   string
+	expires time.Time
+	retryAt time.Time
+	sync.Mutex
+}
+
+var metadataToken sessionToken
+
+// getMetadataToken returns a session token for the EC2 instance metadata
+// service, requesting a new one when the cached one is about to expire. It
+// returns an empty string if the service doesn't hand out tokens, in which
+// case requests are made without one (IMDSv1), and doesn't ask again for a
+// while after that. The lock isn't held while asking.
+func getMetadataToken(ctx context.Context) string {
+	metadataToken.Lock()
+	if metadataToken.value != "" && now().Before(metadataToken.expires.Add(-metadataTokenBuffer)) {
+		value := metadataToken.value
+		metadataToken.Unlock()
+		return value
+	}
+	if now().Before(metadataToken.retryAt) {
+		metadataToken.Unlock()
+		return ""
+	}
+	metadataToken.Unlock()
+
+	ttl := MetadataTokenTTL
+	token, err := requestMetadataToken(ctx, ttl)
+
+	metadataToken.Lock()
+	defer metadataToken.Unlock()
+	if err != nil {
+		if ctx.Err() == nil {
+			metadataToken.retryAt = now().Add(metadataTokenRetryDelay)
+		}
+		return ""
+	}
+	metadataToken.value = token
+	metadataToken.expires = now().Add(ttl)
+	return token
+}
+
+// requestMetadataToken asks the EC2 instance metadata service for a session
+// token valid for ttl.
+func requestMetadataToken(ctx context.Context, ttl time.Duration) (string, error) {
+	url := metadataEndpoint() + "/latest/api/token"
+	request, err := http.NewRequestWithContext(ctx, "PUT", url, nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(int(ttl/time.Second)))
+
+	response, err := metadataClient().Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata service returned %s for a session token", response.Status)
+	}
+
+	token, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+// newMetadataRequest builds a request for the EC2 instance metadata service,
+// carrying a session token when one can be had. Without a token the request
+// falls back to IMDSv1, unless AWS_EC2_METADATA_V1_DISABLED is true.
+func newMetadataRequest(ctx context.Context, url string) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	token := getMetadataToken(ctx)
+	if token == "" && strings.EqualFold(os.Getenv(envEC2MetadataV1Disabled), "true") {
+		return nil, errNoMetadataToken
+	}
+	if token == "" {
+		logger(nil).Warn("awsauth: no IMDSv2 session token could be had; falling back to IMDSv1", "url", url)
+	}
+	if token != "" {
+		request.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+	return request, nil
+}
+
+var errNoMetadataToken = errors.New("no IMDSv2 session token could be had and IMDSv1 is disabled")
+
 // getIAMRoleList gets a list of the roles that are available to this instance
-func getIAMRoleList() []string {
+func getIAMRoleList(ctx context.Context) ([]string, error) {
 
 	var roles []string
-	url := "http://169.254.169.254/latest/meta-data/iam/security-credentials/"
+	url := metadataURL() + "iam/security-credentials/"
 
-	client := &http.Client{}
-
-	request, err := http.NewRequest("GET", url, nil)
+	request, err := newMetadataRequest(ctx, url)
 
 	if err != nil {
-		return roles
+		return roles, wrapCredentialsError(ErrMetadataUnavailable, err)
 	}
 
-	response, err := client.Do(request)
+	response, err := metadataClient().Do(request)
 
 	if err != nil {
-		return roles
+		return roles, wrapCredentialsError(ErrMetadataUnavailable, err)
 	}
 	defer response.Body.Close()
 
+	if response.StatusCode != http.StatusOK {
+		return roles, fmt.Errorf("%w: listing roles returned %s", ErrMetadataUnavailable, response.Status)
+	}
+
 	scanner := bufio.NewScanner(response.Body)
 	for scanner.Scan() {
 		roles = append(roles, scanner.Text())
 	}
-	return roles
+	return roles, nil
 }
 
-func getIAMRoleCredentials() Credentials {
+func getIAMRoleCredentials(ctx context.Context) (Credentials, error) {
 
-	roles := getIAMRoleList()
+	roles, err := getIAMRoleList(ctx)
+
+	if err != nil {
+		return Credentials{}, err
+	}
 
 	if len(roles) < 1 {
-		return Credentials{}
+		return Credentials{}, ErrNoCredentials
 	}
 
 	// Use the first role in the list
 	role := roles[0]
 
-	url := "http://169.254.169.254/latest/meta-data/iam/security-credentials/"
+	url := metadataURL() + "iam/security-credentials/"
 
 	// Create the full URL of the role
 	var buffer bytes.Buffer
@@ -196,20 +952,23 @@ func getIAMRoleCredentials() Credentials {
 	roleURL := buffer.String()
 
 	// Get the role
-	roleRequest, err := http.NewRequest("GET", roleURL, nil)
+	roleRequest, err := newMetadataRequest(ctx, roleURL)
 
 	if err != nil {
-		return Credentials{}
+		return Credentials{}, wrapCredentialsError(ErrMetadataUnavailable, err)
 	}
 
-	client := &http.Client{}
-	roleResponse, err := client.Do(roleRequest)
+	roleResponse, err := metadataClient().Do(roleRequest)
 
 	if err != nil {
-		return Credentials{}
+		return Credentials{}, wrapCredentialsError(ErrMetadataUnavailable, err)
 	}
 	defer roleResponse.Body.Close()
 
+	if roleResponse.StatusCode != http.StatusOK {
+		return Credentials{}, fmt.Errorf("%w: fetching role %s returned %s", ErrMetadataUnavailable, role, roleResponse.Status)
+	}
+
 	roleBuffer := new(bytes.Buffer)
 	roleBuffer.ReadFrom(roleResponse.Body)
 
@@ -218,10 +977,10 @@ func getIAMRoleCredentials() Credentials {
 	err = json.Unmarshal(roleBuffer.Bytes(), &credentials)
 
 	if err != nil {
-		return Credentials{}
+		return Credentials{}, wrapCredentialsError(ErrMetadataDecode, err)
 	}
 
-	return credentials
+	return credentials, nil
 
 }
 
@@ -237,6 +996,30 @@ func augmentRequestQuery(request *http.Request, values url.Values) *http.Request
 	return request
 }
 
+// canonicalizeHeaders rekeys headers that were set on the map directly with
+// non-canonical names, so that Header.Get finds them however they are cased.
+func canonicalizeHeaders(header http.Header) {
+	for key, values := range header {
+		canonical := http.CanonicalHeaderKey(key)
+		if canonical != key {
+			delete(header, key)
+			header[canonical] = append(header[canonical], values...)
+		}
+	}
+}
+
+// headerValues returns every value of a header, matching its name without
+// regard to case.
+func headerValues(header http.Header, name string) []string {
+	var values []string
+	for key, v := range header {
+		if strings.EqualFold(key, name) {
+			values = append(values, v...)
+		}
+	}
+	return values
+}
+
 func hmacSHA256(key []byte, content string) []byte {
 	mac := hmac.New(sha256.New, key)
 	mac.Write([]byte(content))
@@ -255,21 +1038,90 @@ func hashSHA256(content []byte) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
+// hashReaderSHA256 hashes what is left to read from r, a piece at a time.
+func hashReaderSHA256(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// hashBody returns the SHA-256 hash of a request body without holding it in
+// memory, so that uploads of files of any size can be signed: it reads the
+// body itself if it can be sought back to where it was, such as an *os.File,
+// or else a copy of it from GetBody if set. Other bodies are read into memory
+// and replaced, as readAndReplaceBody does.
+func hashBody(request *http.Request) string {
+	if request.Body == nil || request.Body == http.NoBody {
+		return emptyPayloadHash
+	}
+
+	if seeker, ok := request.Body.(io.Seeker); ok {
+		if start, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			hash, err := hashReaderSHA256(request.Body)
+			if _, seekErr := seeker.Seek(start, io.SeekStart); err == nil && seekErr == nil {
+				return hash
+			}
+		}
+	}
+	if request.GetBody != nil {
+		if body, err := request.GetBody(); err == nil {
+			hash, err := hashReaderSHA256(body)
+			body.Close()
+			if err == nil {
+				return hash
+			}
+		}
+	}
+	return hashSHA256(readAndReplaceBody(request))
+}
+
 func hashMD5(content []byte) string {
 	h := md5.New()
 	h.Write(content)
 	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
+// readAndReplaceBody reads the whole request body and puts an equivalent one
+// back in its place. GetBody is set as well so the request can be replayed.
 func readAndReplaceBody(request *http.Request) []byte {
 	if request.Body == nil {
 		return []byte{}
 	}
 	payload, _ := ioutil.ReadAll(request.Body)
-	request.Body = ioutil.NopCloser(bytes.NewReader(payload))
+	request.Body.Close()
+	replaceBody(request, payload)
 	return payload
 }
 
+func replaceBody(request *http.Request, payload []byte) {
+	request.Body = ioutil.NopCloser(bytes.NewReader(payload))
+	request.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(payload)), nil
+	}
+}
+
+// cloneRequest returns a deep copy of the request, including a body that can
+// be read without draining the original.
+func cloneRequest(request *http.Request) (*http.Request, error) {
+	clone := request.Clone(request.Context())
+	if request.Body == nil || request.Body == http.NoBody {
+		return clone, nil
+	}
+
+	if request.GetBody == nil {
+		readAndReplaceBody(request)
+	}
+
+	body, err := request.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	clone.Body = body
+	return clone, nil
+}
+
 func concat(delim string, str ...string) string {
 	return strings.Join(str, delim)
 }
@@ -286,6 +1138,40 @@ func normuri(uri string) string {
 	return strings.Join(parts, "/")
 }
 
+// normescapeduri encodes an escaped path the way normuri encodes an unescaped
+// one, decoding each segment first, so that encoded slashes stay encoded.
+func normescapeduri(uri string) string {
+	parts := strings.Split(uri, "/")
+	for i := range parts {
+		if part, err := url.PathUnescape(parts[i]); err == nil {
+			parts[i] = part
+		}
+		parts[i] = encodePathFrag(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
+
+// escapedPath returns the path of a URL as it is sent, taken from Opaque for
+// URLs that set it.
+func escapedPath(u *url.URL) string {
+	uri := u.EscapedPath()
+	if u.Opaque != "" {
+		uri = u.Opaque
+		if strings.HasPrefix(uri, "//") {
+			// An opaque //host/path names the host too
+			if i := strings.Index(uri[2:], "/"); i >= 0 {
+				uri = uri[2+i:]
+			} else {
+				uri = ""
+			}
+		}
+	}
+	if uri == "" {
+		uri = "/"
+	}
+	return uri
+}
+
 func encodePathFrag(s string) string {
 	hexCount := 0
 	for i := 0; i < len(s); i++ {
@@ -324,8 +1210,16 @@ func shouldEscape(c byte) bool {
 	return true
 }
 
+// normquery builds a canonical query string from the values, sorted by name
+// and then by value.
 func normquery(v url.Values) string {
-	queryString := v.Encode()
+	sorted := url.Values{}
+	for key, values := range v {
+		values = append([]string(nil), values...)
+		sort.Strings(values)
+		sorted[key] = values
+	}
+	queryString := sorted.Encode()
 
 	// Go encodes a space as '+' but Amazon requires '%20'. Luckily any '+' in the
 	// original query string has been percent escaped so all '+' chars that are left
@@ -1,8 +1,20 @@
 package awsauth
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -36,6 +48,193 @@ func TestCommonFunctions(t *testing.T) {
 		service, region = serviceAndRegion("s3-external-1.amazonaws.com")
 		So(service, ShouldEqual, "s3")
 		So(region, ShouldEqual, "us-east-1")
+
+		service, region = serviceAndRegion("bucketname.s3.eu-west-1.amazonaws.com")
+		So(service, ShouldEqual, "s3")
+		So(region, ShouldEqual, "eu-west-1")
+	})
+
+	Convey("Service and region should be properly extracted from compound service hosts", t, func() {
+		hosts := []struct{ host, service, region string }{
+			{"s3-object-lambda.us-west-2.amazonaws.com", "s3-object-lambda", "us-west-2"},
+			{"myap-123456789012.s3-object-lambda.us-west-2.amazonaws.com", "s3-object-lambda", "us-west-2"},
+			{"myap-123456789012.s3-accesspoint.eu-central-1.amazonaws.com", "s3", "eu-central-1"},
+			{"s3-accesspoint.ap-south-1.amazonaws.com", "s3", "ap-south-1"},
+			{"search-domain.us-west-1.es.amazonaws.com", "es", "us-west-1"},
+			{"mfzwi23gnjvgw.mrap.accesspoint.s3-global.amazonaws.com", "s3", "us-east-1"},
+			{"myap-123456789012.s3-accesspoint.dualstack.us-west-2.amazonaws.com", "s3", "us-west-2"},
+			{"myap-123456789012.s3-accesspoint-fips.us-gov-east-1.amazonaws.com", "s3", "us-gov-east-1"},
+			{"myap-123456789012.op-01ac5d28a6a232904.s3-outposts.us-west-2.amazonaws.com", "s3-outposts", "us-west-2"},
+			{"myap-123456789012.op-01ac5d28a6a232904.s3-outposts-fips.us-gov-west-1.amazonaws.com", "s3-outposts", "us-gov-west-1"},
+			{"s3-outposts.us-west-2.amazonaws.com", "s3-outposts", "us-west-2"},
+			{"myap-123456789012.s3-object-lambda-fips.us-east-2.amazonaws.com", "s3-object-lambda", "us-east-2"},
+			{"myap-123456789012.s3-object-lambda.dualstack.us-west-2.amazonaws.com", "s3-object-lambda", "us-west-2"},
+			{"myap-123456789012.s3-object-lambda.cn-north-1.amazonaws.com.cn", "s3-object-lambda", "cn-north-1"},
+			{"abc123.execute-api.us-east-1.amazonaws.com", "execute-api", "us-east-1"},
+			{"abc123-vpce-0123456789abcdef0.execute-api.eu-west-1.amazonaws.com", "execute-api", "eu-west-1"},
+			{"vpce-0123456789abcdef0-abcdefgh.execute-api.eu-west-1.vpce.amazonaws.com", "execute-api", "eu-west-1"},
+			{"vpce-0123456789abcdef0-abcdefgh.sqs.us-west-2.vpce.amazonaws.com", "sqs", "us-west-2"},
+			{"bucket.vpce-0123456789abcdef0-abcdefgh.s3.us-west-2.vpce.amazonaws.com", "s3", "us-west-2"},
+			{"example.appsync-api.eu-west-2.amazonaws.com", "appsync", "eu-west-2"},
+			{"example.appsync-realtime-api.eu-west-2.amazonaws.com", "appsync", "eu-west-2"},
+			{"db.cluster-abc123.eu-west-1.neptune.amazonaws.com", "neptune-db", "eu-west-1"},
+			{"transcribestreaming.us-east-1.amazonaws.com", "transcribe", "us-east-1"},
+		}
+		for _, h := range hosts {
+			service, region := serviceAndRegion(h.host)
+			So(service, ShouldEqual, h.service)
+			So(region, ShouldEqual, h.region)
+		}
+	})
+
+	Convey("Dualstack, FIPS and other partitions' hosts should be parsed", t, func() {
+		hosts := []struct{ host, service, region string }{
+			{"s3.dualstack.eu-west-1.amazonaws.com", "s3", "eu-west-1"},
+			{"bucket.s3.dualstack.eu-west-1.amazonaws.com", "s3", "eu-west-1"},
+			{"s3-fips.dualstack.us-east-2.amazonaws.com", "s3", "us-east-2"},
+			{"bucket.s3-fips.us-gov-west-1.amazonaws.com", "s3", "us-gov-west-1"},
+			{"ec2-fips.us-gov-west-1.amazonaws.com", "ec2", "us-gov-west-1"},
+			{"kms-fips.us-west-2.amazonaws.com", "kms", "us-west-2"},
+			{"dynamodb.fips.us-east-1.amazonaws.com", "dynamodb", "us-east-1"},
+			{"ec2.us-east-1.api.aws", "ec2", "us-east-1"},
+			{"sqs.cn-north-1.amazonaws.com.cn", "sqs", "cn-north-1"},
+			{"bucket.s3.cn-northwest-1.amazonaws.com.cn", "s3", "cn-northwest-1"},
+			{"s3.amazonaws.com.cn", "s3", "cn-north-1"},
+			{"sqs.us-iso-east-1.c2s.ic.gov", "sqs", "us-iso-east-1"},
+			{"ec2.us-isob-east-1.sc2s.sgov.gov", "ec2", "us-isob-east-1"},
+			{"iam.cn-north-1.amazonaws.com.cn", "iam", "cn-north-1"},
+			{"iam.us-gov.amazonaws.com", "iam", "us-gov-west-1"},
+			{"iam.us-isob-east-1.sc2s.sgov.gov", "iam", "us-isob-east-1"},
+			{"sqs.eu-isoe-west-1.cloud.adc-e.uk", "sqs", "eu-isoe-west-1"},
+			{"sqs.us-isof-south-1.csp.hci.ic.gov", "sqs", "us-isof-south-1"},
+			{"sqs.cn-northwest-1.amazonaws.com.cn", "sqs", "cn-northwest-1"},
+			{"iam.amazonaws.com.cn", "iam", "cn-north-1"},
+			{"abc123.execute-api.cn-northwest-1.amazonaws.com.cn", "execute-api", "cn-northwest-1"},
+		}
+		for _, h := range hosts {
+			service, region := serviceAndRegion(h.host)
+			So(service, ShouldEqual, h.service)
+			So(region, ShouldEqual, h.region)
+		}
+	})
+
+	Convey("S3 hosts should be parsed whatever the bucket is called", t, func() {
+		t.Setenv(envRegion, "ap-northeast-1")
+		hosts := []struct{ host, service, region string }{
+			{"assets.example.com.s3.amazonaws.com", "s3", "us-east-1"},
+			{"assets.example.com.s3.eu-west-1.amazonaws.com", "s3", "eu-west-1"},
+			{"assets.example.com.s3-us-west-2.amazonaws.com", "s3", "us-west-2"},
+			{"assets.example.com.s3.dualstack.sa-east-1.amazonaws.com", "s3", "sa-east-1"},
+			{"www.example.com.s3-external-1.amazonaws.com", "s3", "us-east-1"},
+			{"s3.us-west-2.amazonaws.com", "s3", "us-west-2"},
+			{"bucket.s3-accelerate.amazonaws.com", "s3", "ap-northeast-1"},
+			{"my.bucket.s3-accelerate.dualstack.amazonaws.com", "s3", "ap-northeast-1"},
+		}
+		for _, h := range hosts {
+			service, region := serviceAndRegion(h.host)
+			So(service, ShouldEqual, h.service)
+			So(region, ShouldEqual, h.region)
+		}
+	})
+
+	Convey("Global services should always be signed for us-east-1", t, func() {
+		hosts := map[string]string{
+			"iam.amazonaws.com":               "iam",
+			"cloudfront.amazonaws.com":        "cloudfront",
+			"route53.amazonaws.com":           "route53",
+			"iam.us-west-2.amazonaws.com":     "iam",
+			"route53.eu-west-1.amazonaws.com": "route53",
+		}
+		for host, expected := range hosts {
+			service, region := serviceAndRegion(host)
+			So(service, ShouldEqual, expected)
+			So(region, ShouldEqual, "us-east-1")
+		}
+	})
+
+	Convey("Given a registered partition", t, func() {
+		RegisterPartition("mycloud.net", "local-1")
+		defer func() {
+			partitions.Lock()
+			delete(partitions.defaultRegions, "mycloud.net")
+			partitions.Unlock()
+		}()
+
+		Convey("Its hosts should be parsed without the suffix", func() {
+			service, region := serviceAndRegion("s3.eu-1.mycloud.net")
+			So(service, ShouldEqual, "s3")
+			So(region, ShouldEqual, "eu-1")
+
+			service, region = serviceAndRegion("bucket.s3.eu-1.mycloud.net:9000")
+			So(service, ShouldEqual, "s3")
+			So(region, ShouldEqual, "eu-1")
+		})
+
+		Convey("Its default region should be used when the host names none", func() {
+			service, region := serviceAndRegion("s3.mycloud.net")
+			So(service, ShouldEqual, "s3")
+			So(region, ShouldEqual, "local-1")
+
+			service, region = serviceAndRegion("iam.mycloud.net")
+			So(service, ShouldEqual, "iam")
+			So(region, ShouldEqual, "local-1")
+		})
+
+		Convey("Other hosts should be parsed as before", func() {
+			service, region := serviceAndRegion("sqs.us-west-2.amazonaws.com")
+			So(service, ShouldEqual, "sqs")
+			So(region, ShouldEqual, "us-west-2")
+		})
+	})
+
+	Convey("Given a registered custom endpoint", t, func() {
+		t.Setenv(envRegion, "eu-west-3")
+		RegisterEndpoint("minio.internal:9000", "s3", "")
+		RegisterEndpoint("localhost", "sqs", "us-east-2")
+		defer func() {
+			endpoints.Lock()
+			delete(endpoints.scopes, "minio.internal:9000")
+			delete(endpoints.scopes, "localhost")
+			endpoints.Unlock()
+		}()
+
+		Convey("Its requests should be signed for its service and region", func() {
+			service, region := serviceAndRegion("localhost:4566")
+			So(service, ShouldEqual, "sqs")
+			So(region, ShouldEqual, "us-east-2")
+		})
+
+		Convey("Its region should default to the configured one", func() {
+			service, region := serviceAndRegion("minio.internal:9000")
+			So(service, ShouldEqual, "s3")
+			So(region, ShouldEqual, "eu-west-3")
+		})
+
+		Convey("Other ports on its host should not match", func() {
+			service, _ := serviceAndRegion("minio.internal:9001")
+			So(service, ShouldEqual, "minio")
+		})
+	})
+
+	Convey("Given service endpoints in the environment", t, func() {
+		t.Setenv(envRegion, "ap-south-1")
+		t.Setenv(envEndpointURL+"_DYNAMODB", "http://localhost:8000")
+		t.Setenv(envEndpointURL+"_CLOUDWATCH_LOGS", "http://localhost:4566")
+
+		Convey("Requests to them should be signed for their service", func() {
+			service, region := serviceAndRegion("localhost:8000")
+			So(service, ShouldEqual, "dynamodb")
+			So(region, ShouldEqual, "ap-south-1")
+
+			service, _ = serviceAndRegion("localhost:4566")
+			So(service, ShouldEqual, "logs")
+		})
+
+		Convey("They should be ignored when configured endpoints are", func() {
+			t.Setenv(envIgnoreEndpointURLs, "true")
+			service, _ := serviceAndRegion("localhost:8000")
+			So(service, ShouldEqual, "localhost")
+		})
 	})
 
 	Convey("MD5 hashes should be properly computed and base-64 encoded", t, func() {
@@ -85,5 +284,650 @@ func TestCommonFunctions(t *testing.T) {
 
 	Convey("URI query strings should be properly encoded", t, func() {
 		So(normquery(url.Values{"p": []string{" +&;-=._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"}}), ShouldEqual, "p=%20%2B%26%3B-%3D._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz")
+		So(normquery(url.Values{"b": []string{"2", "1"}, "a": []string{"z"}}), ShouldEqual, "a=z&b=1&b=2")
+	})
+}
+
+func TestCredentialsStore(t *testing.T) {
+	Convey("Given credentials in the environment", t, func() {
+		defer test_restoreCredentials()()
+		t.Setenv(envAccessKeyID, "AKIDFIRST")
+		t.Setenv(envSecretAccessKey, "first-secret")
+
+		So(RefreshCredentials(), ShouldBeNil)
+
+		Convey("They should be the current credentials", func() {
+			credentials, err := CurrentCredentials()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDFIRST")
+		})
+
+		Convey("A refresh should pick up new values before they expire", func() {
+			t.Setenv(envAccessKeyID, "AKIDSECOND")
+			t.Setenv(envSecretAccessKey, "second-secret")
+
+			So(RefreshCredentials(), ShouldBeNil)
+			credentials, err := CurrentCredentials()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDSECOND")
+		})
+	})
+
+	Convey("Given credentials that were changed in the environment", t, func() {
+		defer test_restoreCredentials()()
+		t.Setenv(envAccessKeyID, "AKIDFIRST")
+		t.Setenv(envSecretAccessKey, "first-secret")
+		So(RefreshCredentials(), ShouldBeNil)
+
+		t.Setenv(envAccessKeyID, "AKIDRELOADED")
+		t.Setenv(envSecretAccessKey, "reloaded-secret")
+		t.Setenv(envSessionToken, "")
+		t.Setenv(envSecurityToken, "reloaded-token")
+
+		Convey("Reloading them should make the new values current", func() {
+			So(ReloadEnvCredentials(), ShouldBeNil)
+
+			credentials, err := CurrentCredentials()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDRELOADED")
+			So(credentials.SecretAccessKey, ShouldEqual, "reloaded-secret")
+			So(credentials.SecurityToken, ShouldEqual, "reloaded-token")
+		})
+
+		Convey("Requests should then be signed with the new values", func() {
+			So(ReloadEnvCredentials(), ShouldBeNil)
+
+			request := Sign4(test_plainRequestV4(true))
+			So(request.Header.Get("Authorization"), ShouldContainSubstring, "Credential=AKIDRELOADED/")
+		})
+
+		Convey("Reloading an empty environment should keep the current values", func() {
+			t.Setenv(envAccessKeyID, "")
+			t.Setenv(envSecretAccessKey, "")
+
+			So(ReloadEnvCredentials(), ShouldEqual, ErrNoCredentials)
+
+			credentials, _ := CurrentCredentials()
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDFIRST")
+		})
+	})
+
+	Convey("Given no credentials anywhere", t, func() {
+		defer test_restoreCredentials()()
+		defer test_notOnEC2()()
+		t.Setenv(envAccessKeyID, "")
+		t.Setenv(envAccessKey, "")
+		t.Setenv(envSecretAccessKey, "")
+		t.Setenv(envSecretKey, "")
+		t.Setenv(envSharedCredentialsFile, filepath.Join(t.TempDir(), "credentials"))
+		t.Setenv(envConfigFile, filepath.Join(t.TempDir(), "config"))
+		t.Setenv(envContainerRelativeURI, "")
+		t.Setenv(envContainerFullURI, "")
+		t.Setenv(envRoleARN, "")
+
+		Convey("Refreshing should report that none were found", func() {
+			So(RefreshCredentials(), ShouldEqual, ErrNoCredentials)
+		})
+
+		Convey("The current credentials should report that none were found", func() {
+			_, err := CurrentCredentials()
+			So(err, ShouldEqual, ErrNoCredentials)
+		})
+	})
+
+	Convey("Given a provider that fails and then recovers", t, func() {
+		provider := &test_provider{err: ErrMetadataUnavailable}
+		store := &CredentialsStore{providers: []CredentialProvider{provider}}
+
+		_, err := store.Current()
+		So(err, ShouldEqual, ErrMetadataUnavailable)
+
+		provider.Lock()
+		provider.err, provider.credentials = nil, *testCredV4
+		provider.Unlock()
+
+		Convey("The failure should not be remembered", func() {
+			credentials, err := store.Current()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, testCredV4.AccessKeyID)
+			So(provider.retrieved, ShouldEqual, 2)
+		})
+	})
+
+	Convey("Given a lookup that was given up on", t, func() {
+		provider := &test_provider{credentials: *testCredV4}
+		store := &CredentialsStore{providers: []CredentialProvider{provider}}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := store.CurrentCtx(ctx)
+		So(errors.Is(err, context.Canceled), ShouldBeTrue)
+
+		Convey("The next lookup should find the credentials", func() {
+			credentials, err := store.Current()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, testCredV4.AccessKeyID)
+		})
+	})
+
+	Convey("Given stored credentials that fail to refresh", t, func() {
+		provider := &test_provider{credentials: *testCredV4}
+		store := &CredentialsStore{providers: []CredentialProvider{provider}}
+		store.Current()
+
+		provider.Lock()
+		provider.err = ErrMetadataUnavailable
+		provider.Unlock()
+
+		Convey("The stored credentials should be kept", func() {
+			So(store.Refresh(), ShouldEqual, ErrMetadataUnavailable)
+			credentials, err := store.Current()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, testCredV4.AccessKeyID)
+		})
+	})
+}
+
+func TestConcurrentSigning(t *testing.T) {
+	Convey("Given many requests signed at once with looked-up credentials", t, func() {
+		defer test_restoreCredentials()()
+		provider := &test_provider{credentials: *testCredV4}
+		SetCredentialProviders(provider)
+
+		var wg sync.WaitGroup
+		signed := make([]*http.Request, 64)
+		for i := range signed {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				switch i % 4 {
+				case 0:
+					signed[i] = Sign4(test_plainRequestV4(false))
+				case 1:
+					signed[i] = Sign(newRequest("GET", "https://ec2.amazonaws.com", url.Values{"Action": {"DescribeInstances"}}))
+				case 2:
+					signed[i] = SignS3(test_plainRequestS3())
+				case 3:
+					signed[i] = Sign4A(test_plainRequestV4(false))
+				}
+				if i%16 == 0 {
+					RefreshCredentials()
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		Convey("Every request should be signed", func() {
+			for i, request := range signed {
+				if i%4 == 1 {
+					So(request.URL.Query().Get("Signature"), ShouldNotBeBlank)
+				} else {
+					So(request.Header.Get("Authorization"), ShouldNotBeBlank)
+				}
+			}
+		})
+
+		Convey("The credentials should only be retrieved once, besides refreshes", func() {
+			So(provider.retrieved, ShouldBeLessThanOrEqualTo, 5)
+		})
+	})
+}
+
+func TestCredentialsRefreshAhead(t *testing.T) {
+	Convey("Given credentials that are about to expire", t, func() {
+		defer test_mockNowV4("20230101T000000Z")()
+		expiring := Credentials{AccessKeyID: "AKIDOLD", SecretAccessKey: "old", Expiration: time.Date(2023, time.January, 1, 0, 10, 0, 0, time.UTC)}
+		provider := &test_provider{credentials: expiring}
+		store := &CredentialsStore{providers: []CredentialProvider{provider}}
+		store.Current()
+
+		provider.Lock()
+		provider.credentials = Credentials{AccessKeyID: "AKIDNEW", SecretAccessKey: "new", Expiration: time.Date(2023, time.January, 1, 1, 0, 0, 0, time.UTC)}
+		provider.Unlock()
+
+		Convey("They should be used while new ones are retrieved in the background", func() {
+			credentials, err := store.Current()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDOLD")
+
+			test_waitForRefresh(store)
+			credentials, _ = store.Current()
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDNEW")
+			So(provider.retrieved, ShouldEqual, 2)
+		})
+
+		Convey("They should be kept if new ones can't be retrieved", func() {
+			provider.Lock()
+			provider.err = ErrMetadataUnavailable
+			provider.Unlock()
+
+			store.Current()
+			test_waitForRefresh(store)
+			credentials, err := store.Current()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDOLD")
+		})
+
+		Convey("They should not be refreshed early with the window closed", func() {
+			store.SetRefreshWindow(0)
+
+			store.Current()
+			test_waitForRefresh(store)
+			So(provider.retrieved, ShouldEqual, 1)
+		})
+
+		Convey("A failed refresh should not be tried again on every signature", func() {
+			provider.Lock()
+			provider.err = ErrMetadataUnavailable
+			provider.Unlock()
+
+			for i := 0; i < 50; i++ {
+				store.Current()
+				test_waitForRefresh(store)
+			}
+			So(provider.retrieved, ShouldEqual, 2)
+
+			now = func() time.Time { return time.Date(2023, time.January, 1, 0, 0, 31, 0, time.UTC) }
+			store.Current()
+			test_waitForRefresh(store)
+			So(provider.retrieved, ShouldEqual, 3)
+		})
+
+		Convey("Credentials that come back as close to expiring should not be refreshed again right away", func() {
+			provider.Lock()
+			provider.credentials = expiring
+			provider.Unlock()
+
+			for i := 0; i < 50; i++ {
+				store.Current()
+				test_waitForRefresh(store)
+			}
+			So(provider.retrieved, ShouldEqual, 2)
+		})
+
+		Convey("A signer should refresh them with its own window", func() {
+			signer := NewSigner(provider, WithRefreshWindow(5*time.Minute))
+			signer.Credentials()
+			signer.Credentials()
+			test_waitForRefresh(signer.store)
+			So(provider.retrieved, ShouldEqual, 2)
+		})
+	})
+}
+
+// test_waitForRefresh waits for a background refresh of the store to finish.
+func test_waitForRefresh(store *CredentialsStore) {
+	for i := 0; i < 100; i++ {
+		store.RLock()
+		refreshing := store.refreshing
+		store.RUnlock()
+		if !refreshing {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEC2Detection(t *testing.T) {
+	Convey("Given the EC2 metadata service is disabled", t, func() {
+		t.Setenv(envEC2MetadataDisabled, "true")
+
+		loc.Lock()
+		checked := loc.checked
+		loc.checked = false
+		loc.Unlock()
+		defer func() {
+			loc.Lock()
+			loc.checked = checked
+			loc.Unlock()
+		}()
+
+		Convey("It should not be probed for", func() {
+			So(onEC2(context.Background()), ShouldBeFalse)
+
+			loc.RLock()
+			defer loc.RUnlock()
+			So(loc.checked, ShouldBeFalse)
+		})
+	})
+}
+
+func TestMetadataEndpoint(t *testing.T) {
+	Convey("Given no metadata service endpoint configured", t, func() {
+		t.Setenv(envEC2MetadataEndpoint, "")
+		t.Setenv(envEC2MetadataEndpointMode, "")
+
+		Convey("Its IPv4 address should be used", func() {
+			So(metadataURL(), ShouldEqual, "http://169.254.169.254/latest/meta-data/")
+			So(metadataAddress(), ShouldEqual, "169.254.169.254:80")
+		})
+
+		Convey("Its IPv6 address should be used in IPv6 mode", func() {
+			t.Setenv(envEC2MetadataEndpointMode, "IPv6")
+			So(metadataURL(), ShouldEqual, "http://[fd00:ec2::254]/latest/meta-data/")
+			So(metadataAddress(), ShouldEqual, "[fd00:ec2::254]:80")
+		})
+	})
+
+	Convey("Given a metadata service endpoint", t, func() {
+		t.Setenv(envEC2MetadataEndpoint, "https://metadata.internal:8443/")
+
+		Convey("It should be used", func() {
+			So(metadataURL(), ShouldEqual, "https://metadata.internal:8443/latest/meta-data/")
+			So(metadataAddress(), ShouldEqual, "metadata.internal:8443")
+		})
+	})
+
+	Convey("Given a malformed metadata service endpoint", t, func() {
+		t.Setenv(envEC2MetadataEndpoint, "http://[::1")
+		loc.Lock()
+		checked, ec2 := loc.checked, loc.ec2
+		loc.checked = false
+		loc.Unlock()
+		defer func() {
+			loc.Lock()
+			loc.checked, loc.ec2 = checked, ec2
+			loc.Unlock()
+		}()
+
+		Convey("It should be treated as unusable rather than panic", func() {
+			So(metadataAddress(), ShouldBeBlank)
+			So(onEC2(context.Background()), ShouldBeFalse)
+
+			_, err := getIAMRoleCredentials(context.Background())
+			So(errors.Is(err, ErrMetadataUnavailable), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given the metadata service is disabled in code", t, func() {
+		DisableEC2Metadata = true
+		defer func() { DisableEC2Metadata = false }()
+		defer test_notOnEC2()()
+		loc.Lock()
+		loc.checked = false
+		loc.Unlock()
+
+		Convey("It should not be probed for", func() {
+			So(onEC2(context.Background()), ShouldBeFalse)
+			loc.RLock()
+			defer loc.RUnlock()
+			So(loc.checked, ShouldBeFalse)
+		})
+	})
+}
+
+func TestIAMRoleCredentials(t *testing.T) {
+	Convey("Given an EC2 metadata service that returns errors", t, func() {
+		defer test_metadataServer(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "oops", http.StatusInternalServerError)
+		})()
+
+		Convey("It should be reported as unavailable", func() {
+			_, err := getIAMRoleCredentials(context.Background())
+			So(errors.Is(err, ErrMetadataUnavailable), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given an EC2 metadata service without any roles", t, func() {
+		defer test_metadataServer(func(w http.ResponseWriter, r *http.Request) {})()
+
+		Convey("No credentials should be found", func() {
+			_, err := getIAMRoleCredentials(context.Background())
+			So(err, ShouldEqual, ErrNoCredentials)
+		})
+	})
+
+	Convey("Given an EC2 metadata service that returns malformed credentials", t, func() {
+		defer test_metadataServer(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/security-credentials/") {
+				fmt.Fprintln(w, "role")
+				return
+			}
+			fmt.Fprint(w, "{not json")
+		})()
+
+		Convey("They should be reported as undecodable", func() {
+			_, err := getIAMRoleCredentials(context.Background())
+			So(errors.Is(err, ErrMetadataDecode), ShouldBeTrue)
+
+			var syntaxErr *json.SyntaxError
+			So(errors.As(err, &syntaxErr), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given an EC2 metadata service with a role", t, func() {
+		defer test_metadataServer(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/security-credentials/") {
+				fmt.Fprintln(w, "role")
+				return
+			}
+			fmt.Fprint(w, `{"AccessKeyId":"AKIDROLE","SecretAccessKey":"secret","Token":"token"}`)
+		})()
+
+		Convey("Its credentials should be returned", func() {
+			credentials, err := getIAMRoleCredentials(context.Background())
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDROLE")
+			So(credentials.SecurityToken, ShouldEqual, "token")
+		})
+	})
+}
+
+func TestMetadataToken(t *testing.T) {
+	Convey("Given an EC2 metadata service that hands out session tokens", t, func() {
+		defer test_mockNowV4("20230101T000000Z")()
+
+		puts, tokens := 0, []string{}
+		ttl := ""
+		defer test_metadataServer(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "PUT" {
+				puts++
+				ttl = r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds")
+				fmt.Fprintf(w, "token-%d", puts)
+				return
+			}
+			tokens = append(tokens, r.Header.Get("X-aws-ec2-metadata-token"))
+			if strings.HasSuffix(r.URL.Path, "/security-credentials/") {
+				fmt.Fprintln(w, "role")
+				return
+			}
+			fmt.Fprint(w, `{"AccessKeyId":"AKIDROLE","SecretAccessKey":"secret","Token":"token"}`)
+		})()
+
+		Convey("A token should be requested for the configured TTL and sent along", func() {
+			_, err := getIAMRoleCredentials(context.Background())
+			So(err, ShouldBeNil)
+			So(puts, ShouldEqual, 1)
+			So(ttl, ShouldEqual, "21600")
+			So(tokens, ShouldResemble, []string{"token-1", "token-1"})
+		})
+
+		Convey("A fresh token should be reused", func() {
+			getIAMRoleCredentials(context.Background())
+			now = func() time.Time { return time.Date(2023, time.January, 1, 5, 58, 0, 0, time.UTC) }
+			getIAMRoleCredentials(context.Background())
+
+			So(puts, ShouldEqual, 1)
+		})
+
+		Convey("A token about to expire should be replaced", func() {
+			getIAMRoleCredentials(context.Background())
+			now = func() time.Time { return time.Date(2023, time.January, 1, 5, 59, 30, 0, time.UTC) }
+			getIAMRoleCredentials(context.Background())
+
+			So(puts, ShouldEqual, 2)
+			So(tokens[len(tokens)-1], ShouldEqual, "token-2")
+		})
+
+		Convey("A shorter TTL should be honored", func() {
+			saved := MetadataTokenTTL
+			MetadataTokenTTL = 10 * time.Minute
+			defer func() { MetadataTokenTTL = saved }()
+
+			getIAMRoleCredentials(context.Background())
+			now = func() time.Time { return time.Date(2023, time.January, 1, 0, 9, 30, 0, time.UTC) }
+			getIAMRoleCredentials(context.Background())
+
+			So(ttl, ShouldEqual, "600")
+			So(puts, ShouldEqual, 2)
+		})
+	})
+
+	Convey("Given an EC2 metadata service without session tokens", t, func() {
+		defer test_mockNowV4("20230101T000000Z")()
+		puts := 0
+		defer test_metadataServer(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "PUT" {
+				puts++
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			if strings.HasSuffix(r.URL.Path, "/security-credentials/") {
+				fmt.Fprintln(w, "role")
+				return
+			}
+			fmt.Fprint(w, `{"AccessKeyId":"AKIDROLE","SecretAccessKey":"secret","Token":"token"}`)
+		})()
+
+		Convey("Credentials should be fetched without a token", func() {
+			credentials, err := getIAMRoleCredentials(context.Background())
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDROLE")
+		})
+
+		Convey("A token should not be asked for again right away", func() {
+			getIAMRoleCredentials(context.Background())
+			So(puts, ShouldEqual, 1)
+
+			now = func() time.Time { return time.Date(2023, time.January, 1, 0, 0, 11, 0, time.UTC) }
+			getIAMRoleCredentials(context.Background())
+			So(puts, ShouldEqual, 2)
+		})
+
+		Convey("Credentials should not be fetched without a token once IMDSv1 is disabled", func() {
+			t.Setenv(envEC2MetadataV1Disabled, "true")
+
+			_, err := getIAMRoleCredentials(context.Background())
+			So(errors.Is(err, ErrMetadataUnavailable), ShouldBeTrue)
+		})
+	})
+}
+
+// test_metadataServer serves the EC2 metadata service with the handler and
+// returns a function that shuts it down again.
+func test_metadataServer(handler http.HandlerFunc) func() {
+	server := httptest.NewServer(handler)
+	saved, set := os.LookupEnv(envEC2MetadataEndpoint)
+	os.Setenv(envEC2MetadataEndpoint, server.URL)
+	test_forgetMetadataToken()
+
+	return func() {
+		if set {
+			os.Setenv(envEC2MetadataEndpoint, saved)
+		} else {
+			os.Unsetenv(envEC2MetadataEndpoint)
+		}
+		test_forgetMetadataToken()
+		server.Close()
+	}
+}
+
+// test_forgetMetadataToken drops the cached metadata session token.
+func test_forgetMetadataToken() {
+	metadataToken.Lock()
+	metadataToken.value = ""
+	metadataToken.expires, metadataToken.retryAt = time.Time{}, time.Time{}
+	metadataToken.Unlock()
+}
+
+// test_restoreCredentials saves the cached credentials and their providers
+// and returns a function that puts them back.
+func test_restoreCredentials() func() {
+	gCredentialsStore.Lock()
+	saved, providers, source := gCredentialsStore.credentials, gCredentialsStore.providers, gCredentialsStore.source
+	gCredentialsStore.Unlock()
+
+	return func() {
+		gCredentialsStore.Lock()
+		gCredentialsStore.credentials, gCredentialsStore.providers, gCredentialsStore.source = saved, providers, source
+		gCredentialsStore.Unlock()
+	}
+}
+
+// test_onEC2 pretends the EC2 metadata service is reachable and returns a
+// function that undoes it.
+func test_onEC2() func() {
+	loc.Lock()
+	checked, ec2 := loc.checked, loc.ec2
+	loc.checked, loc.ec2 = true, true
+	loc.Unlock()
+
+	return func() {
+		loc.Lock()
+		loc.checked, loc.ec2 = checked, ec2
+		loc.Unlock()
+	}
+}
+
+// test_notOnEC2 pretends the EC2 metadata service is unreachable and returns
+// a function that undoes it.
+func test_notOnEC2() func() {
+	loc.Lock()
+	checked, ec2 := loc.checked, loc.ec2
+	loc.checked, loc.ec2 = true, false
+	loc.Unlock()
+
+	return func() {
+		loc.Lock()
+		loc.checked, loc.ec2 = checked, ec2
+		loc.Unlock()
+	}
+}
+
+func TestHashBody(t *testing.T) {
+	Convey("Given a request whose body is a file", t, func() {
+		path := filepath.Join(t.TempDir(), "upload")
+		os.WriteFile(path, []byte("skip:payload"), 0600)
+		file, _ := os.Open(path)
+		defer file.Close()
+		file.Seek(5, 0)
+
+		request, _ := http.NewRequest("PUT", "https://examplebucket.s3.amazonaws.com/upload", file)
+
+		Convey("The rest of the file should be hashed and left to be sent", func() {
+			So(hashBody(request), ShouldEqual, hashSHA256([]byte("payload")))
+			So(request.GetBody, ShouldBeNil)
+
+			payload, _ := io.ReadAll(request.Body)
+			So(string(payload), ShouldEqual, "payload")
+		})
+	})
+
+	Convey("Given a request that can make copies of its body", t, func() {
+		request, _ := http.NewRequest("PUT", "https://examplebucket.s3.amazonaws.com/upload", strings.NewReader("payload"))
+
+		Convey("A copy should be hashed and the body left unread", func() {
+			So(hashBody(request), ShouldEqual, hashSHA256([]byte("payload")))
+
+			payload, _ := io.ReadAll(request.Body)
+			So(string(payload), ShouldEqual, "payload")
+		})
+	})
+
+	Convey("Given a request with a body that can only be read once", t, func() {
+		request, _ := http.NewRequest("PUT", "https://examplebucket.s3.amazonaws.com/upload", io.MultiReader(strings.NewReader("payload")))
+
+		Convey("The body should be read and replaced", func() {
+			So(hashBody(request), ShouldEqual, hashSHA256([]byte("payload")))
+
+			payload, _ := io.ReadAll(request.Body)
+			So(string(payload), ShouldEqual, "payload")
+			So(request.GetBody, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a request without a body", t, func() {
+		request, _ := http.NewRequest("GET", "https://examplebucket.s3.amazonaws.com/upload", nil)
+		So(hashBody(request), ShouldEqual, emptyPayloadHash)
 	})
 }
@@ -0,0 +1,283 @@
+package awsauth
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fallbackRegion returns the region to sign for when a custom endpoint doesn't
+// name one. Like the AWS CLI, it looks at AWS_REGION, AWS_DEFAULT_REGION and
+// the region of the selected profile in the shared config file, in that
+// order, then at the region of the EC2 instance the program runs on, and
+// settles on us-east-1 if none of them is set.
+func fallbackRegion() string {
+	return fallbackRegionCtx(context.Background())
+}
+
+// fallbackRegionCtx is fallbackRegion, asking the metadata service with ctx.
+func fallbackRegionCtx(ctx context.Context) string {
+	if region := os.Getenv(envRegion); region != "" {
+		return region
+	}
+	if region := os.Getenv(envDefaultRegion); region != "" {
+		return region
+	}
+	if region := profileRegion(); region != "" {
+		return region
+	}
+	if region := instanceRegion(ctx); region != "" {
+		return region
+	}
+	return "us-east-1"
+}
+
+// CurrentRegion returns the region the program is configured for: the one in
+// AWS_REGION, AWS_DEFAULT_REGION or the selected profile of the shared config
+// file, or else the region of the EC2 instance it runs on, or else us-east-1.
+// Requests to hosts that don't name a region are signed for it.
+func CurrentRegion() string {
+	return fallbackRegion()
+}
+
+// CurrentRegionCtx is CurrentRegion, with ctx bounding the request to the EC2
+// instance metadata service if it has to be asked.
+func CurrentRegionCtx(ctx context.Context) string {
+	return fallbackRegionCtx(ctx)
+}
+
+// placement caches the region of the EC2 instance, which doesn't change. When
+// the metadata service can't be asked, it isn't asked again until retryAt.
+type placement struct {
+	region  string
+	checked bool
+	retryAt time.Time
+	sync.Mutex
+}
+
+var instancePlacement placement
+
+// placementRetryDelay is how long instanceRegion waits before asking the
+// metadata service again after it failed to answer.
+const placementRetryDelay = time.Minute
+
+// instanceRegion returns the region of the EC2 instance the program runs on,
+// as the instance metadata service tells it, or an empty string when not on
+// EC2 or when the service doesn't answer. The lock isn't held while asking.
+func instanceRegion(ctx context.Context) string {
+	instancePlacement.Lock()
+	if instancePlacement.checked || now().Before(instancePlacement.retryAt) {
+		region := instancePlacement.region
+		instancePlacement.Unlock()
+		return region
+	}
+	instancePlacement.Unlock()
+
+	region, definite := getInstanceRegion(ctx)
+
+	instancePlacement.Lock()
+	defer instancePlacement.Unlock()
+	if definite {
+		instancePlacement.region, instancePlacement.checked = region, true
+	} else if ctx.Err() == nil {
+		instancePlacement.retryAt = now().Add(placementRetryDelay)
+	}
+	return region
+}
+
+// getInstanceRegion asks the metadata service for the region of the EC2
+// instance. It reports whether the answer is definite: a region, or the
+// program not being on EC2, rather than the service failing to answer.
+func getInstanceRegion(ctx context.Context) (string, bool) {
+	if !onEC2(ctx) {
+		return "", ctx.Err() == nil
+	}
+	request, err := newMetadataRequest(ctx, metadataURL()+"placement/region")
+	if err != nil {
+		return "", false
+	}
+	response, err := metadataClient().Do(request)
+	if err != nil {
+		return "", false
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", response.StatusCode == http.StatusNotFound
+	}
+	region, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(region)), true
+}
+
+// profileRegion returns the region of the selected profile in the shared
+// config file, or an empty string if the file can't be read or the profile
+// doesn't set a region. Like credentials read from the shared files, it is
+// read once and kept.
+func profileRegion() string {
+	key := [2]string{sharedFile(envConfigFile, "config"), configSection(selectedProfile())}
+
+	profileRegions.RLock()
+	region, ok := profileRegions.regions[key]
+	profileRegions.RUnlock()
+	if ok {
+		return region
+	}
+
+	region = readProfile(key[0], key[1])["region"]
+	profileRegions.Lock()
+	defer profileRegions.Unlock()
+	if profileRegions.regions == nil {
+		profileRegions.regions = map[[2]string]string{}
+	}
+	profileRegions.regions[key] = region
+	return region
+}
+
+// regionCache keeps the regions of the profiles in each config file that have
+// been read.
+type regionCache struct {
+	regions map[[2]string]string
+	sync.RWMutex
+}
+
+var profileRegions regionCache
+
+// envEndpointService returns the service whose AWS_ENDPOINT_URL_<SERVICE>
+// variable points at a host. The AWS SDKs send a service's requests to the
+// endpoint in that variable, unless AWS_IGNORE_CONFIGURED_ENDPOINT_URLS is
+// true.
+func envEndpointService(host string) (string, bool) {
+	if strings.EqualFold(os.Getenv(envIgnoreEndpointURLs), "true") {
+		return "", false
+	}
+
+	for _, variable := range os.Environ() {
+		name, value, _ := strings.Cut(variable, "=")
+		if !strings.HasPrefix(name, envEndpointURL+"_") || value == "" {
+			continue
+		}
+		id := strings.TrimPrefix(name, envEndpointURL+"_")
+		endpoint, err := url.Parse(value)
+		if err != nil || endpoint.Host == "" {
+			continue
+		}
+		if strings.EqualFold(endpoint.Host, host) || (endpoint.Port() == "" && strings.EqualFold(endpoint.Hostname(), host)) {
+			return endpointService(id), true
+		}
+	}
+	return "", false
+}
+
+// endpointService turns the service ID in the name of an
+// AWS_ENDPOINT_URL_<SERVICE> variable into the service name signed for.
+func endpointService(id string) string {
+	service := strings.ToLower(strings.ReplaceAll(id, "_", ""))
+	if signingName, ok := endpointSigningNames[service]; ok {
+		return signingName
+	}
+	return service
+}
+
+// endpointSigningNames lists the services whose ID doesn't match the name
+// their requests are signed for.
+var endpointSigningNames = map[string]string{
+	"cloudwatch":     "monitoring",
+	"cloudwatchlogs": "logs",
+	"eventbridge":    "events",
+	"sfn":            "states",
+	"sesv2":          "ses",
+}
+
+// configSection returns the name of the section of the shared config file
+// that holds a profile: [default] for the default profile, and
+// [profile name] for any other. The credentials file names them [name].
+func configSection(profile string) string {
+	if profile == "default" {
+		return profile
+	}
+	return "profile " + profile
+}
+
+// selectedProfile returns the name of the profile named by AWS_PROFILE, or of
+// the default profile.
+func selectedProfile() string {
+	if profile := os.Getenv(envProfile); profile != "" {
+		return profile
+	}
+	return "default"
+}
+
+// sharedFile returns the path of a shared AWS file: the one in the named
+// environment variable if set, or else the named file in ~/.aws.
+func sharedFile(env, name string) string {
+	if path := os.Getenv(env); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".aws", name)
+}
+
+// readProfile reads the settings in a section of a shared config or
+// credentials file. It returns no settings if the file can't be read.
+func readProfile(path, section string) map[string]string {
+	file, err := os.Open(path)
+	if err != nil {
+		return map[string]string{}
+	}
+	defer file.Close()
+
+	return readConfigSection(file, section)
+}
+
+// readConfigSection reads the settings in a section of a file in the format
+// of ~/.aws/config and ~/.aws/credentials. Nested settings, which are
+// indented under a key with no value, are skipped.
+func readConfigSection(file io.Reader, section string) map[string]string {
+	settings := map[string]string{}
+	inProfile, nested := false, false
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.Join(strings.Fields(line[1:len(line)-1]), " ")
+			inProfile = name == section
+			nested = false
+			continue
+		}
+		if !inProfile {
+			continue
+		}
+		if nested && raw != strings.TrimLeft(raw, " \t") {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		nested = value == ""
+		settings[key] = value
+	}
+
+	return settings
+}
@@ -0,0 +1,150 @@
+package awsauth
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFallbackRegion(t *testing.T) {
+	Convey("Given a shared config file with profile regions", t, func() {
+		path := filepath.Join(t.TempDir(), "config")
+		os.WriteFile(path, []byte(test_configFile), 0600)
+
+		t.Setenv(envConfigFile, path)
+		t.Setenv(envProfile, "")
+		t.Setenv(envRegion, "")
+		t.Setenv(envDefaultRegion, "")
+		defer test_notOnEC2()()
+		defer test_forgetPlacement()()
+
+		Convey("A custom endpoint should be signed for the default profile's region", func() {
+			service, region := serviceAndRegion("storage.example.com")
+			So(service, ShouldEqual, "storage")
+			So(region, ShouldEqual, "us-west-1")
+		})
+
+		Convey("A custom endpoint should be signed for the selected profile's region", func() {
+			t.Setenv(envProfile, "dev")
+
+			_, region := serviceAndRegion("storage.example.com:9000")
+			So(region, ShouldEqual, "eu-west-2")
+		})
+
+		Convey("AWS_DEFAULT_REGION should take precedence over the config file", func() {
+			t.Setenv(envDefaultRegion, "ap-south-1")
+
+			_, region := serviceAndRegion("storage.example.com")
+			So(region, ShouldEqual, "ap-south-1")
+		})
+
+		Convey("AWS_REGION should take precedence over AWS_DEFAULT_REGION", func() {
+			t.Setenv(envDefaultRegion, "ap-south-1")
+			t.Setenv(envRegion, "ca-central-1")
+
+			_, region := serviceAndRegion("storage.example.com")
+			So(region, ShouldEqual, "ca-central-1")
+		})
+
+		Convey("The config file should only be read once", func() {
+			So(profileRegion(), ShouldEqual, "us-west-1")
+			os.WriteFile(path, []byte("[default]\nregion = eu-west-1\n"), 0600)
+			So(profileRegion(), ShouldEqual, "us-west-1")
+		})
+
+		Convey("A region in the host should take precedence over the configured one", func() {
+			t.Setenv(envRegion, "ca-central-1")
+
+			_, region := serviceAndRegion("sqs.eu-central-1.example.com")
+			So(region, ShouldEqual, "eu-central-1")
+		})
+
+		Convey("AWS hosts without a region should still be signed for us-east-1", func() {
+			t.Setenv(envProfile, "dev")
+
+			_, region := serviceAndRegion("s3.amazonaws.com")
+			So(region, ShouldEqual, "us-east-1")
+		})
+
+		Convey("A profile without a region should fall back to us-east-1", func() {
+			t.Setenv(envProfile, "nested")
+
+			_, region := serviceAndRegion("storage.example.com")
+			So(region, ShouldEqual, "us-east-1")
+		})
+
+		Convey("A missing config file should fall back to us-east-1", func() {
+			t.Setenv(envConfigFile, filepath.Join(t.TempDir(), "missing"))
+
+			_, region := serviceAndRegion("storage.example.com")
+			So(region, ShouldEqual, "us-east-1")
+		})
+
+		Convey("On EC2 without a configured region, the instance's region should be used", func() {
+			t.Setenv(envProfile, "nested")
+			defer test_onEC2()()
+			defer test_metadataServer(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/latest/meta-data/placement/region" {
+					fmt.Fprint(w, "sa-east-1")
+				}
+			})()
+
+			So(CurrentRegion(), ShouldEqual, "sa-east-1")
+			_, region := serviceAndRegion("storage.example.com")
+			So(region, ShouldEqual, "sa-east-1")
+		})
+
+		Convey("A metadata service that fails to answer should be asked again later", func() {
+			t.Setenv(envProfile, "nested")
+			defer test_mockNowV4("20230101T000000Z")()
+			defer test_onEC2()()
+			failing := true
+			defer test_metadataServer(func(w http.ResponseWriter, r *http.Request) {
+				if failing {
+					w.WriteHeader(http.StatusInternalServerError)
+				} else if r.URL.Path == "/latest/meta-data/placement/region" {
+					fmt.Fprint(w, "sa-east-1")
+				}
+			})()
+
+			So(CurrentRegion(), ShouldEqual, "us-east-1")
+			failing = false
+			So(CurrentRegion(), ShouldEqual, "us-east-1")
+
+			now = func() time.Time { return time.Date(2023, time.January, 1, 0, 2, 0, 0, time.UTC) }
+			So(CurrentRegion(), ShouldEqual, "sa-east-1")
+		})
+	})
+}
+
+// test_forgetPlacement drops the cached region of the EC2 instance and returns
+// a function that drops it again.
+func test_forgetPlacement() func() {
+	forget := func() {
+		instancePlacement.Lock()
+		instancePlacement.region, instancePlacement.checked, instancePlacement.retryAt = "", false, time.Time{}
+		instancePlacement.Unlock()
+	}
+	forget()
+	return forget
+}
+
+const test_configFile = `# Shared AWS settings
+[default]
+region = us-west-1
+output = json
+
+[profile dev]
+; the development account
+region=eu-west-2
+
+[profile nested]
+s3 =
+  region = eu-north-1
+output = text
+`
@@ -0,0 +1,134 @@
+package awsauth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// EventStreamSigner signs the messages sent on an event stream
+// (application/vnd.amazon.eventstream), as Transcribe streaming and the
+// Kinesis and Lex streaming APIs take them. Each message is signed with the
+// signature of the one before it, the first with the seed signature of the
+// request, or presigned URL, that opened the stream, so messages must be
+// signed in the order they are sent. It is safe for concurrent use.
+type EventStreamSigner struct {
+	keys      Credentials
+	region    string
+	service   string
+	signature []byte
+	sync.Mutex
+}
+
+// NewEventStreamSigner returns a signer for the messages of a stream opened
+// with the given seed signature, as a hex string, for the given region and
+// service.
+func NewEventStreamSigner(seedSignature, region, service string, keys Credentials) (*EventStreamSigner, error) {
+	signature, err := hex.DecodeString(seedSignature)
+	if err != nil {
+		return nil, err
+	}
+	return &EventStreamSigner{keys: keys, region: region, service: service, signature: signature}, nil
+}
+
+func sign4EventStream(request *http.Request, meta *metadata, credentials []Credentials) (*EventStreamSigner, error) {
+	keys, err := credentialsV4(request, meta, credentials)
+	if err != nil {
+		return nil, err
+	}
+	if anonymous(keys) {
+		return &EventStreamSigner{keys: keys}, nil
+	}
+
+	meta.payloadHash = streamingEventsV4
+	sign4(request, meta, []Credentials{keys})
+	return NewEventStreamSigner(meta.signature, meta.region, meta.service, keys)
+}
+
+// Sign signs the payload of the next message, which is empty for the message
+// that ends the stream, and returns the values of its :date and
+// :chunk-signature headers.
+func (s *EventStreamSigner) Sign(payload []byte) (time.Time, []byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	date := now().Truncate(time.Millisecond)
+	timestamp := date.Format(timeFormatV4)
+	scope := concat("/", tsDateV4(timestamp), s.region, s.service, "aws4_request")
+
+	stringToSign := concat("\n", streamingChunkAlgorithmV4, timestamp, scope,
+		hex.EncodeToString(s.signature),
+		hashSHA256(encodeEventHeaders(eventHeader{":date", date})),
+		hashSHA256(payload))
+	signingKey := keyCache.signingKey(s.keys.SecretAccessKey, tsDateV4(timestamp), s.region, s.service)
+	s.signature = hmacSHA256(signingKey, stringToSign)
+	return date, s.signature
+}
+
+// Message signs a payload, itself an encoded event stream message, and
+// returns the message that carries it on the stream: the payload with the
+// :date and :chunk-signature headers. An empty payload ends the stream.
+func (s *EventStreamSigner) Message(payload []byte) []byte {
+	if anonymous(s.keys) {
+		return encodeEventMessage(nil, payload)
+	}
+
+	date, signature := s.Sign(payload)
+	return encodeEventMessage([]eventHeader{{":date", date}, {":chunk-signature", signature}}, payload)
+}
+
+// eventHeader is a header of an event stream message, whose value is either a
+// timestamp or a byte array.
+type eventHeader struct {
+	name  string
+	value interface{}
+}
+
+// encodeEventHeaders encodes headers the way event stream messages carry them.
+func encodeEventHeaders(headers ...eventHeader) []byte {
+	var encoded bytes.Buffer
+	for _, header := range headers {
+		encoded.WriteByte(byte(len(header.name)))
+		encoded.WriteString(header.name)
+		switch value := header.value.(type) {
+		case time.Time:
+			encoded.WriteByte(eventTimestampType)
+			binary.Write(&encoded, binary.BigEndian, value.UnixMilli())
+		case []byte:
+			encoded.WriteByte(eventByteArrayType)
+			binary.Write(&encoded, binary.BigEndian, uint16(len(value)))
+			encoded.Write(value)
+		}
+	}
+	return encoded.Bytes()
+}
+
+// encodeEventMessage frames headers and a payload as an event stream message:
+// a prelude of the total and header lengths with its own checksum, the
+// headers, the payload and a checksum of it all.
+func encodeEventMessage(headers []eventHeader, payload []byte) []byte {
+	encodedHeaders := encodeEventHeaders(headers...)
+
+	message := make([]byte, 12, 16+len(encodedHeaders)+len(payload))
+	binary.BigEndian.PutUint32(message[0:], uint32(cap(message)))
+	binary.BigEndian.PutUint32(message[4:], uint32(len(encodedHeaders)))
+	binary.BigEndian.PutUint32(message[8:], crc32.ChecksumIEEE(message[:8]))
+	message = append(message, encodedHeaders...)
+	message = append(message, payload...)
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(message))
+	return append(message, checksum[:]...)
+}
+
+const (
+	// streamingEventsV4 stands in for the payload hash of requests that open
+	// an event stream.
+	streamingEventsV4 = "STREAMING-AWS4-HMAC-SHA256-EVENTS"
+
+	eventByteArrayType = 6
+	eventTimestampType = 8
+)
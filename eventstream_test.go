@@ -0,0 +1,69 @@
+package awsauth
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEventStreamSigning(t *testing.T) {
+	Convey("Given a request opening a Transcribe stream", t, func() {
+		defer test_mockNowV4("20230101T000000Z")()
+
+		request, _ := http.NewRequest("POST", "https://transcribestreaming.us-east-1.amazonaws.com/stream-transcription", nil)
+		signer, err := Sign4EventStream(request, *testCredV4)
+		So(err, ShouldBeNil)
+
+		Convey("The request should be signed for a stream of events", func() {
+			So(request.Header.Get("X-Amz-Content-Sha256"), ShouldEqual, "STREAMING-AWS4-HMAC-SHA256-EVENTS")
+			So(request.Header.Get("Authorization"), ShouldContainSubstring, "/us-east-1/transcribe/aws4_request")
+		})
+
+		Convey("Each message should be signed with the signature of the one before", func() {
+			seed := request.Header.Get("Authorization")
+			seed = seed[strings.LastIndex(seed, "=")+1:]
+			signingKey := signingKeyV4(testCredV4.SecretAccessKey, "20230101", "us-east-1", "transcribe")
+			date := time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)
+			dateHeader := []byte{5, ':', 'd', 'a', 't', 'e', 8, 0, 0, 1, 133, 106, 160, 200, 0}
+			test_expected := func(previous string, payload []byte) []byte {
+				return hmacSHA256(signingKey, "AWS4-HMAC-SHA256-PAYLOAD\n20230101T000000Z\n20230101/us-east-1/transcribe/aws4_request\n"+
+					previous+"\n"+hashSHA256(dateHeader)+"\n"+hashSHA256(payload))
+			}
+
+			signedAt, first := signer.Sign([]byte("audio"))
+			So(signedAt, ShouldEqual, date)
+			So(first, ShouldResemble, test_expected(seed, []byte("audio")))
+
+			_, last := signer.Sign(nil)
+			So(last, ShouldResemble, test_expected(hex.EncodeToString(first), nil))
+		})
+
+		Convey("Messages should be framed with their date and signature", func() {
+			message := signer.Message([]byte("audio"))
+
+			So(binary.BigEndian.Uint32(message[0:]), ShouldEqual, len(message))
+			So(binary.BigEndian.Uint32(message[8:]), ShouldEqual, crc32.ChecksumIEEE(message[:8]))
+			So(binary.BigEndian.Uint32(message[len(message)-4:]), ShouldEqual, crc32.ChecksumIEEE(message[:len(message)-4]))
+
+			headersLength := binary.BigEndian.Uint32(message[4:])
+			So(headersLength, ShouldEqual, 15+len(":chunk-signature")+4+32)
+			So(string(message[12+headersLength:len(message)-4]), ShouldEqual, "audio")
+			So(string(message[12:18]), ShouldEqual, "\x05:date")
+			So(string(message[28:44]), ShouldEqual, ":chunk-signature")
+		})
+	})
+
+	Convey("Given a malformed seed signature", t, func() {
+		_, err := NewEventStreamSigner("not hex", "us-east-1", "transcribe", *testCredV4)
+
+		Convey("No signer should be made", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,119 @@
+package awsauth
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+)
+
+// Hooks are told about what the package does, for logging and metrics: every
+// signature made, every time credentials are retrieved, and every failure to
+// retrieve them, including background refreshes that would otherwise fail
+// unseen. Methods may be called concurrently and should return quickly.
+// Embed NopHooks to implement only some of them.
+type Hooks interface {
+	OnSign(SignEvent)
+	OnCredentialRefresh(CredentialRefreshEvent)
+	OnError(error)
+}
+
+// SigningHooks, if set, are told about every signature and credentials
+// retrieval, made by the package-level functions and signers alike.
+var SigningHooks Hooks
+
+// SignEvent describes a signature that was made.
+type SignEvent struct {
+	// Scheme is the scheme the request was signed with: the Version 4 or
+	// 4A algorithm, AWS3-HTTPS, AWS for S3 or SignatureVersion2.
+	Scheme string
+
+	// Service and Region are those a Version 4 signature was scoped to.
+	Service string
+	Region  string
+
+	// Presigned is set for presigned URLs.
+	Presigned bool
+
+	// Duration is how long signing took.
+	Duration time.Duration
+}
+
+// CredentialRefreshEvent describes credentials that were retrieved.
+type CredentialRefreshEvent struct {
+	// Source is the type of the provider they came from, such as
+	// *awsauth.AssumeRoleProvider.
+	Source string
+
+	// Expiration is when they expire, zero if they don't.
+	Expiration time.Time
+
+	// Background is set when they were retrieved ahead of the current ones
+	// expiring, while requests were still signed with those.
+	Background bool
+
+	// Duration is how long retrieving them took.
+	Duration time.Duration
+}
+
+// NopHooks does nothing with the events it is told about.
+type NopHooks struct{}
+
+func (NopHooks) OnSign(SignEvent)                           {}
+func (NopHooks) OnCredentialRefresh(CredentialRefreshEvent) {}
+func (NopHooks) OnError(error)                              {}
+
+// NewExpvarHooks returns hooks that count events in an expvar.Map published
+// under name, served by the expvar handler at /debug/vars: signatures made
+// and the nanoseconds spent making them (signatures, sign_nanoseconds),
+// credentials retrieved (credential_refreshes) and errors (errors). Asking
+// for the same name again returns hooks sharing the map.
+func NewExpvarHooks(name string) Hooks {
+	counters, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		counters = expvar.NewMap(name)
+	}
+	return expvarHooks{counters}
+}
+
+type expvarHooks struct {
+	counters *expvar.Map
+}
+
+func (h expvarHooks) OnSign(event SignEvent) {
+	h.counters.Add("signatures", 1)
+	h.counters.Add("sign_nanoseconds", int64(event.Duration))
+}
+
+func (h expvarHooks) OnCredentialRefresh(CredentialRefreshEvent) {
+	h.counters.Add("credential_refreshes", 1)
+}
+
+func (h expvarHooks) OnError(error) {
+	h.counters.Add("errors", 1)
+}
+
+// observeSign tells SigningHooks about a signature started at start.
+func observeSign(scheme, service, region string, presigned bool, start time.Time) {
+	if hooks := SigningHooks; hooks != nil {
+		hooks.OnSign(SignEvent{Scheme: scheme, Service: service, Region: region, Presigned: presigned, Duration: time.Since(start)})
+	}
+}
+
+// observeRefresh tells SigningHooks about credentials retrieved from source,
+// starting at start, or about the error retrieving them.
+func observeRefresh(credentials Credentials, source CredentialProvider, background bool, start time.Time, err error) {
+	hooks := SigningHooks
+	if hooks == nil {
+		return
+	}
+	if err != nil {
+		hooks.OnError(err)
+		return
+	}
+	hooks.OnCredentialRefresh(CredentialRefreshEvent{
+		Source:     fmt.Sprintf("%T", source),
+		Expiration: credentials.Expiration,
+		Background: background,
+		Duration:   time.Since(start),
+	})
+}
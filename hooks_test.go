@@ -0,0 +1,97 @@
+package awsauth
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSigningHooks(t *testing.T) {
+	Convey("Given hooks that record what they are told", t, func() {
+		hooks := &test_hooks{}
+		SigningHooks = hooks
+		defer func() { SigningHooks = nil }()
+
+		Convey("Every signature should be reported", func() {
+			Sign4(test_plainRequestV4(false), *testCredV4)
+			SignS3(test_plainRequestV4(false), *testCredV4)
+			PresignURL4(test_plainRequestV4(false), time.Minute, *testCredV4)
+
+			So(hooks.signs, ShouldHaveLength, 3)
+			So(hooks.signs[0].Scheme, ShouldEqual, "AWS4-HMAC-SHA256")
+			So(hooks.signs[0].Service, ShouldEqual, "iam")
+			So(hooks.signs[0].Region, ShouldEqual, "us-east-1")
+			So(hooks.signs[1].Scheme, ShouldEqual, "AWS")
+			So(hooks.signs[2].Presigned, ShouldBeTrue)
+		})
+
+		Convey("Unsigned requests should not be reported", func() {
+			Sign4(test_plainRequestV4(false), AnonymousCredentials)
+			So(hooks.signs, ShouldBeEmpty)
+		})
+
+		Convey("Retrieved credentials should be reported with their source", func() {
+			expiration := time.Date(2100, time.January, 1, 0, 0, 0, 0, time.UTC)
+			store := &CredentialsStore{providers: []CredentialProvider{&test_provider{credentials: Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret", Expiration: expiration}}}}
+			store.Refresh()
+
+			So(hooks.refreshes, ShouldHaveLength, 1)
+			So(hooks.refreshes[0].Source, ShouldEqual, "*awsauth.test_provider")
+			So(hooks.refreshes[0].Expiration, ShouldEqual, expiration)
+			So(hooks.refreshes[0].Background, ShouldBeFalse)
+		})
+
+		Convey("Failures to retrieve credentials should be reported", func() {
+			failure := errors.New("unreachable")
+			store := &CredentialsStore{providers: []CredentialProvider{&test_provider{err: failure}}}
+			store.Refresh()
+
+			So(hooks.errors, ShouldResemble, []error{failure})
+		})
+	})
+
+	Convey("Given expvar hooks", t, func() {
+		hooks := NewExpvarHooks("awsauth_test")
+		hooks.OnSign(SignEvent{Duration: time.Millisecond})
+		hooks.OnSign(SignEvent{Duration: time.Millisecond})
+		hooks.OnCredentialRefresh(CredentialRefreshEvent{})
+		NewExpvarHooks("awsauth_test").OnError(ErrNoCredentials)
+
+		Convey("Events should be counted in the published map", func() {
+			counters := expvar.Get("awsauth_test").(*expvar.Map)
+			So(counters.Get("signatures").String(), ShouldEqual, "2")
+			So(counters.Get("sign_nanoseconds").String(), ShouldEqual, "2000000")
+			So(counters.Get("credential_refreshes").String(), ShouldEqual, "1")
+			So(counters.Get("errors").String(), ShouldEqual, "1")
+		})
+	})
+}
+
+type test_hooks struct {
+	sync.Mutex
+	signs     []SignEvent
+	refreshes []CredentialRefreshEvent
+	errors    []error
+}
+
+func (h *test_hooks) OnSign(event SignEvent) {
+	h.Lock()
+	defer h.Unlock()
+	h.signs = append(h.signs, event)
+}
+
+func (h *test_hooks) OnCredentialRefresh(event CredentialRefreshEvent) {
+	h.Lock()
+	defer h.Unlock()
+	h.refreshes = append(h.refreshes, event)
+}
+
+func (h *test_hooks) OnError(err error) {
+	h.Lock()
+	defer h.Unlock()
+	h.errors = append(h.errors, err)
+}
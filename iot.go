@@ -0,0 +1,25 @@
+package awsauth
+
+import (
+	"net/http"
+	"time"
+)
+
+// PresignIoTWebSocketURL returns a URL to connect to the device gateway of
+// AWS IoT Core with MQTT over WebSocket, given the IoT data endpoint of the
+// account, such as a1b2c3d4e5f6g7-ats.iot.us-east-1.amazonaws.com, and its
+// region. The device gateway signs the /mqtt path with the hash of an empty
+// payload, and takes the security token of temporary credentials unsigned,
+// after the signature.
+// Info: https://docs.aws.amazon.com/iot/latest/developerguide/protocols.html#mqtt-ws
+func PresignIoTWebSocketURL(endpoint, region string, expires time.Duration, credentials ...Credentials) (string, error) {
+	request, err := http.NewRequest("GET", "wss://"+endpoint+"/mqtt", nil)
+	if err != nil {
+		return "", err
+	}
+
+	meta := new(metadata)
+	meta.region, meta.service = region, "iotdevicegateway"
+	meta.unsignedToken = true
+	return presignURL4(request, meta, expires, nil, credentials)
+}
@@ -0,0 +1,46 @@
+package awsauth
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIoTWebSocketPresigning(t *testing.T) {
+	Convey("Given an AWS IoT data endpoint", t, func() {
+		defer test_mockNowV4("20230101T000000Z")()
+		endpoint := "a1b2c3d4e5f6g7-ats.iot.us-east-1.amazonaws.com"
+
+		Convey("The URL should be presigned for the device gateway", func() {
+			presigned, err := PresignIoTWebSocketURL(endpoint, "us-east-1", time.Hour, *testCredV4)
+			So(err, ShouldBeNil)
+			So(presigned, ShouldStartWith, "wss://"+endpoint+"/mqtt?X-Amz-Algorithm=AWS4-HMAC-SHA256")
+
+			query := test_queryOf(presigned)
+			So(query.Get("X-Amz-Credential"), ShouldEqual, "AKIDEXAMPLE/20230101/us-east-1/iotdevicegateway/aws4_request")
+
+			canonicalRequest := "GET\n/mqtt\n" +
+				"X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=AKIDEXAMPLE%2F20230101%2Fus-east-1%2Fiotdevicegateway%2Faws4_request&X-Amz-Date=20230101T000000Z&X-Amz-Expires=3600&X-Amz-SignedHeaders=host\n" +
+				"host:" + endpoint + "\n\nhost\n" + emptyPayloadHash
+			stringToSign := "AWS4-HMAC-SHA256\n20230101T000000Z\n20230101/us-east-1/iotdevicegateway/aws4_request\n" + hashSHA256([]byte(canonicalRequest))
+			signingKey := signingKeyV4(testCredV4.SecretAccessKey, "20230101", "us-east-1", "iotdevicegateway")
+			So(query.Get("X-Amz-Signature"), ShouldEqual, signatureV4(signingKey, stringToSign))
+		})
+
+		Convey("The security token should be added after the signature", func() {
+			presigned, err := PresignIoTWebSocketURL(endpoint, "us-east-1", time.Hour, *testCredV4WithSTS)
+			So(err, ShouldBeNil)
+
+			query := test_queryOf(presigned)
+			So(query.Get("X-Amz-Security-Token"), ShouldEqual, testCredV4WithSTS.SecurityToken)
+
+			query.Del("X-Amz-Security-Token")
+			withoutToken, _ := PresignIoTWebSocketURL(endpoint, "us-east-1", time.Hour, Credentials{
+				AccessKeyID:     testCredV4WithSTS.AccessKeyID,
+				SecretAccessKey: testCredV4WithSTS.SecretAccessKey,
+			})
+			So(query.Encode(), ShouldEqual, test_queryOf(withoutToken).Encode())
+		})
+	})
+}
@@ -0,0 +1,37 @@
+package awsauth
+
+// Logger receives the package's log messages, with key-value pairs of
+// details after the message. A *slog.Logger is one. Messages at Debug level
+// show how requests were signed, their canonical request and string to sign
+// included, and how credentials were looked up; Warn messages report falling
+// back, such as from IMDSv2 to IMDSv1, and background refreshes that failed.
+type Logger interface {
+	Debug(msg string, keyvals ...any)
+	Info(msg string, keyvals ...any)
+	Warn(msg string, keyvals ...any)
+	Error(msg string, keyvals ...any)
+}
+
+// DefaultLogger, if set, receives the log messages of the package-level
+// functions, and of transports and signers not given a logger with
+// WithLogger. If nil, nothing is logged.
+var DefaultLogger Logger
+
+// logger returns l, or DefaultLogger if l is nil, or a logger that discards
+// everything if that is nil too.
+func logger(l Logger) Logger {
+	if l != nil {
+		return l
+	}
+	if l := DefaultLogger; l != nil {
+		return l
+	}
+	return nopLogger{}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
@@ -0,0 +1,24 @@
+//go:build go1.21
+
+package awsauth
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSlogLogger(t *testing.T) {
+	Convey("Given a slog logger", t, func() {
+		var out bytes.Buffer
+		DefaultLogger = slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		defer func() { DefaultLogger = nil }()
+
+		Convey("It should be usable as is", func() {
+			Sign4(test_plainRequestV4(false), *testCredV4)
+			So(out.String(), ShouldContainSubstring, `msg="awsauth: signing request"`)
+		})
+	})
+}
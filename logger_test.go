@@ -0,0 +1,107 @@
+package awsauth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLogger(t *testing.T) {
+	Convey("Given a signer with a logger of its own", t, func() {
+		log := &test_logger{}
+		signer := NewSigner(&test_provider{credentials: *testCredV4}, WithLogger(log))
+		signer.Sign4(test_plainRequestV4(false))
+
+		Convey("The canonical request and string to sign should be logged at Debug level", func() {
+			So(log.contains("DEBUG awsauth: signing request"), ShouldBeTrue)
+			So(log.contains("canonical_request=POST\n/\n"), ShouldBeTrue)
+			So(log.contains("string_to_sign=AWS4-HMAC-SHA256\n"), ShouldBeTrue)
+		})
+
+		Convey("Where the credentials came from should be logged", func() {
+			So(log.contains("awsauth: found credentials provider=*awsauth.test_provider access_key_id=AKIDEXAMPLE"), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given a package-wide logger", t, func() {
+		log := &test_logger{}
+		DefaultLogger = log
+		defer func() { DefaultLogger = nil }()
+
+		Convey("Providers without credentials should be logged as they are passed over", func() {
+			store := &CredentialsStore{providers: []CredentialProvider{&test_provider{err: ErrNoCredentials}, &test_provider{credentials: *testCredV4}}}
+			store.Current()
+			So(log.contains("awsauth: no credentials from provider provider=*awsauth.test_provider error="+ErrNoCredentials.Error()), ShouldBeTrue)
+			So(log.contains("awsauth: found credentials"), ShouldBeTrue)
+		})
+
+		Convey("Signers with a logger of their own should not log to it", func() {
+			NewSigner(nil, WithCredentials(*testCredV4), WithLogger(&test_logger{})).Sign4(test_plainRequestV4(false))
+			So(log.lines, ShouldBeEmpty)
+		})
+	})
+
+	Convey("Given credentials with a session token", t, func() {
+		log := &test_logger{}
+		credentials := Credentials{AccessKeyID: "ASIAEXAMPLE", SecretAccessKey: "secret", SecurityToken: "secret-token"}
+		signer := NewSigner(nil, WithCredentials(credentials), WithLogger(log))
+
+		Convey("The token should not be logged when it is signed as a header", func() {
+			signer.Sign4(test_plainRequestV4(false))
+			So(log.contains("x-amz-security-token:REDACTED"), ShouldBeTrue)
+			So(log.contains("secret-token"), ShouldBeFalse)
+		})
+
+		Convey("The token should not be logged when it is signed in the query", func() {
+			request, _ := http.NewRequest("GET", "https://examplebucket.s3.amazonaws.com/test.txt", nil)
+			signer.Presign(request, time.Hour)
+			So(log.contains("X-Amz-Security-Token=REDACTED"), ShouldBeTrue)
+			So(log.contains("secret-token"), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given no logger", t, func() {
+		meta := &metadata{canonicalRequest: "GET\n/\n\nhost:sqs.us-east-1.amazonaws.com\nx-amz-security-token:secret-token\n"}
+
+		Convey("Signing should not redact a canonical request that won't be logged", func() {
+			allocs := testing.AllocsPerRun(100, func() { traceV4(meta, "AWS4-HMAC-SHA256\n") })
+			So(allocs, ShouldEqual, 0)
+		})
+	})
+}
+
+type test_logger struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *test_logger) log(level, msg string, keyvals []any) {
+	l.Lock()
+	defer l.Unlock()
+	line := level + " " + msg
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		line += fmt.Sprintf(" %v=%v", keyvals[i], keyvals[i+1])
+	}
+	l.lines = append(l.lines, line)
+}
+
+func (l *test_logger) contains(s string) bool {
+	l.Lock()
+	defer l.Unlock()
+	for _, line := range l.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *test_logger) Debug(msg string, keyvals ...any) { l.log("DEBUG", msg, keyvals) }
+func (l *test_logger) Info(msg string, keyvals ...any)  { l.log("INFO", msg, keyvals) }
+func (l *test_logger) Warn(msg string, keyvals ...any)  { l.log("WARN", msg, keyvals) }
+func (l *test_logger) Error(msg string, keyvals ...any) { l.log("ERROR", msg, keyvals) }
@@ -0,0 +1,99 @@
+package awsauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// ProcessProvider provides the credentials printed by the command in the
+// credential_process setting of a profile in the shared config or
+// credentials file, which must follow the format the AWS CLI expects:
+//
+//	{"Version": 1, "AccessKeyId": "...", "SecretAccessKey": "...",
+//	 "SessionToken": "...", "Expiration": "2023-01-01T00:00:00Z"}
+//
+// The command is run again once the credentials it printed expire.
+type ProcessProvider struct {
+	// Profile is the profile whose command is run. If empty, the one named
+	// by AWS_PROFILE, or else the default profile, is used.
+	Profile string
+
+	credentials Credentials
+	sync.RWMutex
+}
+
+func (p *ProcessProvider) Retrieve() (Credentials, error) {
+	return p.RetrieveCtx(context.Background())
+}
+
+func (p *ProcessProvider) RetrieveCtx(ctx context.Context) (Credentials, error) {
+	profile := p.Profile
+	if profile == "" {
+		profile = selectedProfile()
+	}
+
+	command := readProfile(sharedFile(envSharedCredentialsFile, "credentials"), profile)["credential_process"]
+	if command == "" {
+		command = readProfile(sharedFile(envConfigFile, "config"), configSection(profile))["credential_process"]
+	}
+	if command == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd.exe", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return Credentials{}, fmt.Errorf("awsauth: credential_process failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	var printed struct {
+		Version         int
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		SessionToken    string
+		Expiration      *time.Time
+	}
+	if err := json.Unmarshal(output, &printed); err != nil {
+		return Credentials{}, fmt.Errorf("awsauth: cannot decode credential_process output: %w", err)
+	}
+	if printed.Version != 1 {
+		return Credentials{}, fmt.Errorf("awsauth: unsupported credential_process output version %d", printed.Version)
+	}
+
+	credentials := Credentials{
+		AccessKeyID:     printed.AccessKeyID,
+		SecretAccessKey: printed.SecretAccessKey,
+		SecurityToken:   printed.SessionToken,
+	}
+	if printed.Expiration != nil {
+		credentials.Expiration = *printed.Expiration
+	}
+	if credentials.blank() {
+		return Credentials{}, fmt.Errorf("awsauth: credential_process printed no credentials")
+	}
+
+	p.Lock()
+	p.credentials = credentials
+	p.Unlock()
+	return credentials, nil
+}
+
+func (p *ProcessProvider) IsExpired() bool {
+	p.RLock()
+	defer p.RUnlock()
+	return p.credentials.blank() || p.credentials.Expired()
+}
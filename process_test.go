@@ -0,0 +1,84 @@
+package awsauth
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProcessProvider(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test commands need a POSIX shell")
+	}
+
+	Convey("Given profiles with a credential_process", t, func() {
+		defer test_mockNowV4("20230101T000000Z")()
+
+		dir := t.TempDir()
+		script := filepath.Join(dir, "credentials.sh")
+		os.WriteFile(script, []byte(test_credentialProcess), 0700)
+		counter := filepath.Join(dir, "runs")
+
+		config := "[profile tool]\ncredential_process = " + script + " " + counter + "\n" +
+			"[profile broken]\ncredential_process = echo oops >&2; exit 1\n" +
+			"[profile old]\ncredential_process = echo '{\"Version\": 2}'\n"
+		os.WriteFile(filepath.Join(dir, "config"), []byte(config), 0600)
+		t.Setenv(envConfigFile, filepath.Join(dir, "config"))
+		t.Setenv(envSharedCredentialsFile, filepath.Join(dir, "credentials"))
+		t.Setenv(envProfile, "tool")
+
+		Convey("The credentials it prints should be provided", func() {
+			credentials, err := (&ProcessProvider{}).Retrieve()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDPROCESS1")
+			So(credentials.SecretAccessKey, ShouldEqual, "process-secret")
+			So(credentials.SecurityToken, ShouldEqual, "process-token")
+			So(credentials.Expiration, ShouldEqual, time.Date(2023, time.January, 1, 1, 0, 0, 0, time.UTC))
+		})
+
+		Convey("It should be run again once they expire", func() {
+			defer test_restoreCredentials()()
+			SetCredentialProviders(&ProcessProvider{})
+
+			first, _ := CurrentCredentials()
+			again, _ := CurrentCredentials()
+			now = func() time.Time { return time.Date(2023, time.January, 1, 0, 58, 0, 0, time.UTC) }
+			renewed, _ := CurrentCredentials()
+
+			So(first.AccessKeyID, ShouldEqual, "AKIDPROCESS1")
+			So(again.AccessKeyID, ShouldEqual, "AKIDPROCESS1")
+			So(renewed.AccessKeyID, ShouldEqual, "AKIDPROCESS2")
+		})
+
+		Convey("A failing command should be reported with what it printed", func() {
+			_, err := (&ProcessProvider{Profile: "broken"}).Retrieve()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "oops")
+		})
+
+		Convey("Output in an unknown version should be refused", func() {
+			_, err := (&ProcessProvider{Profile: "old"}).Retrieve()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A profile without a command should have no credentials", func() {
+			_, err := (&ProcessProvider{Profile: "missing"}).Retrieve()
+			So(err, ShouldEqual, ErrNoCredentials)
+		})
+	})
+}
+
+// test_credentialProcess prints credentials numbered after how many times it
+// has run, counting in the file it is given.
+const test_credentialProcess = `#!/bin/sh
+echo x >> "$1"
+runs=$(wc -l < "$1" | tr -d ' ')
+cat <<JSON
+{"Version": 1, "AccessKeyId": "AKIDPROCESS$runs", "SecretAccessKey": "process-secret",
+ "SessionToken": "process-token", "Expiration": "2023-01-01T01:00:00Z"}
+JSON
+`
@@ -0,0 +1,285 @@
+package awsauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// CredentialProvider is a source of credentials for signing requests that
+// aren't given any. Providers are asked in turn, and the credentials of the
+// first that has some are used until they, or the provider, expire.
+// Implementations must be safe for concurrent use.
+type CredentialProvider interface {
+	// Retrieve returns the provider's credentials. It returns
+	// ErrNoCredentials if the provider has none to offer.
+	Retrieve() (Credentials, error)
+
+	// IsExpired reports whether the credentials last retrieved are no
+	// longer valid and must be retrieved again.
+	IsExpired() bool
+}
+
+// ContextProvider is a CredentialProvider that can give up on retrieving
+// credentials when a context is done. Credentials looked up with a context,
+// as by SignCtx, are retrieved with RetrieveCtx from providers that have it.
+type ContextProvider interface {
+	CredentialProvider
+	RetrieveCtx(ctx context.Context) (Credentials, error)
+}
+
+// retrieveCtx retrieves the credentials of a provider, with the context if
+// the provider takes one.
+func retrieveCtx(ctx context.Context, provider CredentialProvider) (Credentials, error) {
+	if provider, ok := provider.(ContextProvider); ok {
+		return provider.RetrieveCtx(ctx)
+	}
+	return provider.Retrieve()
+}
+
+// EnvProvider provides the credentials in the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SECURITY_TOKEN environment variables.
+type EnvProvider struct{}
+
+func (EnvProvider) Retrieve() (Credentials, error) {
+	credentials := envCredentials()
+	if credentials.blank() {
+		return credentials, ErrNoCredentials
+	}
+	return credentials, nil
+}
+
+func (EnvProvider) IsExpired() bool {
+	return false
+}
+
+// SharedCredentialsProvider provides the credentials of a profile in the
+// shared credentials file, or failing that in the shared config file
+// (AWS_CONFIG_FILE or ~/.aws/config), the way the AWS CLI reads them.
+type SharedCredentialsProvider struct {
+	// Filename is the shared credentials file. If empty, the file named by
+	// AWS_SHARED_CREDENTIALS_FILE, or else ~/.aws/credentials, is read.
+	Filename string
+
+	// Profile is the profile whose credentials are provided. If empty, the
+	// one named by AWS_PROFILE, or else the default profile, is used.
+	Profile string
+}
+
+func (p SharedCredentialsProvider) Retrieve() (Credentials, error) {
+	profile := p.Profile
+	if profile == "" {
+		profile = selectedProfile()
+	}
+	filename := p.Filename
+	if filename == "" {
+		filename = sharedFile(envSharedCredentialsFile, "credentials")
+	}
+
+	settings := readProfile(filename, profile)
+	if settings["aws_access_key_id"] == "" {
+		settings = readProfile(sharedFile(envConfigFile, "config"), configSection(profile))
+	}
+
+	credentials := Credentials{
+		AccessKeyID:     settings["aws_access_key_id"],
+		SecretAccessKey: settings["aws_secret_access_key"],
+		SecurityToken:   settings["aws_session_token"],
+	}
+	if credentials.SecurityToken == "" {
+		// The name older tools, such as boto, write the token under
+		credentials.SecurityToken = settings["aws_security_token"]
+	}
+	if credentials.blank() {
+		return credentials, ErrNoCredentials
+	}
+	return credentials, nil
+}
+
+func (SharedCredentialsProvider) IsExpired() bool {
+	return false
+}
+
+// EC2RoleProvider provides the credentials of the first IAM role of the EC2
+// instance the program runs on, as served by the instance metadata service.
+type EC2RoleProvider struct {
+	credentials Credentials
+	sync.RWMutex
+}
+
+func (p *EC2RoleProvider) Retrieve() (Credentials, error) {
+	return p.RetrieveCtx(context.Background())
+}
+
+func (p *EC2RoleProvider) RetrieveCtx(ctx context.Context) (Credentials, error) {
+	if !onEC2(ctx) {
+		if err := ctx.Err(); err != nil {
+			return Credentials{}, err
+		}
+		return Credentials{}, ErrNoCredentials
+	}
+
+	credentials, err := getIAMRoleCredentials(ctx)
+	if err != nil {
+		return credentials, err
+	}
+
+	p.Lock()
+	p.credentials = credentials
+	p.Unlock()
+	return credentials, nil
+}
+
+func (p *EC2RoleProvider) IsExpired() bool {
+	p.RLock()
+	defer p.RUnlock()
+	return p.credentials.Expired()
+}
+
+// ContainerProvider provides the credentials of the task role of an ECS task
+// or Fargate container, or of the pod identity of an EKS pod, as served by
+// the endpoint in AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or
+// AWS_CONTAINER_CREDENTIALS_FULL_URI. Requests to a full URI carry the token
+// in AWS_CONTAINER_AUTHORIZATION_TOKEN, or in the file named by
+// AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE.
+type ContainerProvider struct {
+	credentials Credentials
+	sync.RWMutex
+}
+
+func (p *ContainerProvider) Retrieve() (Credentials, error) {
+	return p.RetrieveCtx(context.Background())
+}
+
+func (p *ContainerProvider) RetrieveCtx(ctx context.Context) (Credentials, error) {
+	endpoint := ""
+	if uri := os.Getenv(envContainerRelativeURI); uri != "" {
+		endpoint = containerCredentialsHost + uri
+	} else if uri := os.Getenv(envContainerFullURI); uri != "" {
+		endpoint = uri
+	} else {
+		return Credentials{}, ErrNoCredentials
+	}
+
+	credentials, err := getContainerCredentials(ctx, endpoint)
+	if err != nil {
+		return credentials, err
+	}
+
+	p.Lock()
+	p.credentials = credentials
+	p.Unlock()
+	return credentials, nil
+}
+
+func (p *ContainerProvider) IsExpired() bool {
+	p.RLock()
+	defer p.RUnlock()
+	return p.credentials.Expired()
+}
+
+// containerCredentialsHost is where ECS serves the relative URIs of task
+// credentials.
+var containerCredentialsHost = "http://169.254.170.2"
+
+// getContainerCredentials fetches credentials from a container credentials
+// endpoint.
+func getContainerCredentials(ctx context.Context, endpoint string) (Credentials, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return Credentials{}, wrapCredentialsError(ErrMetadataUnavailable, err)
+	}
+	if !containerHostAllowed(request.URL) {
+		return Credentials{}, fmt.Errorf("%w: %s is not a loopback or HTTPS endpoint", ErrMetadataUnavailable, endpoint)
+	}
+
+	token := os.Getenv(envContainerAuthorization)
+	if path := os.Getenv(envContainerAuthorizationFile); path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return Credentials{}, wrapCredentialsError(ErrMetadataUnavailable, err)
+		}
+		token = strings.TrimSpace(string(contents))
+	}
+	if token != "" {
+		request.Header.Set("Authorization", token)
+	}
+
+	response, err := CredentialsClient.Do(request)
+	if err != nil {
+		return Credentials{}, wrapCredentialsError(ErrMetadataUnavailable, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return Credentials{}, fmt.Errorf("%w: container credentials endpoint returned %s", ErrMetadataUnavailable, response.Status)
+	}
+
+	var credentials Credentials
+	if err := json.NewDecoder(response.Body).Decode(&credentials); err != nil {
+		return Credentials{}, wrapCredentialsError(ErrMetadataDecode, err)
+	}
+	return credentials, nil
+}
+
+// containerHostAllowed reports whether credentials may be fetched from a URL:
+// the ECS and EKS endpoints, loopback addresses and anything over HTTPS, so
+// that credentials aren't sent in the clear across the network.
+func containerHostAllowed(u *url.URL) bool {
+	if u.Scheme == "https" {
+		return true
+	}
+
+	host := u.Hostname()
+	if host == "localhost" || host == "169.254.170.2" || host == "169.254.170.23" || host == "fd00:ec2::23" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// defaultProviders returns the providers that are asked for credentials unless
+// others are set: the environment, then the shared files with their SSO
+// profiles and credential processes, then a web identity, then the container
+// role and finally the EC2 role.
+func defaultProviders() []CredentialProvider {
+	return []CredentialProvider{
+		EnvProvider{},
+		SharedCredentialsProvider{},
+		&SSOProvider{},
+		&ProcessProvider{},
+		&WebIdentityProvider{},
+		&ContainerProvider{},
+		&EC2RoleProvider{},
+	}
+}
+
+// SetCredentialProviders replaces the providers that are asked for
+// credentials, in order, when requests are signed without any. The
+// credentials currently in use are dropped, so the next request is signed with
+// ones from the new providers. Calling it without providers restores the
+// default chain of the environment, the shared files, SSO profiles, credential
+// processes, a web identity, the container role and the EC2 role.
+func SetCredentialProviders(providers ...CredentialProvider) {
+	gCredentialsStore.Lock()
+	defer gCredentialsStore.Unlock()
+
+	gCredentialsStore.providers = providers
+	gCredentialsStore.credentials, gCredentialsStore.source = nil, nil
+}
+
+// RegisterCredentialProvider puts a provider in front of the ones currently
+// asked for credentials, so that its credentials are preferred over theirs.
+func RegisterCredentialProvider(provider CredentialProvider) {
+	gCredentialsStore.Lock()
+	defer gCredentialsStore.Unlock()
+
+	gCredentialsStore.providers = append([]CredentialProvider{provider}, gCredentialsStore.chain()...)
+	gCredentialsStore.credentials, gCredentialsStore.source = nil, nil
+}
@@ -0,0 +1,422 @@
+package awsauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCredentialProviders(t *testing.T) {
+	Convey("Given a registered custom provider", t, func() {
+		defer test_restoreCredentials()()
+		t.Setenv(envAccessKeyID, "AKIDENV")
+		t.Setenv(envSecretAccessKey, "env-secret")
+
+		provider := &test_provider{credentials: Credentials{AccessKeyID: "AKIDCUSTOM", SecretAccessKey: "custom"}}
+		RegisterCredentialProvider(provider)
+
+		Convey("Its credentials should be preferred over the environment's", func() {
+			request := Sign4(test_plainRequestV4(true))
+			So(request.Header.Get("Authorization"), ShouldContainSubstring, "Credential=AKIDCUSTOM/")
+		})
+
+		Convey("They should be retrieved once while they are valid", func() {
+			CurrentCredentials()
+			CurrentCredentials()
+			So(provider.retrieved, ShouldEqual, 1)
+		})
+
+		Convey("They should be retrieved again once the provider expires", func() {
+			CurrentCredentials()
+			provider.expire(Credentials{AccessKeyID: "AKIDROTATED", SecretAccessKey: "rotated"})
+
+			credentials, err := CurrentCredentials()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDROTATED")
+			So(provider.retrieved, ShouldEqual, 2)
+		})
+
+		Convey("The next providers should be asked when it has none", func() {
+			provider.expire(Credentials{})
+
+			credentials, err := CurrentCredentials()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDENV")
+		})
+	})
+
+	Convey("Given a chain of providers that fail", t, func() {
+		defer test_restoreCredentials()()
+
+		failure := errors.New("unreachable")
+		SetCredentialProviders(
+			&test_provider{},
+			&test_provider{err: failure},
+		)
+
+		Convey("The failure should be reported rather than a lack of credentials", func() {
+			_, err := CurrentCredentials()
+			So(err, ShouldEqual, failure)
+		})
+	})
+
+	Convey("Given a shared credentials file", t, func() {
+		defer test_restoreCredentials()()
+		SetCredentialProviders(SharedCredentialsProvider{})
+
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "credentials"), []byte(test_credentialsFile), 0600)
+		os.WriteFile(filepath.Join(dir, "config"), []byte(test_configCredentialsFile), 0600)
+		t.Setenv(envSharedCredentialsFile, filepath.Join(dir, "credentials"))
+		t.Setenv(envConfigFile, filepath.Join(dir, "config"))
+		t.Setenv(envProfile, "")
+
+		Convey("The default profile's credentials should be used", func() {
+			credentials, err := CurrentCredentials()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDDEFAULT")
+			So(credentials.SecretAccessKey, ShouldEqual, "default-secret")
+		})
+
+		Convey("The selected profile's credentials should be used", func() {
+			t.Setenv(envProfile, "dev")
+
+			credentials, err := CurrentCredentials()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDDEV")
+			So(credentials.SecurityToken, ShouldEqual, "dev-token")
+		})
+
+		Convey("Credentials in the config file should be used as a fallback", func() {
+			t.Setenv(envProfile, "ops")
+
+			credentials, err := CurrentCredentials()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDOPS")
+		})
+
+		Convey("A profile without credentials should have none", func() {
+			t.Setenv(envProfile, "missing")
+
+			_, err := CurrentCredentials()
+			So(err, ShouldEqual, ErrNoCredentials)
+		})
+	})
+
+	Convey("Given a provider for an explicit file and profile", t, func() {
+		path := filepath.Join(t.TempDir(), "credentials")
+		os.WriteFile(path, []byte(test_credentialsFile), 0600)
+		t.Setenv(envSharedCredentialsFile, filepath.Join(t.TempDir(), "elsewhere"))
+		t.Setenv(envProfile, "dev")
+
+		Convey("They should take precedence over the environment", func() {
+			credentials, err := SharedCredentialsProvider{Filename: path, Profile: "legacy"}.Retrieve()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDLEGACY")
+		})
+
+		Convey("A token under its legacy name should be read", func() {
+			credentials, _ := SharedCredentialsProvider{Filename: path, Profile: "legacy"}.Retrieve()
+			So(credentials.SecurityToken, ShouldEqual, "legacy-token")
+		})
+	})
+
+	Convey("Given an EC2 role", t, func() {
+		defer test_restoreCredentials()()
+		defer test_onEC2()()
+		defer test_mockNowV4("20230101T000000Z")()
+		SetCredentialProviders(&EC2RoleProvider{})
+
+		expiration := "2023-01-01T01:00:00Z"
+		defer test_metadataServer(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/security-credentials/") {
+				fmt.Fprintln(w, "role")
+				return
+			}
+			fmt.Fprintf(w, `{"AccessKeyId":"AKIDROLE","SecretAccessKey":"secret","Token":"token","Expiration":"%s"}`, expiration)
+		})()
+
+		Convey("Its credentials should be used", func() {
+			credentials, err := CurrentCredentials()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDROLE")
+		})
+
+		Convey("Its credentials should be retrieved again when they expire", func() {
+			CurrentCredentials()
+			expiration = "2023-01-01T02:00:00Z"
+			now = func() time.Time { return time.Date(2023, time.January, 1, 0, 58, 0, 0, time.UTC) }
+
+			credentials, _ := CurrentCredentials()
+			So(credentials.Expiration, ShouldEqual, time.Date(2023, time.January, 1, 2, 0, 0, 0, time.UTC))
+		})
+	})
+}
+
+func TestContainerProvider(t *testing.T) {
+	Convey("Given a container credentials endpoint", t, func() {
+		defer test_restoreCredentials()()
+		defer test_notOnEC2()()
+		t.Setenv(envAccessKeyID, "")
+		t.Setenv(envAccessKey, "")
+		t.Setenv(envSharedCredentialsFile, filepath.Join(t.TempDir(), "credentials"))
+		t.Setenv(envConfigFile, filepath.Join(t.TempDir(), "config"))
+		t.Setenv(envContainerRelativeURI, "")
+		t.Setenv(envContainerFullURI, "")
+		t.Setenv(envContainerAuthorization, "")
+		t.Setenv(envContainerAuthorizationFile, "")
+		SetCredentialProviders()
+
+		path, authorization := "", ""
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path, authorization = r.URL.Path, r.Header.Get("Authorization")
+			fmt.Fprint(w, `{"AccessKeyId":"AKIDTASK","SecretAccessKey":"secret","Token":"token","Expiration":"2100-01-01T00:00:00Z"}`)
+		}))
+		defer server.Close()
+
+		saved := containerCredentialsHost
+		containerCredentialsHost = server.URL
+		defer func() { containerCredentialsHost = saved }()
+
+		Convey("The credentials of an ECS task should be used by default", func() {
+			t.Setenv(envContainerRelativeURI, "/v2/credentials/task")
+
+			credentials, err := CurrentCredentials()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDTASK")
+			So(credentials.SecurityToken, ShouldEqual, "token")
+			So(path, ShouldEqual, "/v2/credentials/task")
+		})
+
+		Convey("A full URI should be sent the authorization token", func() {
+			t.Setenv(envContainerFullURI, server.URL+"/credentials")
+			t.Setenv(envContainerAuthorization, "Bearer secret-token")
+
+			credentials, err := CurrentCredentials()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDTASK")
+			So(authorization, ShouldEqual, "Bearer secret-token")
+		})
+
+		Convey("The authorization token should be read from its file", func() {
+			file := filepath.Join(t.TempDir(), "token")
+			os.WriteFile(file, []byte("file-token\n"), 0600)
+			t.Setenv(envContainerFullURI, server.URL+"/credentials")
+			t.Setenv(envContainerAuthorizationFile, file)
+
+			_, err := CurrentCredentials()
+			So(err, ShouldBeNil)
+			So(authorization, ShouldEqual, "file-token")
+		})
+
+		Convey("A full URI on another host over plain HTTP should be refused", func() {
+			t.Setenv(envContainerFullURI, "http://example.com/credentials")
+
+			_, err := CurrentCredentials()
+			So(errors.Is(err, ErrMetadataUnavailable), ShouldBeTrue)
+		})
+
+		Convey("Outside of a container there should be no credentials", func() {
+			_, err := (&ContainerProvider{}).Retrieve()
+			So(err, ShouldEqual, ErrNoCredentials)
+		})
+
+		Convey("The credentials should be fetched with CredentialsClient", func() {
+			t.Setenv(envContainerRelativeURI, "/v2/credentials/task")
+			saved := CredentialsClient
+			defer func() { CredentialsClient = saved }()
+
+			var proxied string
+			CredentialsClient = &http.Client{Transport: test_roundTripper(func(r *http.Request) (*http.Response, error) {
+				proxied = r.URL.Path
+				return http.DefaultTransport.RoundTrip(r)
+			})}
+
+			_, err := (&ContainerProvider{}).Retrieve()
+			So(err, ShouldBeNil)
+			So(proxied, ShouldEqual, "/v2/credentials/task")
+		})
+
+		Convey("The metadata service should be asked with a shorter timeout", func() {
+			saved := CredentialsClient
+			defer func() { CredentialsClient = saved }()
+
+			transport := &http.Transport{}
+			CredentialsClient = &http.Client{Transport: transport, Timeout: time.Minute}
+			So(metadataClient().Timeout, ShouldEqual, metadataTimeout)
+			So(metadataClient().Transport, ShouldEqual, transport)
+			So(CredentialsClient.Timeout, ShouldEqual, time.Minute)
+		})
+	})
+}
+
+func TestCredentialLookupContext(t *testing.T) {
+	Convey("Given an EC2 metadata service that doesn't answer", t, func() {
+		defer test_restoreCredentials()()
+		defer test_onEC2()()
+		SetCredentialProviders(&EC2RoleProvider{})
+
+		defer test_metadataServer(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		})()
+
+		Convey("Signing with a deadline should give up on it", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			started := time.Now()
+			request, err := SignCtx(ctx, test_plainRequestV4(true))
+
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+			So(time.Since(started), ShouldBeLessThan, time.Second)
+			So(request.Header.Get("Authorization"), ShouldBeBlank)
+		})
+
+		Convey("Looking up credentials with a cancelled context should fail", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err := CurrentCredentialsCtx(ctx)
+			So(errors.Is(err, context.Canceled), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given credentials that are passed in", t, func() {
+		Convey("Signing with a context should use them", func() {
+			request, err := SignCtx(context.Background(), test_plainRequestV4(true), *testCredV4)
+			So(err, ShouldBeNil)
+			So(request.Header.Get("Authorization"), ShouldContainSubstring, "Credential="+testCredV4.AccessKeyID+"/")
+		})
+	})
+}
+
+func TestSignE(t *testing.T) {
+	Convey("Given a provider that fails", t, func() {
+		defer test_restoreCredentials()()
+		SetCredentialProviders(&test_provider{err: ErrMetadataUnavailable})
+
+		Convey("SignE should return its error and leave the request unsigned", func() {
+			request, err := SignE(test_plainRequestV4(true))
+			So(err, ShouldEqual, ErrMetadataUnavailable)
+			So(request.Header.Get("Authorization"), ShouldBeBlank)
+		})
+
+		Convey("Sign4E should return its error too", func() {
+			_, err := Sign4E(test_plainRequestV4(true))
+			So(err, ShouldEqual, ErrMetadataUnavailable)
+		})
+	})
+
+	Convey("Given no credentials anywhere", t, func() {
+		defer test_restoreCredentials()()
+		SetCredentialProviders(&test_provider{})
+
+		Convey("SignE should report that none were found", func() {
+			_, err := SignE(test_plainRequestV4(true))
+			So(err, ShouldEqual, ErrNoCredentials)
+		})
+	})
+
+	Convey("Given credentials picked for each request that can't be", t, func() {
+		CredentialsForRequest = func(*http.Request, string, string) (Credentials, error) {
+			return Credentials{}, errors.New("no account for this region")
+		}
+		defer func() { CredentialsForRequest = nil }()
+
+		Convey("SignE should return the error", func() {
+			_, err := SignE(test_plainRequestV4(true))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "no account for this region")
+		})
+	})
+
+	Convey("Given working credentials", t, func() {
+		defer test_restoreCredentials()()
+		SetCredentialProviders(&test_provider{credentials: *testCredV4})
+
+		Convey("SignE and Sign4E should sign with them", func() {
+			request, err := SignE(test_plainRequestV4(true))
+			So(err, ShouldBeNil)
+			So(request.Header.Get("Authorization"), ShouldContainSubstring, "Credential=AKIDEXAMPLE/")
+
+			request, err = Sign4E(test_plainRequestV4(true))
+			So(err, ShouldBeNil)
+			So(request.Header.Get("Authorization"), ShouldContainSubstring, "Credential=AKIDEXAMPLE/")
+		})
+	})
+}
+
+// test_provider hands out the credentials it holds, until told to expire.
+type test_provider struct {
+	credentials Credentials
+	err         error
+	retrieved   int
+	expired     bool
+	sync.Mutex
+}
+
+func (p *test_provider) Retrieve() (Credentials, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.retrieved++
+	p.expired = false
+	if p.err != nil {
+		return Credentials{}, p.err
+	}
+	if p.credentials.blank() {
+		return Credentials{}, ErrNoCredentials
+	}
+	return p.credentials, nil
+}
+
+func (p *test_provider) RetrieveCtx(ctx context.Context) (Credentials, error) {
+	if err := ctx.Err(); err != nil {
+		return Credentials{}, err
+	}
+	return p.Retrieve()
+}
+
+func (p *test_provider) IsExpired() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.expired
+}
+
+func (p *test_provider) expire(next Credentials) {
+	p.Lock()
+	defer p.Unlock()
+	p.credentials = next
+	p.expired = true
+}
+
+const test_credentialsFile = `[default]
+aws_access_key_id = AKIDDEFAULT
+aws_secret_access_key = default-secret
+
+[dev]
+aws_access_key_id = AKIDDEV
+aws_secret_access_key = dev-secret
+aws_session_token = dev-token
+
+[legacy]
+aws_access_key_id = AKIDLEGACY
+aws_secret_access_key = legacy-secret
+aws_security_token = legacy-token
+`
+
+const test_configCredentialsFile = `[profile ops]
+region = eu-west-1
+aws_access_key_id = AKIDOPS
+aws_secret_access_key = ops-secret
+`
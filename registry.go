@@ -0,0 +1,96 @@
+package awsauth
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrUnknownKey is returned for keys nothing was registered under in a
+// CredentialsRegistry.
+var ErrUnknownKey = errors.New("awsauth: no credentials registered for key")
+
+// CredentialsRegistry keeps the credentials of many tenants apart, under keys
+// of the caller's choosing such as tenant or account IDs, each with its own
+// provider and its credentials kept until they expire, so that a proxy can
+// sign the requests of each tenant with its own keys. It is safe for
+// concurrent use.
+type CredentialsRegistry struct {
+	mu      sync.RWMutex
+	signers map[string]*Signer
+	opts    []Option
+}
+
+// NewCredentialsRegistry returns an empty registry, whose tenants' requests
+// are signed with the options NewSigner takes, such as WithRegion.
+func NewCredentialsRegistry(opts ...Option) *CredentialsRegistry {
+	return &CredentialsRegistry{signers: map[string]*Signer{}, opts: opts}
+}
+
+// Register makes requests signed for key be signed with credentials from
+// provider, retrieved when first needed and again when they expire. It
+// replaces whatever was registered under key before.
+func (r *CredentialsRegistry) Register(key string, provider CredentialProvider) {
+	r.set(key, NewSigner(provider, r.opts...))
+}
+
+// RegisterCredentials makes requests signed for key be signed with fixed
+// credentials.
+func (r *CredentialsRegistry) RegisterCredentials(key string, credentials Credentials) {
+	r.set(key, NewSigner(nil, append(r.opts[:len(r.opts):len(r.opts)], WithCredentials(credentials))...))
+}
+
+func (r *CredentialsRegistry) set(key string, signer *Signer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.signers[key] = signer
+}
+
+// Remove forgets the credentials registered under key.
+func (r *CredentialsRegistry) Remove(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.signers, key)
+}
+
+// Signer returns the signer of the credentials registered under key.
+func (r *CredentialsRegistry) Signer(key string) (*Signer, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	signer, ok := r.signers[key]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return signer, nil
+}
+
+// Credentials returns the credentials registered under key, retrieving them
+// from its provider if they have expired.
+func (r *CredentialsRegistry) Credentials(key string) (Credentials, error) {
+	signer, err := r.Signer(key)
+	if err != nil {
+		return Credentials{}, err
+	}
+	return signer.Credentials()
+}
+
+// SignFor signs a request with the credentials registered under key, as
+// Signer.Sign does.
+func (r *CredentialsRegistry) SignFor(key string, request *http.Request) (*http.Request, error) {
+	signer, err := r.Signer(key)
+	if err != nil {
+		return request, err
+	}
+	return signer.Sign(request)
+}
+
+// PresignFor returns a Version 4 presigned URL for the request, signed with
+// the credentials registered under key.
+func (r *CredentialsRegistry) PresignFor(key string, request *http.Request, expires time.Duration) (string, error) {
+	signer, err := r.Signer(key)
+	if err != nil {
+		return "", err
+	}
+	return signer.Presign(request, expires)
+}
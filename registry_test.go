@@ -0,0 +1,84 @@
+package awsauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCredentialsRegistry(t *testing.T) {
+	Convey("Given a registry of tenants' credentials", t, func() {
+		registry := NewCredentialsRegistry()
+		expiring := &test_provider{credentials: Credentials{AccessKeyID: "AKIDFIRST", SecretAccessKey: "first", Expiration: time.Now().Add(-time.Minute)}}
+		registry.Register("first", expiring)
+		registry.RegisterCredentials("second", Credentials{AccessKeyID: "AKIDSECOND", SecretAccessKey: "second"})
+
+		Convey("Each tenant's requests should be signed with its own credentials at the same time", func() {
+			var wg sync.WaitGroup
+			requests := make([]*http.Request, 20)
+			for i := range requests {
+				requests[i], _ = http.NewRequest("GET", "https://sqs.us-east-1.amazonaws.com/", nil)
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					registry.SignFor([]string{"first", "second"}[i%2], requests[i])
+				}(i)
+			}
+			wg.Wait()
+
+			for i, request := range requests {
+				So(request.Header.Get("Authorization"), ShouldContainSubstring, "Credential="+[]string{"AKIDFIRST", "AKIDSECOND"}[i%2]+"/")
+			}
+		})
+
+		Convey("Credentials in a request's context should not override the tenant's", func() {
+			ctx := ContextWithCredentials(context.Background(), Credentials{AccessKeyID: "AKIDOTHER", SecretAccessKey: "other"})
+			request, _ := http.NewRequestWithContext(ctx, "GET", "https://sqs.us-east-1.amazonaws.com/", nil)
+			registry.SignFor("second", request)
+			So(request.Header.Get("Authorization"), ShouldContainSubstring, "Credential=AKIDSECOND/")
+		})
+
+		Convey("Expired credentials should be retrieved again from the tenant's provider", func() {
+			registry.Credentials("first")
+			registry.Credentials("first")
+			So(expiring.retrieved, ShouldEqual, 2)
+		})
+
+		Convey("A URL should be presigned for a tenant", func() {
+			request, _ := http.NewRequest("GET", "https://examplebucket.s3.amazonaws.com/test.txt", nil)
+			presigned, err := registry.PresignFor("second", request, time.Hour)
+			So(err, ShouldBeNil)
+			So(test_queryOf(presigned).Get("X-Amz-Credential"), ShouldStartWith, "AKIDSECOND/")
+		})
+
+		Convey("Unknown and removed tenants should be refused", func() {
+			request, _ := http.NewRequest("GET", "https://sqs.us-east-1.amazonaws.com/", nil)
+			_, err := registry.SignFor("third", request)
+			So(err, ShouldEqual, ErrUnknownKey)
+
+			registry.Remove("second")
+			_, err = registry.SignFor("second", request)
+			So(err, ShouldEqual, ErrUnknownKey)
+			So(request.Header.Get("Authorization"), ShouldBeBlank)
+		})
+	})
+
+	Convey("Given a registry with signing options", t, func() {
+		registry := NewCredentialsRegistry(WithRegion("eu-west-1"), WithService("execute-api"))
+		for i := 0; i < 3; i++ {
+			registry.RegisterCredentials(fmt.Sprint(i), *testCredV4)
+		}
+
+		Convey("Every tenant's requests should be signed with them", func() {
+			request, _ := http.NewRequest("GET", "https://api.example.com/orders", nil)
+			_, err := registry.SignFor("1", request)
+			So(err, ShouldBeNil)
+			So(request.Header.Get("Authorization"), ShouldContainSubstring, "/eu-west-1/execute-api/aws4_request")
+		})
+	})
+}
@@ -0,0 +1,179 @@
+package awsauth
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RetryTransport is an http.RoundTripper that sends a request again when it
+// fails in a way that may pass, such as throttling, a server error or an
+// expired session token. Since a signature is only good for a while, each
+// attempt is sent through Base as a fresh copy, to be signed anew:
+//
+//	client := &http.Client{Transport: &awsauth.RetryTransport{Base: awsauth.NewTransport(nil)}}
+type RetryTransport struct {
+	// Base signs and sends each attempt. If nil, a SigningTransport that
+	// picks the signature version of each request's service is used.
+	Base http.RoundTripper
+
+	// MaxAttempts is how many times a request is sent at most, the first
+	// time included. If zero, DefaultMaxAttempts is used.
+	MaxAttempts int
+
+	// Backoff returns how long to wait before the given retry, counting from
+	// 1. If nil, the wait doubles from 100 milliseconds up to 20 seconds,
+	// with random jitter.
+	Backoff func(retry int) time.Duration
+
+	// RetryStatuses are the response status codes that are retried. If nil,
+	// 429, 500, 502, 503 and 504 are.
+	RetryStatuses []int
+
+	// signer is the SigningTransport used when Base is nil, made on first
+	// use so that its clock offset and credentials carry across requests.
+	signer     *SigningTransport
+	signerOnce sync.Once
+}
+
+// DefaultMaxAttempts is how many times a RetryTransport sends a request at
+// most unless told otherwise.
+var DefaultMaxAttempts = 3
+
+// RoundTrip sends the request until it succeeds, fails in a way that won't
+// pass, or has been sent MaxAttempts times, and returns the last response.
+// The body of the request is buffered on a copy so that it can be sent again;
+// the caller's request is left untouched.
+func (t *RetryTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	outgoing := request.Clone(request.Context())
+	if outgoing.Body != nil && outgoing.Body != http.NoBody && outgoing.GetBody == nil {
+		readAndReplaceBody(outgoing)
+	}
+	if request.Body != nil {
+		request.Body.Close()
+	}
+
+	for retry := 0; ; retry++ {
+		if retry > 0 {
+			timer := time.NewTimer(t.backoff(retry))
+			select {
+			case <-request.Context().Done():
+				timer.Stop()
+				return nil, request.Context().Err()
+			case <-timer.C:
+			}
+		}
+
+		attempt, err := cloneRequest(outgoing)
+		if err != nil {
+			return nil, err
+		}
+		response, err := t.base().RoundTrip(attempt)
+		if retry+1 >= t.maxAttempts() || request.Context().Err() != nil {
+			return response, err
+		}
+		if err == nil {
+			if tokenExpired(response) {
+				// Sign the next attempt with new credentials
+				if refresher, ok := t.base().(CredentialsRefresher); ok {
+					refresher.RefreshCredentials(outgoing)
+				}
+			} else if !t.retryable(response.StatusCode) {
+				return response, nil
+			}
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}
+	}
+}
+
+// CredentialsRefresher is implemented by transports that can retrieve the
+// credentials they sign a request with again. A RetryTransport refreshes the
+// credentials of its Base through it when a request is refused for an expired
+// session token; a Base that doesn't implement it is retried as is.
+type CredentialsRefresher interface {
+	RefreshCredentials(request *http.Request) error
+}
+
+// tokenExpired reports whether a request was refused because the session token
+// it was signed with has expired. The body of the response is left readable.
+func tokenExpired(response *http.Response) bool {
+	if response.StatusCode != http.StatusForbidden && response.StatusCode != http.StatusBadRequest {
+		return false
+	}
+
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	for _, code := range expiredTokenCodes {
+		if bytes.Contains(body, []byte(code)) {
+			return true
+		}
+	}
+	return false
+}
+
+// expiredTokenCodes are the error codes AWS refuses requests with when their
+// credentials have expired.
+var expiredTokenCodes = []string{"ExpiredToken", "RequestExpired", "TokenRefreshRequired"}
+
+func (t *RetryTransport) retryable(status int) bool {
+	statuses := t.RetryStatuses
+	if statuses == nil {
+		statuses = defaultRetryStatuses
+	}
+	for _, retryable := range statuses {
+		if status == retryable {
+			return true
+		}
+	}
+	return false
+}
+
+var defaultRetryStatuses = []int{
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+func (t *RetryTransport) backoff(retry int) time.Duration {
+	if t.Backoff != nil {
+		return t.Backoff(retry)
+	}
+
+	wait := maxBackoff
+	if retry < 16 {
+		wait = minBackoff << (retry - 1)
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 20 * time.Second
+)
+
+func (t *RetryTransport) maxAttempts() int {
+	if t.MaxAttempts > 0 {
+		return t.MaxAttempts
+	}
+	return DefaultMaxAttempts
+}
+
+func (t *RetryTransport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	t.signerOnce.Do(func() {
+		t.signer = &SigningTransport{auto: true}
+	})
+	return t.signer
+}
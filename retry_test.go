@@ -0,0 +1,146 @@
+package awsauth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRetryTransport(t *testing.T) {
+	Convey("Given a server that fails the first requests it is sent", t, func() {
+		var statuses []int
+		var dates, bodies []string
+		base := NewTransport(test_roundTripper(func(r *http.Request) (*http.Response, error) {
+			dates = append(dates, r.Header.Get("X-Amz-Date"))
+			payload, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(payload))
+
+			recorder := httptest.NewRecorder()
+			if len(statuses) > 0 {
+				recorder.WriteHeader(statuses[0])
+				statuses = statuses[1:]
+			}
+			return recorder.Result(), nil
+		}), WithCredentials(*testCredV4))
+
+		var waits []int
+		transport := &RetryTransport{Base: base, Backoff: func(retry int) time.Duration {
+			waits = append(waits, retry)
+			return 0
+		}}
+		test_send := func() *http.Response {
+			request, _ := http.NewRequest("PUT", "https://examplebucket.s3.amazonaws.com/object", strings.NewReader("payload"))
+			response, err := transport.RoundTrip(request)
+			So(err, ShouldBeNil)
+			return response
+		}
+
+		Convey("A throttled request should be signed and sent again with its body", func() {
+			statuses = []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}
+			times := []string{"20230101T000000Z", "20230101T000001Z", "20230101T000002Z"}
+			defer test_mockNowV4(times[0])()
+			saved := now
+			now = func() time.Time { return saved().Add(time.Duration(len(dates)) * time.Second) }
+
+			So(test_send().StatusCode, ShouldEqual, http.StatusOK)
+			So(dates, ShouldResemble, times)
+			So(bodies, ShouldResemble, []string{"payload", "payload", "payload"})
+			So(waits, ShouldResemble, []int{1, 2})
+		})
+
+		Convey("A request should be sent no more than MaxAttempts times", func() {
+			statuses = []int{500, 500, 500, 500}
+			transport.MaxAttempts = 2
+
+			So(test_send().StatusCode, ShouldEqual, http.StatusInternalServerError)
+			So(len(dates), ShouldEqual, 2)
+		})
+
+		Convey("A request refused for other reasons should not be sent again", func() {
+			statuses = []int{http.StatusNotFound}
+
+			So(test_send().StatusCode, ShouldEqual, http.StatusNotFound)
+			So(len(dates), ShouldEqual, 1)
+		})
+
+		Convey("Only the given status codes should be retried", func() {
+			statuses = []int{http.StatusServiceUnavailable}
+			transport.RetryStatuses = []int{http.StatusTooManyRequests}
+
+			So(test_send().StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+			So(len(dates), ShouldEqual, 1)
+		})
+
+		Convey("A body that can't be rewound should be buffered on a copy", func() {
+			statuses = []int{http.StatusServiceUnavailable}
+			request, _ := http.NewRequest("PUT", "https://examplebucket.s3.amazonaws.com/object", ioutil.NopCloser(strings.NewReader("payload")))
+			body := request.Body
+
+			response, err := transport.RoundTrip(request)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			So(bodies, ShouldResemble, []string{"payload", "payload"})
+			So(request.Body, ShouldEqual, body)
+			So(request.GetBody, ShouldBeNil)
+		})
+	})
+
+	Convey("Given a retry transport without a base", t, func() {
+		transport := &RetryTransport{}
+
+		Convey("Every request should be signed by the same transport", func() {
+			signer := transport.base()
+			So(signer, ShouldHaveSameTypeAs, &SigningTransport{})
+			So(transport.base(), ShouldEqual, signer)
+		})
+	})
+
+	Convey("Given credentials whose session token has expired", t, func() {
+		defer test_restoreCredentials()()
+		provider := &test_provider{credentials: Credentials{AccessKeyID: "ASIAEXAMPLE", SecretAccessKey: "secret", SecurityToken: "token-1"}}
+		SetCredentialProviders(provider)
+
+		var tokens []string
+		transport := &RetryTransport{
+			Base: NewTransport(test_roundTripper(func(r *http.Request) (*http.Response, error) {
+				tokens = append(tokens, r.Header.Get("X-Amz-Security-Token"))
+				recorder := httptest.NewRecorder()
+				if len(tokens) == 1 {
+					provider.Lock()
+					provider.credentials.SecurityToken = "token-2"
+					provider.Unlock()
+					recorder.WriteHeader(http.StatusForbidden)
+					fmt.Fprint(recorder, "<Error><Code>ExpiredToken</Code></Error>")
+				}
+				return recorder.Result(), nil
+			})),
+			Backoff: func(int) time.Duration { return 0 },
+		}
+
+		Convey("The request should be signed again with new credentials", func() {
+			request, _ := http.NewRequest("GET", "https://sqs.us-east-1.amazonaws.com/", nil)
+			response, err := transport.RoundTrip(request)
+
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			So(tokens, ShouldResemble, []string{"token-1", "token-2"})
+		})
+
+		Convey("The current credentials should be left alone when the transport signs with its own", func() {
+			CurrentCredentials()
+			retrieved := provider.retrieved
+			transport.Base.(*SigningTransport).Credentials = &Credentials{AccessKeyID: "ASIAOWN", SecretAccessKey: "secret", SecurityToken: "own"}
+
+			request, _ := http.NewRequest("GET", "https://sqs.us-east-1.amazonaws.com/", nil)
+			transport.RoundTrip(request)
+			So(tokens, ShouldResemble, []string{"own", "own"})
+			So(provider.retrieved, ShouldEqual, retrieved)
+		})
+	})
+}
@@ -2,6 +2,8 @@ package awsauth
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"net"
 	"net/http"
 	"sort"
 	"strconv"
@@ -47,8 +49,49 @@ func stringToSignS3(request *http.Request) string {
 	return str
 }
 
-func stringToSignS3Url(method string, expire time.Time, path string) string {
-	return method + "\n\n\n" + timeToUnixEpochString(expire) + "\n" + path
+// presignURLS3 returns a copy of the request URL with the query string
+// parameters of S3 query string authentication, valid until it expires. The
+// Content-Md5, Content-Type and X-Amz-* headers of the request are signed,
+// so whoever uses the URL must send them unchanged.
+func presignURLS3(request *http.Request, expires time.Time, keys Credentials) string {
+	start := time.Now()
+	presigned := request.Clone(request.Context())
+	if presigned.URL.Path == "" {
+		presigned.URL.Path = "/"
+	}
+	escapePathS3(presigned)
+
+	query := presigned.URL.Query()
+	if keys.SecurityToken != "" {
+		// Signed as a header, but sent in the query string
+		presigned.Header.Set("X-Amz-Security-Token", keys.SecurityToken)
+		query.Set("x-amz-security-token", keys.SecurityToken)
+	}
+
+	stringToSign := presigned.Method + "\n" +
+		presigned.Header.Get("Content-Md5") + "\n" +
+		presigned.Header.Get("Content-Type") + "\n" +
+		timeToUnixEpochString(expires) + "\n" +
+		canonicalAmzHeadersS3(presigned) +
+		canonicalResourceS3(presigned)
+
+	query.Set("AWSAccessKeyId", keys.AccessKeyID)
+	query.Set("Expires", timeToUnixEpochString(expires))
+	query.Set("Signature", signatureS3(stringToSign, keys))
+	presigned.URL.RawQuery = query.Encode()
+	observeSign("AWS", "", "", true, start)
+
+	return presigned.URL.String()
+}
+
+// stringToSignS3Url builds the string to sign of a query string authenticated
+// request. securityToken, if set, is signed as the only x-amz- header.
+func stringToSignS3Url(method string, expire time.Time, securityToken, path string) string {
+	amzHeaders := ""
+	if securityToken != "" {
+		amzHeaders = "x-amz-security-token:" + securityToken + "\n"
+	}
+	return method + "\n\n\n" + timeToUnixEpochString(expire) + "\n" + amzHeaders + path
 }
 
 func timeToUnixEpochString(t time.Time) string {
@@ -58,17 +101,25 @@ func timeToUnixEpochString(t time.Time) string {
 func canonicalAmzHeadersS3(request *http.Request) string {
 	var headers []string
 
+	seen := map[string]bool{}
 	for header := range request.Header {
 		standardized := strings.ToLower(strings.TrimSpace(header))
-		if strings.HasPrefix(standardized, "x-amz") {
+		if strings.HasPrefix(standardized, "x-amz-") && !seen[standardized] {
+			seen[standardized] = true
 			headers = append(headers, standardized)
 		}
 	}
 
 	sort.Strings(headers)
 
+	// Repeated headers, however they are cased, are signed as one with their
+	// values joined by commas
 	for i, header := range headers {
-		headers[i] = header + ":" + strings.Replace(request.Header.Get(header), "\n", " ", -1)
+		values := headerValues(request.Header, header)
+		for j := range values {
+			values[j] = strings.TrimSpace(strings.Replace(values[j], "\n", " ", -1))
+		}
+		headers[i] = header + ":" + strings.Join(values, ",")
 	}
 
 	if len(headers) > 0 {
@@ -81,12 +132,11 @@ func canonicalAmzHeadersS3(request *http.Request) string {
 func canonicalResourceS3(request *http.Request) string {
 	res := ""
 
-	if isS3VirtualHostedStyle(request) {
-		bucketname := strings.Split(request.Host, ".")[0]
+	if bucketname := bucketS3(requestHost(request)); bucketname != "" {
 		res += "/" + bucketname
 	}
 
-	res += request.URL.Path
+	res += normuri(request.URL.Path)
 
 	for _, subres := range strings.Split(subresourcesS3, ",") {
 		if strings.HasPrefix(request.URL.RawQuery, subres) {
@@ -105,10 +155,108 @@ func prepareRequestS3(request *http.Request) *http.Request {
 	return request
 }
 
+// escapePathS3 makes a copy of a request send its path encoded the way it is
+// signed, where Go would otherwise leave characters such as & and =
+// unencoded. The encoding is the one Version 4 uses for its canonical URI, so
+// that both versions sign the same key with the same path. The caller's own
+// requests are signed with the path encoded that way, but left as they are.
+func escapePathS3(request *http.Request) {
+	request.URL.RawPath = normuri(request.URL.Path)
+}
+
+// bucketS3 returns the bucket named in front of the S3 endpoint in a
+// virtual-hosted-style host, which may itself contain dots, or an empty string
+// for path-style hosts.
 // Info: http://docs.aws.amazon.com/AmazonS3/latest/dev/VirtualHosting.html
-func isS3VirtualHostedStyle(request *http.Request) bool {
-	service, _ := serviceAndRegion(request.Host)
-	return service == "s3" && strings.Count(request.Host, ".") == 3
+func bucketS3(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	labels := strings.Split(host, ".")
+	for i := len(labels) - 1; i > 0; i-- {
+		label := labels[i]
+		if label == "s3" || (strings.HasPrefix(label, "s3-") && serviceLabels[label] == "" && label != "s3-global") {
+			return strings.Join(labels[:i], ".")
+		}
+	}
+	return ""
+}
+
+// postPolicyV4 returns the form fields of a browser-based upload to S3 with the
+// given policy, signed with Version 4 for the region. The policy is given the
+// conditions on the signing fields it lacks, since S3 requires every field of
+// the form to be named by one.
+// Info: https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-HTTPPOSTConstructPolicy.html
+func postPolicyV4(policy []byte, region string, keys Credentials) (map[string]string, error) {
+	timestamp := timestampV4()
+	date := tsDateV4(timestamp)
+
+	fields := map[string]string{
+		"x-amz-algorithm":  "AWS4-HMAC-SHA256",
+		"x-amz-credential": keys.AccessKeyID + "/" + concat("/", date, region, "s3", "aws4_request"),
+		"x-amz-date":       timestamp,
+	}
+	if keys.SecurityToken != "" {
+		fields["x-amz-security-token"] = keys.SecurityToken
+	}
+
+	policy, err := withConditionsS3(policy, fields)
+	if err != nil {
+		return nil, err
+	}
+	fields["policy"] = base64.StdEncoding.EncodeToString(policy)
+
+	signingKey := keyCache.signingKey(keys.SecretAccessKey, date, region, "s3")
+	fields["x-amz-signature"] = signatureV4(signingKey, fields["policy"])
+	return fields, nil
+}
+
+// withConditionsS3 returns the policy with a condition requiring each of the
+// fields that it doesn't already have a condition on, or the policy as it is
+// if it has them all.
+func withConditionsS3(policy []byte, fields map[string]string) ([]byte, error) {
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal(policy, &document); err != nil {
+		return nil, err
+	}
+	var conditions []json.RawMessage
+	if raw, ok := document["conditions"]; ok {
+		if err := json.Unmarshal(raw, &conditions); err != nil {
+			return nil, err
+		}
+	}
+
+	present := map[string]bool{}
+	for _, condition := range conditions {
+		var match map[string]string
+		var operation []string
+		if json.Unmarshal(condition, &match) == nil {
+			for field := range match {
+				present[strings.ToLower(field)] = true
+			}
+		} else if json.Unmarshal(condition, &operation) == nil && len(operation) == 3 {
+			present[strings.ToLower(strings.TrimPrefix(operation[1], "$"))] = true
+		}
+	}
+
+	var names []string
+	for field := range fields {
+		if !present[field] {
+			names = append(names, field)
+		}
+	}
+	if len(names) == 0 {
+		return policy, nil
+	}
+
+	sort.Strings(names)
+	for _, field := range names {
+		condition, _ := json.Marshal(map[string]string{field: fields[field]})
+		conditions = append(conditions, condition)
+	}
+	document["conditions"], _ = json.Marshal(conditions)
+	return json.Marshal(document)
 }
 
 func timestampS3() string {
@@ -0,0 +1,22 @@
+package awsauth
+
+import "encoding/base64"
+
+// DeriveSESSMTPPassword returns the password to send email through the SES
+// SMTP interface of a region with, derived from the secret access key of the
+// IAM user whose access key ID is the SMTP user name. The user needs the
+// ses:SendRawEmail permission.
+// Info: https://docs.aws.amazon.com/ses/latest/dg/smtp-credentials.html
+func DeriveSESSMTPPassword(secret, region string) string {
+	signingKey := signingKeyV4(secret, smtpDateSES, region, "ses")
+	signature := hmacSHA256(signingKey, smtpMessageSES)
+	return base64.StdEncoding.EncodeToString(append([]byte{smtpVersionSES}, signature...))
+}
+
+const (
+	// The fixed date and message the SMTP password is a signature of
+	smtpDateSES    = "11111111"
+	smtpMessageSES = "SendRawEmail"
+
+	smtpVersionSES = 0x04
+)
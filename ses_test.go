@@ -0,0 +1,32 @@
+package awsauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSESSMTPPassword(t *testing.T) {
+	Convey("Given the secret access key of an IAM user", t, func() {
+		secret := "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"
+		password := DeriveSESSMTPPassword(secret, "us-east-1")
+
+		Convey("The password should be the version followed by the signature of SendRawEmail", func() {
+			key := []byte("AWS4" + secret)
+			for _, part := range []string{"11111111", "us-east-1", "ses", "aws4_request", "SendRawEmail"} {
+				mac := hmac.New(sha256.New, key)
+				mac.Write([]byte(part))
+				key = mac.Sum(nil)
+			}
+			So(password, ShouldEqual, base64.StdEncoding.EncodeToString(append([]byte{4}, key...)))
+			So(password, ShouldHaveLength, 44)
+		})
+
+		Convey("Each region should have its own password", func() {
+			So(DeriveSESSMTPPassword(secret, "eu-west-1"), ShouldNotEqual, password)
+		})
+	})
+}
@@ -17,7 +17,7 @@ func prepareRequestV2(request *http.Request, keys Credentials) *http.Request {
 	values.Set("SignatureMethod", "HmacSHA256")
 	values.Set("Timestamp", timestampV2())
 
-	augmentRequestQuery(request, values)
+	augmentRequestParamsV2(request, values)
 
 	if request.URL.Path == "" {
 		request.URL.Path += "/"
@@ -28,7 +28,7 @@ func prepareRequestV2(request *http.Request, keys Credentials) *http.Request {
 
 func stringToSignV2(request *http.Request) string {
 	str := request.Method + "\n"
-	str += strings.ToLower(request.URL.Host) + "\n"
+	str += strings.ToLower(requestHost(request)) + "\n"
 	str += request.URL.Path + "\n"
 	str += canonicalQueryStringV2(request)
 	return str
@@ -39,10 +39,56 @@ func signatureV2(strToSign string, keys Credentials) string {
 	return base64.StdEncoding.EncodeToString(hashed)
 }
 
+// signatureV2SHA1 signs with HMAC-SHA1, for requests whose SignatureMethod is
+// HmacSHA1, as older services that take Version 2 signatures require.
+func signatureV2SHA1(strToSign string, keys Credentials) string {
+	hashed := hmacSHA1([]byte(keys.SecretAccessKey), strToSign)
+	return base64.StdEncoding.EncodeToString(hashed)
+}
+
 func canonicalQueryStringV2(request *http.Request) string {
+	if formRequestV2(request) {
+		return normquery(paramsV2(request))
+	}
 	return request.URL.RawQuery
 }
 
+// formRequestV2 reports whether a request carries its parameters in a
+// form-encoded body, as SQS and SNS POST requests do, rather than in its query
+// string. Those parameters are signed and the signature is added to them.
+func formRequestV2(request *http.Request) bool {
+	contentType := request.Header.Get("Content-Type")
+	return request.Method == "POST" && strings.HasPrefix(contentType, "application/x-www-form-urlencoded")
+}
+
+// paramsV2 returns the parameters of a request, from its body if it is a form.
+func paramsV2(request *http.Request) url.Values {
+	if !formRequestV2(request) {
+		return request.URL.Query()
+	}
+	params, _ := url.ParseQuery(string(readAndReplaceBody(request)))
+	return params
+}
+
+// augmentRequestParamsV2 adds values to the parameters of a request, in its
+// body if it is a form or else in its query string. Parameters the request
+// already has are kept as they are.
+func augmentRequestParamsV2(request *http.Request, values url.Values) {
+	if !formRequestV2(request) {
+		augmentRequestQuery(request, values)
+		return
+	}
+
+	for key, array := range paramsV2(request) {
+		for _, value := range array {
+			values.Set(key, value)
+		}
+	}
+	payload := []byte(values.Encode())
+	replaceBody(request, payload)
+	request.ContentLength = int64(len(payload))
+}
+
 func timestampV2() string {
 	return now().Format(timeFormatV2)
 }
@@ -1,54 +1,268 @@
 package awsauth
 
 import (
+	"crypto/sha256"
 	"encoding/hex"
+	"net"
 	"net/http"
+	"path"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 func hashedCanonicalRequestV4(request *http.Request, meta *metadata) string {
 	// TASK 1. http://docs.aws.amazon.com/general/latest/gr/sigv4-create-canonical-request.html
 
-	payload := readAndReplaceBody(request)
-	payloadHash := hashSHA256(payload)
+	// Requests without a body are left without one
+	payloadHash := emptyPayloadHash
+	if meta.payloadHash != "" {
+		payloadHash = meta.payloadHash
+	} else if request.Header.Get("X-Amz-Content-Sha256") == unsignedPayload && request.URL.Scheme == "https" {
+		// The caller chose not to sign the body, which TLS protects instead
+		payloadHash = unsignedPayload
+	} else if hash := request.Header.Get("X-Amz-Content-Sha256"); isPayloadHashV4(hash) {
+		// The caller already hashed the body
+		payloadHash = strings.ToLower(hash)
+	} else if request.Body != nil && request.Body != http.NoBody {
+		payloadHash = hashBody(request)
+	}
 	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
 
 	// Set this in header values to make it appear in the range of headers to sign
-	request.Header.Set("Host", request.Host)
+	request.Header.Set("Host", requestHost(request))
 
 	var sortedHeaderKeys []string
-	for key, _ := range request.Header {
-		switch key {
-		case "Content-Type", "Content-Md5", "Host":
-		default:
-			if !strings.HasPrefix(key, "X-Amz-") {
+	if meta.headersToSign != nil {
+		sortedHeaderKeys = headerKeysV4(meta.headersToSign)
+	} else {
+		for key, _ := range request.Header {
+			switch {
+			case key == "Host", key == "X-Amz-Date":
+			case containsFold(meta.excludeHeaders, key):
+				continue
+			case key == "Content-Type", key == "Content-Md5", strings.HasPrefix(key, "X-Amz-"):
+			case !containsFold(meta.includeHeaders, key):
 				continue
 			}
+			sortedHeaderKeys = append(sortedHeaderKeys, key)
+		}
+		// Headers set under differently cased names are signed once
+		sortedHeaderKeys = headerKeysV4(sortedHeaderKeys)
+	}
+
+	headersToSign := canonicalHeadersV4(request, sortedHeaderKeys)
+	meta.signedHeaders = concat(";", sortedHeaderKeys...)
+	meta.canonicalRequest = concat("\n", request.Method, canonicalURIV4(request, meta), normquery(request.URL.Query()), headersToSign, meta.signedHeaders, payloadHash)
+
+	return hashSHA256([]byte(meta.canonicalRequest))
+}
+
+// containsFold reports whether a header name is in a list, ignoring case.
+func containsFold(headers []string, name string) bool {
+	for _, header := range headers {
+		if strings.EqualFold(strings.TrimSpace(header), name) {
+			return true
 		}
-		sortedHeaderKeys = append(sortedHeaderKeys, strings.ToLower(key))
 	}
-	sort.Strings(sortedHeaderKeys)
+	return false
+}
+
+// headerKeysV4 turns header names into the lower-case, sorted and
+// de-duplicated list that is signed.
+func headerKeysV4(headers []string) []string {
+	var keys []string
+	seen := map[string]bool{}
+	for _, header := range headers {
+		key := strings.ToLower(strings.TrimSpace(header))
+		if key != "" && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// isPayloadHashV4 reports whether a value is a hex-encoded SHA-256 hash.
+func isPayloadHashV4(value string) bool {
+	if len(value) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
 
+// canonicalHeadersV4 builds the canonical headers block from the given
+// lower-case, sorted header names.
+func canonicalHeadersV4(request *http.Request, keys []string) string {
 	var headersToSign string
-	for _, key := range sortedHeaderKeys {
-		value := strings.TrimSpace(request.Header.Get(key))
+	for _, key := range keys {
+		// Repeated headers are signed as one, their values joined by commas,
+		// and runs of spaces within values are signed as a single space.
+		values := headerValues(request.Header, key)
+		for i := range values {
+			values[i] = strings.Join(strings.Fields(values[i]), " ")
+		}
+		value := strings.Join(values, ",")
 		if key == "host" {
-			//AWS does not include port in signing request.
-			if strings.Contains(value, ":") {
-				split := strings.Split(value, ":")
-				port := split[1]
-				if port == "80" || port == "443" {
-					value = split[0]
-				}
-			}
+			value = canonicalHostV4(request)
 		}
 		headersToSign += key + ":" + value + "\n"
 	}
+	return headersToSign
+}
+
+// canonicalURIV4 returns the path of a request as it is signed: with empty
+// and dot segments removed, and encoded twice, the path as sent being encoded
+// again. Services that take paths literally, such as S3, have them signed as
+// they are and encoded once; OpenSearch has them signed as they are and
+// encoded twice.
+func canonicalURIV4(request *http.Request, meta *metadata) string {
+	service := meta.service
+	if service == "" {
+		service, _ = serviceAndRegion(requestHost(request))
+	}
+
+	uri := escapedPath(request.URL)
+	if !meta.rawPath && !rawPathServices[service] && !unnormalizedPathServices[service] {
+		cleaned := path.Clean(uri)
+		if cleaned != "/" && strings.HasSuffix(uri, "/") {
+			cleaned += "/"
+		}
+		uri = cleaned
+	}
+
+	switch {
+	case meta.escapedPath:
+		return uri
+	case meta.singleEncode || rawPathServices[service]:
+		return normescapeduri(uri)
+	default:
+		return normuri(uri)
+	}
+}
+
+// canonicalHostV4 returns the host of a request as it is signed: without its
+// port if that is the default one of the URL's scheme, WebSocket schemes
+// included. Requests without a scheme, as received by servers, are signed
+// without either default port.
+func canonicalHostV4(request *http.Request) string {
+	host := requestHost(request)
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return host
+	}
+
+	switch strings.ToLower(request.URL.Scheme) {
+	case "http", "ws":
+		if port != "80" {
+			return host
+		}
+	case "https", "wss":
+		if port != "443" {
+			return host
+		}
+	default:
+		if port != "80" && port != "443" {
+			return host
+		}
+	}
+	if strings.Contains(hostname, ":") {
+		return "[" + hostname + "]"
+	}
+	return hostname
+}
+
+// presignURLV4 returns a copy of the request URL with the query string
+// parameters that authorize it for the given duration, signature included.
+// The service and region in meta, if set, override those of the host.
+// The host header is always signed, along with any extra headers named.
+func presignURLV4(request *http.Request, meta *metadata, expires time.Duration, headers []string, keys Credentials) string {
+	start := time.Now()
+	meta.algorithm = "AWS4-HMAC-SHA256"
+	service, region := serviceAndRegion(requestHost(request))
+	if meta.service == "" {
+		meta.service = service
+	}
+	if meta.region == "" {
+		meta.region = region
+	}
+
+	requestTs := timestampV4()
+	meta.timestamp = requestTs
+	meta.date = tsDateV4(requestTs)
+	meta.credentialScope = concat("/", meta.date, meta.region, meta.service, "aws4_request")
+
+	sortedHeaderKeys := headerKeysV4(append([]string{"host"}, headers...))
 	meta.signedHeaders = concat(";", sortedHeaderKeys...)
-	canonicalRequest := concat("\n", request.Method, normuri(request.URL.Path), normquery(request.URL.Query()), headersToSign, meta.signedHeaders, payloadHash)
 
-	return hashSHA256([]byte(canonicalRequest))
+	query := request.URL.Query()
+	query.Set("X-Amz-Algorithm", meta.algorithm)
+	query.Set("X-Amz-Credential", keys.AccessKeyID+"/"+meta.credentialScope)
+	query.Set("X-Amz-Date", requestTs)
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(expires/time.Second), 10))
+	query.Set("X-Amz-SignedHeaders", meta.signedHeaders)
+	if keys.SecurityToken != "" && !meta.unsignedToken {
+		query.Set("X-Amz-Security-Token", keys.SecurityToken)
+	}
+
+	// A payload hash other than the service's default is named in the
+	// query, so that whoever checks the URL knows which was signed
+	payloadHash := meta.payloadHash
+	if payloadHash == "" {
+		payloadHash = presignedPayloadHashV4(meta.service)
+	} else if payloadHash != presignedPayloadHashV4(meta.service) {
+		query.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	headersToSign := canonicalHeadersV4(request, sortedHeaderKeys)
+	meta.canonicalRequest = concat("\n", request.Method, canonicalURIV4(request, meta), normquery(query), headersToSign, meta.signedHeaders, payloadHash)
+
+	stringToSign := concat("\n", meta.algorithm, requestTs, meta.credentialScope, hashSHA256([]byte(meta.canonicalRequest)))
+	traceV4(meta, stringToSign)
+	signingKey := keyCache.signingKey(keys.SecretAccessKey, meta.date, meta.region, meta.service)
+	query.Set("X-Amz-Signature", signatureV4(signingKey, stringToSign))
+	if keys.SecurityToken != "" && meta.unsignedToken {
+		query.Set("X-Amz-Security-Token", keys.SecurityToken)
+	}
+
+	presigned := *request.URL
+	presigned.RawQuery = normquery(query)
+	observeSign(meta.algorithm, meta.service, meta.region, true, start)
+	return presigned.String()
+}
+
+// presignedPayloadHashV4 returns the payload hash URLs presigned for the
+// service are signed with when none is given.
+func presignedPayloadHashV4(service string) string {
+	if emptyPayloadServices[service] {
+		return emptyPayloadHash
+	}
+	return unsignedPayload
+}
+
+// credentialsV4 chooses the keys to sign a request with: the ones passed in,
+// or else those CredentialsForRequest picks for the service and region the
+// request is signed for, or else the ones found in the environment.
+func credentialsV4(request *http.Request, meta *metadata, credentials []Credentials) (Credentials, error) {
+	if len(credentials) > 0 || CredentialsForRequest == nil {
+		return requestKeys(request, credentials), nil
+	}
+	if keys, ok := CredentialsFromContext(request.Context()); ok {
+		return keys, nil
+	}
+
+	service, region := serviceAndRegion(requestHost(request))
+	if meta.service != "" {
+		service = meta.service
+	}
+	if meta.region != "" {
+		region = meta.region
+	}
+	return CredentialsForRequest(request, service, region)
 }
 
 func stringToSignV4(request *http.Request, hashedCanonReq string, meta *metadata) string {
@@ -57,13 +271,14 @@ func stringToSignV4(request *http.Request, hashedCanonReq string, meta *metadata
 	requestTs := request.Header.Get("X-Amz-Date")
 
 	meta.algorithm = "AWS4-HMAC-SHA256"
-	service, region := serviceAndRegion(request.Host)
+	service, region := serviceAndRegion(requestHost(request))
 	if meta.service == "" {
 		meta.service = service
 	}
 	if meta.region == "" {
 		meta.region = region
 	}
+	meta.timestamp = requestTs
 	meta.date = tsDateV4(requestTs)
 	meta.credentialScope = concat("/", meta.date, meta.region, meta.service, "aws4_request")
 
@@ -77,15 +292,10 @@ func signatureV4(signingKey []byte, stringToSign string) string {
 }
 
 func prepareRequestV4(request *http.Request) *http.Request {
-	necessaryDefaults := map[string]string{
-		"Content-Type": "application/x-www-form-urlencoded; charset=utf-8",
-		"X-Amz-Date":   timestampV4(),
-	}
-
-	for header, value := range necessaryDefaults {
-		if request.Header.Get(header) == "" {
-			request.Header.Set(header, value)
-		}
+	// Content-Type is only signed if the caller set it; one is never made up.
+	// An X-Amz-Date that isn't a timestamp is replaced rather than signed
+	if !datedV4(request) {
+		request.Header.Set("X-Amz-Date", requestTimestampV4(request))
 	}
 
 	if request.URL.Path == "" {
@@ -103,6 +313,115 @@ func signingKeyV4(secretKey, date, region, service string) []byte {
 	return kSigning
 }
 
+// traceV4 keeps the string to sign in meta, logs the details of the signature
+// and hands them to DebugSigning, if it is set.
+func traceV4(meta *metadata, stringToSign string) {
+	meta.stringToSign = stringToSign
+	// Redacting the canonical request is only worth it if it will be logged
+	if log := logger(meta.logger); log != (nopLogger{}) {
+		log.Debug("awsauth: signing request", "algorithm", meta.algorithm, "scope", meta.credentialScope,
+			"signed_headers", meta.signedHeaders, "canonical_request", redactTokenV4(meta.canonicalRequest), "string_to_sign", stringToSign)
+	}
+	if debug := DebugSigning; debug != nil {
+		debug(meta.trace())
+	}
+}
+
+// redactTokenV4 hides the session token in a canonical request, in the
+// x-amz-security-token header or the X-Amz-Security-Token query parameter, so
+// that it can be logged.
+func redactTokenV4(canonicalRequest string) string {
+	lines := strings.Split(canonicalRequest, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "x-amz-security-token:") {
+			lines[i] = "x-amz-security-token:" + redacted
+			continue
+		}
+		params := strings.Split(line, "&")
+		for j, param := range params {
+			if strings.HasPrefix(param, "X-Amz-Security-Token=") {
+				params[j] = "X-Amz-Security-Token=" + redacted
+			}
+		}
+		lines[i] = strings.Join(params, "&")
+	}
+	return strings.Join(lines, "\n")
+}
+
+const redacted = "REDACTED"
+
+// trace returns the details of the signature described by meta.
+func (meta *metadata) trace() SigningTrace {
+	return SigningTrace{
+		CanonicalRequest: meta.canonicalRequest,
+		StringToSign:     meta.stringToSign,
+		CredentialScope:  meta.credentialScope,
+		SignedHeaders:    meta.signedHeaders,
+		Timestamp:        meta.timestamp,
+		Region:           meta.region,
+		Service:          meta.service,
+	}
+}
+
+// signingKeyCache keeps the signing keys derived for the current date, since
+// a key only changes with the date, region, service and secret key.
+type signingKeyCache struct {
+	sync.RWMutex
+	enabled bool
+	date    string
+	keys    map[string][]byte
+}
+
+var keyCache = signingKeyCache{enabled: true}
+
+// CacheSigningKeys turns caching of Version 4 signing keys on or off. With it
+// on, as it is by default, the four HMAC rounds that derive a key run once per
+// day for each set of credentials, region and service, rather than for every
+// request. Keys are only kept for the latest date signed for.
+func CacheSigningKeys(enabled bool) {
+	keyCache.Lock()
+	defer keyCache.Unlock()
+
+	keyCache.enabled = enabled
+	keyCache.date = ""
+	keyCache.keys = nil
+}
+
+// signingKey returns the signing key for the date, region and service, from
+// the cache when caching is on.
+func (c *signingKeyCache) signingKey(secretKey, date, region, service string) []byte {
+	id := concat("\x00", secretKey, region, service)
+
+	c.RLock()
+	enabled := c.enabled
+	key, ok := c.keys[id]
+	if c.date != date {
+		ok = false
+	}
+	c.RUnlock()
+
+	if !enabled {
+		return signingKeyV4(secretKey, date, region, service)
+	}
+	if ok {
+		return key
+	}
+
+	key = signingKeyV4(secretKey, date, region, service)
+
+	c.Lock()
+	defer c.Unlock()
+	if c.enabled && date >= c.date {
+		// Keys for older dates are no longer needed once a new day starts
+		if date != c.date {
+			c.date = date
+			c.keys = map[string][]byte{}
+		}
+		c.keys[id] = key
+	}
+	return key
+}
+
 func buildAuthHeaderV4(signature string, meta *metadata, keys Credentials) string {
 	credential := keys.AccessKeyID + "/" + meta.credentialScope
 
@@ -112,6 +431,25 @@ func buildAuthHeaderV4(signature string, meta *metadata, keys Credentials) strin
 		", Signature=" + signature
 }
 
+// requestTimestampV4 returns the time a request should be signed at. A Date
+// header set by the caller is honoured so that the signed time and the header
+// agree; otherwise the current time is used.
+func requestTimestampV4(request *http.Request) string {
+	if date := request.Header.Get("Date"); date != "" {
+		if t, err := http.ParseTime(date); err == nil {
+			return t.UTC().Format(timeFormatV4)
+		}
+	}
+	return timestampV4()
+}
+
+// datedV4 reports whether the request has an X-Amz-Date in the
+// 20060102T150405Z format it is signed in.
+func datedV4(request *http.Request) bool {
+	_, err := time.Parse(timeFormatV4, request.Header.Get("X-Amz-Date"))
+	return err == nil
+}
+
 func timestampV4() string {
 	return now().Format(timeFormatV4)
 }
@@ -120,4 +458,17 @@ func tsDateV4(timestamp string) string {
 	return timestamp[:8]
 }
 
-const timeFormatV4 = "20060102T150405Z"
+const (
+	timeFormatV4 = "20060102T150405Z"
+
+	// unsignedPayload stands in for the payload hash of presigned URLs, whose
+	// body is not known when they are signed, and of requests whose body is
+	// left unsigned.
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+
+	// emptyPayloadHash is the SHA-256 hash of an empty body.
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// maxExpiryV4 is the longest a presigned URL can be valid for.
+	maxExpiryV4 = 7 * 24 * time.Hour
+)
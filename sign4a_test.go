@@ -0,0 +1,65 @@
+package awsauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestVersion4ASigningKey(t *testing.T) {
+	Convey("Given an access key pair", t, func() {
+		key, err := signingKeyV4A("AKISORANDOMAASORANDOM", "q+jcrXGc+0zWN6uzclKVhvMmUsIfRPa4rlRandom")
+		So(err, ShouldBeNil)
+
+		Convey("The derived public key should match the one AWS derives", func() {
+			So(fmt.Sprintf("%064X", key.X), ShouldEqual, "15D242CEEBF8D8169FD6A8B5A746C41140414C3B07579038DA06AF89190FFFCB")
+			So(fmt.Sprintf("%064X", key.Y), ShouldEqual, "0515242CEDD82E94799482E4C0514B505AFCCF2C0C98D6A553BF539F424C5EC0")
+		})
+	})
+}
+
+func TestVersion4ASigning(t *testing.T) {
+	Convey("Given a request to a multi-region access point", t, func() {
+		defer test_mockNowV4("20230101T000000Z")()
+
+		var trace SigningTrace
+		DebugSigning = func(t SigningTrace) { trace = t }
+		defer func() { DebugSigning = nil }()
+
+		request, _ := http.NewRequest("GET", "https://mfzwi23gnjvgw.mrap.accesspoint.s3-global.amazonaws.com/photos/puppy.jpg", nil)
+		keys := Credentials{AccessKeyID: "AKISORANDOMAASORANDOM", SecretAccessKey: "q+jcrXGc+0zWN6uzclKVhvMmUsIfRPa4rlRandom", SecurityToken: "token"}
+		Sign4A(request, keys)
+
+		authorization := request.Header.Get("Authorization")
+
+		Convey("It should be signed for every region", func() {
+			So(request.Header.Get("X-Amz-Region-Set"), ShouldEqual, "*")
+			So(authorization, ShouldContainSubstring, "x-amz-region-set")
+		})
+
+		Convey("It should be signed with the Version 4A algorithm and a region-less scope", func() {
+			So(authorization, ShouldStartWith, "AWS4-ECDSA-P256-SHA256 Credential=AKISORANDOMAASORANDOM/20230101/s3/aws4_request, ")
+			So(trace.StringToSign, ShouldStartWith, "AWS4-ECDSA-P256-SHA256\n20230101T000000Z\n20230101/s3/aws4_request\n")
+		})
+
+		Convey("The security token should be signed", func() {
+			So(request.Header.Get("X-Amz-Security-Token"), ShouldEqual, "token")
+			So(authorization, ShouldContainSubstring, "x-amz-security-token")
+		})
+
+		Convey("The signature should verify with the derived public key", func() {
+			key, _ := signingKeyV4A(keys.AccessKeyID, keys.SecretAccessKey)
+			signature, err := hex.DecodeString(authorization[strings.LastIndex(authorization, "Signature=")+len("Signature="):])
+			So(err, ShouldBeNil)
+
+			digest := sha256.Sum256([]byte(trace.StringToSign))
+			So(ecdsa.VerifyASN1(&key.PublicKey, digest[:], signature), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,218 @@
+package awsauth
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func sign4Streaming(request *http.Request, meta *metadata, chunkSize int, credentials []Credentials) (*http.Request, error) {
+	length := request.ContentLength
+	if request.Body == nil || request.Body == http.NoBody {
+		length = 0
+	} else if length <= 0 {
+		return request, ErrUnknownLength
+	}
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSizeV4
+	}
+
+	var newHash func() hash.Hash
+	trailer := ""
+	if meta.checksum != "" {
+		newHash = checksumsS3[strings.ToUpper(meta.checksum)]
+		if newHash == nil {
+			return request, ErrUnknownChecksum
+		}
+		trailer = "x-amz-checksum-" + strings.ToLower(meta.checksum)
+	}
+
+	keys, err := credentialsV4(request, meta, credentials)
+	if err != nil {
+		return request, err
+	}
+	if anonymous(keys) {
+		return request, nil
+	}
+
+	encoding := "aws-chunked"
+	if existing := request.Header.Get("Content-Encoding"); existing != "" {
+		encoding += "," + existing
+	}
+	request.Header.Set("Content-Encoding", encoding)
+	request.Header.Set("X-Amz-Decoded-Content-Length", strconv.FormatInt(length, 10))
+
+	meta.payloadHash = streamingPayloadV4
+	if trailer != "" {
+		request.Header.Set("X-Amz-Trailer", trailer)
+		meta.payloadHash = streamingTrailerV4
+	}
+	sign4(request, meta, []Credentials{keys})
+
+	// Each chunk is signed with the signature of the one before it, the
+	// first with the signature of the request itself
+	signingKey := keyCache.signingKey(keys.SecretAccessKey, meta.date, meta.region, meta.service)
+	chunked := func(body io.ReadCloser) io.ReadCloser {
+		if body == nil {
+			body = http.NoBody
+		}
+		chunked := &chunkedBodyV4{
+			body:       body,
+			signingKey: signingKey,
+			timestamp:  request.Header.Get("X-Amz-Date"),
+			scope:      meta.credentialScope,
+			signature:  meta.signature,
+			chunk:      make([]byte, chunkSize),
+			trailer:    trailer,
+		}
+		if newHash != nil {
+			chunked.checksum = newHash()
+		}
+		return chunked
+	}
+
+	getBody := request.GetBody
+	request.Body = chunked(request.Body)
+	request.GetBody = func() (io.ReadCloser, error) {
+		if getBody == nil {
+			return chunked(nil), nil
+		}
+		body, err := getBody()
+		if err != nil {
+			return nil, err
+		}
+		return chunked(body), nil
+	}
+	request.ContentLength = chunkedLengthV4(length, int64(chunkSize))
+	if newHash != nil {
+		request.ContentLength += trailerLengthV4(trailer, newHash().Size())
+	}
+
+	return request, nil
+}
+
+// chunkedBodyV4 encodes a body as aws-chunked as it is read, signing each
+// chunk and ending with an empty one.
+type chunkedBodyV4 struct {
+	body       io.ReadCloser
+	signingKey []byte
+	timestamp  string
+	scope      string
+	signature  string
+
+	chunk   []byte
+	pending []byte
+	done    bool
+
+	// trailer names the header the checksum of the body is sent in after
+	// the last chunk, if checksum is set.
+	trailer  string
+	checksum hash.Hash
+}
+
+func (c *chunkedBodyV4) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(c.body, c.chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		c.done = n == 0
+		if c.checksum == nil {
+			c.pending = c.encode(c.chunk[:n])
+		} else if !c.done {
+			c.checksum.Write(c.chunk[:n])
+			c.pending = c.encode(c.chunk[:n])
+		} else {
+			c.pending = c.encodeTrailer()
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *chunkedBodyV4) Close() error {
+	return c.body.Close()
+}
+
+// encode signs a chunk and returns it framed with its length and signature.
+func (c *chunkedBodyV4) encode(data []byte) []byte {
+	stringToSign := concat("\n", streamingChunkAlgorithmV4, c.timestamp, c.scope, c.signature, emptyPayloadHash, hashSHA256(data))
+	c.signature = signatureV4(c.signingKey, stringToSign)
+
+	framed := []byte(strconv.FormatInt(int64(len(data)), 16) + ";chunk-signature=" + c.signature + "\r\n")
+	framed = append(framed, data...)
+	return append(framed, '\r', '\n')
+}
+
+// encodeTrailer signs the last, empty chunk and the trailer that carries the
+// checksum of the body, and returns them framed. The trailer is signed with
+// the signature of the last chunk.
+func (c *chunkedBodyV4) encodeTrailer() []byte {
+	framed := c.encode(nil)
+	framed = framed[:len(framed)-2]
+
+	trailer := c.trailer + ":" + base64.StdEncoding.EncodeToString(c.checksum.Sum(nil))
+	stringToSign := concat("\n", streamingTrailerAlgorithmV4, c.timestamp, c.scope, c.signature, hashSHA256([]byte(trailer+"\n")))
+	c.signature = signatureV4(c.signingKey, stringToSign)
+
+	framed = append(framed, trailer+"\r\n"...)
+	return append(framed, "x-amz-trailer-signature:"+c.signature+"\r\n\r\n"...)
+}
+
+// chunkedLengthV4 returns the length of a body once it is encoded as
+// aws-chunked in chunks of the given size.
+func chunkedLengthV4(length, chunkSize int64) int64 {
+	encoded := chunkLengthV4(0) + length/chunkSize*chunkLengthV4(chunkSize)
+	if rest := length % chunkSize; rest > 0 {
+		encoded += chunkLengthV4(rest)
+	}
+	return encoded
+}
+
+// chunkLengthV4 returns the length of an encoded chunk of n bytes.
+func chunkLengthV4(n int64) int64 {
+	return int64(len(strconv.FormatInt(n, 16))+len(";chunk-signature=")+64+len("\r\n\r\n")) + n
+}
+
+// trailerLengthV4 returns how much longer a body encoded as aws-chunked is
+// with a trailer carrying a checksum of the given size.
+func trailerLengthV4(trailer string, checksumSize int) int64 {
+	checksumLine := len(trailer) + len(":") + base64.StdEncoding.EncodedLen(checksumSize) + len("\r\n")
+	signatureLine := len("x-amz-trailer-signature:") + 64 + len("\r\n")
+	return int64(checksumLine + signatureLine)
+}
+
+// checksumsS3 are the algorithms of the checksums S3 can check objects
+// against, by the names it gives them.
+var checksumsS3 = map[string]func() hash.Hash{
+	"CRC32":  func() hash.Hash { return crc32.NewIEEE() },
+	"CRC32C": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	"SHA1":   sha1.New,
+	"SHA256": sha256.New,
+}
+
+const (
+	// streamingPayloadV4 stands in for the payload hash of requests whose
+	// body is signed chunk by chunk.
+	streamingPayloadV4 = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+
+	// streamingTrailerV4 stands in for it when the body is followed by a
+	// trailer.
+	streamingTrailerV4 = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+
+	streamingChunkAlgorithmV4   = "AWS4-HMAC-SHA256-PAYLOAD"
+	streamingTrailerAlgorithmV4 = "AWS4-HMAC-SHA256-TRAILER"
+
+	defaultChunkSizeV4 = 64 * 1024
+)
@@ -0,0 +1,154 @@
+package awsauth
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Signer signs requests with credentials of its own, kept apart from the ones
+// the package-level functions use, so that requests can be signed with
+// several sets of credentials side by side. It is safe for concurrent use.
+type Signer struct {
+	store   *CredentialsStore
+	own     bool
+	version int
+	region  string
+	service string
+
+	signedHeaders   []string
+	unsignedHeaders []string
+	payloadHash     string
+	rawPath         bool
+	singleEncode    bool
+	escapedPath     bool
+	logger          Logger
+}
+
+// NewSigner returns a signer whose credentials come from provider, or from the
+// default chain if provider is nil, and are kept until they expire. It takes
+// the same options as NewTransport: WithCredentials makes it sign with fixed
+// credentials instead, WithVersion fixes the version Sign signs with, and
+// WithRegion and WithService pin the scope of Version 4 signatures, which
+// WithSignedHeaders and WithUnsignedHeaders choose the headers of, and
+// WithPayloadHash the payload hash of.
+// WithoutPathNormalization, WithoutDoubleEncoding and WithoutPathEscaping
+// choose how it signs paths, WithRefreshWindow when it refreshes its
+// credentials, and WithLogger where it logs to.
+func NewSigner(provider CredentialProvider, opts ...Option) *Signer {
+	settings := applyOptions(opts)
+
+	store := &CredentialsStore{logger: settings.Logger, refreshWindow: settings.refreshWindow}
+	if settings.Credentials != nil {
+		store.credentials = settings.Credentials
+		store.providers = []CredentialProvider{}
+	} else if provider != nil {
+		store.providers = []CredentialProvider{provider}
+	}
+	return &Signer{
+		store:           store,
+		own:             settings.Credentials != nil || provider != nil,
+		version:         settings.Version,
+		region:          settings.Region,
+		service:         settings.Service,
+		signedHeaders:   settings.SignedHeaders,
+		unsignedHeaders: settings.UnsignedHeaders,
+		payloadHash:     settings.PayloadHash,
+		rawPath:         settings.DisablePathNormalization,
+		singleEncode:    settings.DisableDoubleEncoding,
+		escapedPath:     settings.DisablePathEscaping,
+		logger:          settings.Logger,
+	}
+}
+
+// Credentials returns the credentials the signer currently signs with,
+// retrieving them from its provider if they have expired.
+func (s *Signer) Credentials() (Credentials, error) {
+	return s.store.Current()
+}
+
+// RefreshCredentials retrieves the signer's credentials again, even if the
+// current ones have not expired yet, such as after AWS answers ExpiredToken.
+// Signers given fixed credentials keep them.
+func (s *Signer) RefreshCredentials() error {
+	return s.store.Refresh()
+}
+
+// Sign signs a request like Sign does, with the signature version the service
+// it is going to expects unless the signer was given one. The credentials are
+// retrieved with the request's context if needed.
+func (s *Signer) Sign(request *http.Request) (*http.Request, error) {
+	keys, err := s.keys(request)
+	if err != nil {
+		return request, err
+	}
+	if signWithMeta(request, s.version, s.meta(), []Credentials{keys}) == nil {
+		return request, fmt.Errorf("awsauth: unknown signature version %d", s.version)
+	}
+	return request, nil
+}
+
+// Sign4 signs a request with Signed Signature Version 4.
+func (s *Signer) Sign4(request *http.Request) (*http.Request, error) {
+	keys, err := s.keys(request)
+	if err != nil {
+		return request, err
+	}
+	return sign4(request, s.meta(), []Credentials{keys}), nil
+}
+
+// Sign4A signs a request with Signature Version 4A.
+func (s *Signer) Sign4A(request *http.Request) (*http.Request, error) {
+	keys, err := s.keys(request)
+	if err != nil {
+		return request, err
+	}
+	return sign4A(request, s.meta(), []Credentials{keys}), nil
+}
+
+// SignS3 signs a request with the legacy S3 authentication scheme.
+func (s *Signer) SignS3(request *http.Request) (*http.Request, error) {
+	keys, err := s.keys(request)
+	if err != nil {
+		return request, err
+	}
+	return SignS3(request, keys), nil
+}
+
+// Presign returns a Version 4 presigned URL for the request, as PresignURL4
+// does.
+func (s *Signer) Presign(request *http.Request, expires time.Duration) (string, error) {
+	keys, err := s.keys(request)
+	if err != nil {
+		return "", err
+	}
+	return presignURL4(request, s.meta(), expires, s.signedHeaders, []Credentials{keys})
+}
+
+// meta returns the signing metadata with the region, service and headers to
+// sign chosen.
+func (s *Signer) meta() *metadata {
+	meta := new(metadata)
+	meta.region, meta.service = s.region, s.service
+	meta.includeHeaders, meta.excludeHeaders = s.signedHeaders, s.unsignedHeaders
+	meta.payloadHash = s.payloadHash
+	meta.rawPath, meta.singleEncode, meta.escapedPath = s.rawPath, s.singleEncode, s.escapedPath
+	meta.logger = s.logger
+	return meta
+}
+
+// keys returns the credentials to sign a request with: the signer's own if it
+// was given a provider or credentials, or else those attached to its context,
+// or else those of the default chain.
+func (s *Signer) keys(request *http.Request) (Credentials, error) {
+	if !s.own {
+		if keys, ok := CredentialsFromContext(request.Context()); ok {
+			return keys, nil
+		}
+	}
+	keys, err := s.store.CurrentCtx(request.Context())
+	if err != nil && !(err == ErrNoCredentials && AllowAnonymous) {
+		return keys, err
+	}
+	return keys, nil
+}
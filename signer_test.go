@@ -0,0 +1,110 @@
+package awsauth
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSigner(t *testing.T) {
+	Convey("Given signers with different credentials", t, func() {
+		defer test_restoreCredentials()()
+		SetCredentialProviders(&test_provider{credentials: Credentials{AccessKeyID: "AKIDGLOBAL", SecretAccessKey: "global"}})
+
+		first := &test_provider{credentials: Credentials{AccessKeyID: "AKIDFIRST", SecretAccessKey: "first"}}
+		firstSigner := NewSigner(first)
+		secondSigner := NewSigner(nil, WithCredentials(Credentials{AccessKeyID: "AKIDSECOND", SecretAccessKey: "second"}))
+
+		Convey("Each should sign with its own credentials at the same time", func() {
+			var wg sync.WaitGroup
+			requests := make([]*http.Request, 20)
+			for i := range requests {
+				requests[i] = test_plainRequestV4(false)
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					if i%2 == 0 {
+						firstSigner.Sign4(requests[i])
+					} else {
+						secondSigner.Sign4(requests[i])
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			for i, request := range requests {
+				if i%2 == 0 {
+					So(request.Header.Get("Authorization"), ShouldContainSubstring, "Credential=AKIDFIRST/")
+				} else {
+					So(request.Header.Get("Authorization"), ShouldContainSubstring, "Credential=AKIDSECOND/")
+				}
+			}
+		})
+
+		Convey("Their credentials should be retrieved once and kept", func() {
+			firstSigner.Sign4(test_plainRequestV4(false))
+			firstSigner.Sign4(test_plainRequestV4(false))
+			So(first.retrieved, ShouldEqual, 1)
+		})
+
+		Convey("Refreshing should retrieve their credentials again", func() {
+			firstSigner.Sign4(test_plainRequestV4(false))
+			So(firstSigner.RefreshCredentials(), ShouldBeNil)
+			So(first.retrieved, ShouldEqual, 2)
+
+			So(secondSigner.RefreshCredentials(), ShouldBeNil)
+			credentials, _ := secondSigner.Credentials()
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDSECOND")
+		})
+
+		Convey("The package-level credentials should be left alone", func() {
+			firstSigner.Sign4(test_plainRequestV4(false))
+			credentials, _ := CurrentCredentials()
+			So(credentials.AccessKeyID, ShouldEqual, "AKIDGLOBAL")
+		})
+
+		Convey("They should presign URLs with their credentials", func() {
+			url, err := secondSigner.Presign(test_plainRequestV4(false), time.Minute)
+			So(err, ShouldBeNil)
+			So(url, ShouldContainSubstring, "X-Amz-Credential=AKIDSECOND")
+		})
+	})
+
+	Convey("Given a signer fixed to a signature version", t, func() {
+		signer := NewSigner(nil, WithCredentials(*testCredV4), WithVersion(VersionS3))
+
+		Convey("Sign should use that version", func() {
+			request, err := signer.Sign(test_plainRequestV4(false))
+			So(err, ShouldBeNil)
+			So(request.Header.Get("Authorization"), ShouldStartWith, "AWS AKIDEXAMPLE:")
+		})
+	})
+
+	Convey("Given a signer pinned to a region and service", t, func() {
+		signer := NewSigner(nil, WithCredentials(*testCredV4), WithRegion("eu-central-1"), WithService("execute-api"))
+		request, _ := http.NewRequest("GET", "https://vpce-0123.execute-api.vpce.amazonaws.com/orders", nil)
+
+		Convey("Its signatures should be scoped to them", func() {
+			signer.Sign(request)
+			So(request.Header.Get("Authorization"), ShouldContainSubstring, "/eu-central-1/execute-api/aws4_request")
+		})
+
+		Convey("Its presigned URLs should be scoped to them", func() {
+			url, _ := signer.Presign(request, time.Minute)
+			So(url, ShouldContainSubstring, "%2Feu-central-1%2Fexecute-api%2Faws4_request")
+		})
+	})
+
+	Convey("Given a signer whose provider has no credentials", t, func() {
+		signer := NewSigner(&test_provider{})
+
+		Convey("Requests should be left unsigned with the reason", func() {
+			request, err := signer.Sign(test_plainRequestV4(false))
+			So(err, ShouldEqual, ErrNoCredentials)
+			So(request.Header.Get("Authorization"), ShouldBeBlank)
+		})
+	})
+}
@@ -0,0 +1,149 @@
+package awsauth
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SSOProvider provides the credentials of a profile set up for IAM Identity
+// Center (AWS SSO) in the shared config file, using the access token that
+// `aws sso login` caches in ~/.aws/sso/cache. Profiles can name the start URL
+// and region themselves, or refer to an [sso-session name] section for them.
+type SSOProvider struct {
+	// Profile is the profile whose credentials are provided. If empty, the
+	// one named by AWS_PROFILE, or else the default profile, is used.
+	Profile string
+
+	// Client sends the requests to the SSO portal. If nil,
+	// CredentialsClient is used.
+	Client *http.Client
+
+	credentials Credentials
+	sync.RWMutex
+}
+
+func (p *SSOProvider) Retrieve() (Credentials, error) {
+	return p.RetrieveCtx(context.Background())
+}
+
+func (p *SSOProvider) RetrieveCtx(ctx context.Context) (Credentials, error) {
+	profile := p.Profile
+	if profile == "" {
+		profile = selectedProfile()
+	}
+
+	config := sharedFile(envConfigFile, "config")
+	settings := readProfile(config, configSection(profile))
+	if settings["sso_account_id"] == "" || settings["sso_role_name"] == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+
+	// The token is cached under the session name, or else the start URL
+	cacheKey, region := settings["sso_start_url"], settings["sso_region"]
+	if session := settings["sso_session"]; session != "" {
+		cacheKey = session
+		region = readProfile(config, "sso-session "+session)["sso_region"]
+	}
+
+	token, err := cachedSSOToken(cacheKey)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	query := url.Values{}
+	query.Set("account_id", settings["sso_account_id"])
+	query.Set("role_name", settings["sso_role_name"])
+	request, err := http.NewRequestWithContext(ctx, "GET", "https://portal.sso."+region+".amazonaws.com/federation/credentials?"+query.Encode(), nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	request.Header.Set("X-Amz-Sso_bearer_token", token)
+
+	client := p.Client
+	if client == nil {
+		client = CredentialsClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return Credentials{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return Credentials{}, fmt.Errorf("awsauth: GetRoleCredentials returned %s", response.Status)
+	}
+
+	var result struct {
+		RoleCredentials struct {
+			AccessKeyID     string `json:"accessKeyId"`
+			SecretAccessKey string `json:"secretAccessKey"`
+			SessionToken    string `json:"sessionToken"`
+			Expiration      int64  `json:"expiration"`
+		} `json:"roleCredentials"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return Credentials{}, fmt.Errorf("awsauth: cannot decode GetRoleCredentials response: %w", err)
+	}
+
+	credentials := Credentials{
+		AccessKeyID:     result.RoleCredentials.AccessKeyID,
+		SecretAccessKey: result.RoleCredentials.SecretAccessKey,
+		SecurityToken:   result.RoleCredentials.SessionToken,
+		Expiration:      time.UnixMilli(result.RoleCredentials.Expiration).UTC(),
+	}
+
+	p.Lock()
+	p.credentials = credentials
+	p.Unlock()
+	return credentials, nil
+}
+
+func (p *SSOProvider) IsExpired() bool {
+	p.RLock()
+	defer p.RUnlock()
+	return p.credentials.blank() || p.credentials.Expired()
+}
+
+// ssoCacheDir is where `aws sso login` caches access tokens. If empty, it is
+// ~/.aws/sso/cache.
+var ssoCacheDir = ""
+
+// cachedSSOToken returns the access token cached by `aws sso login` for a
+// session name or start URL, in a file named after its SHA-1 hash.
+func cachedSSOToken(key string) (string, error) {
+	dir := ssoCacheDir
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".aws", "sso", "cache")
+	}
+
+	hash := sha1.Sum([]byte(key))
+	contents, err := os.ReadFile(filepath.Join(dir, hex.EncodeToString(hash[:])+".json"))
+	if err != nil {
+		return "", fmt.Errorf("awsauth: no cached SSO token, run aws sso login: %w", err)
+	}
+
+	var cached struct {
+		AccessToken string    `json:"accessToken"`
+		ExpiresAt   time.Time `json:"expiresAt"`
+	}
+	if err := json.Unmarshal(contents, &cached); err != nil {
+		return "", fmt.Errorf("awsauth: cannot decode cached SSO token: %w", err)
+	}
+	if !cached.ExpiresAt.After(now()) {
+		return "", fmt.Errorf("awsauth: cached SSO token expired at %s, run aws sso login", cached.ExpiresAt)
+	}
+	return cached.AccessToken, nil
+}
@@ -0,0 +1,100 @@
+package awsauth
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSSOProvider(t *testing.T) {
+	Convey("Given SSO profiles and a cached access token", t, func() {
+		defer test_mockNowV4("20230101T000000Z")()
+
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "config"), []byte(test_ssoConfigFile), 0600)
+		t.Setenv(envConfigFile, filepath.Join(dir, "config"))
+		t.Setenv(envProfile, "")
+
+		saved := ssoCacheDir
+		ssoCacheDir = dir
+		defer func() { ssoCacheDir = saved }()
+
+		expiresAt := "2023-01-01T08:00:00Z"
+		test_cacheSSOToken := func(key, token string) {
+			hash := sha1.Sum([]byte(key))
+			contents := fmt.Sprintf(`{"accessToken":"%s","expiresAt":"%s","region":"us-east-1","startUrl":"https://example.awsapps.com/start"}`, token, expiresAt)
+			os.WriteFile(filepath.Join(dir, hex.EncodeToString(hash[:])+".json"), []byte(contents), 0600)
+		}
+
+		var request *http.Request
+		client := test_stsClient(func(w http.ResponseWriter, r *http.Request) {
+			request = r
+			fmt.Fprint(w, `{"roleCredentials":{"accessKeyId":"ASIASSO","secretAccessKey":"sso-secret","sessionToken":"sso-token","expiration":1672534800000}}`)
+		})
+
+		Convey("A profile with its own start URL should use the token cached for it", func() {
+			test_cacheSSOToken("https://example.awsapps.com/start", "legacy-token")
+
+			credentials, err := (&SSOProvider{Profile: "legacy", Client: client}).Retrieve()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "ASIASSO")
+			So(credentials.SecurityToken, ShouldEqual, "sso-token")
+			So(credentials.Expiration, ShouldEqual, time.Date(2023, time.January, 1, 1, 0, 0, 0, time.UTC))
+
+			So(request.URL.Host, ShouldEqual, "portal.sso.eu-west-1.amazonaws.com")
+			So(request.URL.Path, ShouldEqual, "/federation/credentials")
+			So(request.URL.Query().Get("account_id"), ShouldEqual, "111122223333")
+			So(request.URL.Query().Get("role_name"), ShouldEqual, "Developer")
+			So(request.Header.Get("X-Amz-Sso_bearer_token"), ShouldEqual, "legacy-token")
+		})
+
+		Convey("A profile with an SSO session should use the token cached for the session", func() {
+			test_cacheSSOToken("my-sso", "session-token")
+
+			_, err := (&SSOProvider{Profile: "session", Client: client}).Retrieve()
+			So(err, ShouldBeNil)
+			So(request.URL.Host, ShouldEqual, "portal.sso.us-west-2.amazonaws.com")
+			So(request.Header.Get("X-Amz-Sso_bearer_token"), ShouldEqual, "session-token")
+		})
+
+		Convey("An expired token should be reported", func() {
+			expiresAt = "2022-12-31T00:00:00Z"
+			test_cacheSSOToken("my-sso", "session-token")
+
+			_, err := (&SSOProvider{Profile: "session", Client: client}).Retrieve()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "aws sso login")
+		})
+
+		Convey("A profile without SSO settings should have no credentials", func() {
+			_, err := (&SSOProvider{Client: client}).Retrieve()
+			So(err, ShouldEqual, ErrNoCredentials)
+		})
+	})
+}
+
+const test_ssoConfigFile = `[default]
+region = us-east-1
+
+[profile legacy]
+sso_start_url = https://example.awsapps.com/start
+sso_region = eu-west-1
+sso_account_id = 111122223333
+sso_role_name = Developer
+
+[profile session]
+sso_session = my-sso
+sso_account_id = 111122223333
+sso_role_name = Developer
+
+[sso-session my-sso]
+sso_start_url = https://example.awsapps.com/start
+sso_region = us-west-2
+`
@@ -0,0 +1,367 @@
+package awsauth
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// STSRegion, if set, makes requests to the Security Token Service go to the
+// endpoint of that region instead of the global sts.amazonaws.com endpoint.
+// Setting the AWS_STS_REGIONAL_ENDPOINTS environment variable to "regional"
+// does the same for the region in AWS_REGION or AWS_DEFAULT_REGION.
+var STSRegion string
+
+// stsEndpoint returns the host that STS requests are sent to. The global
+// endpoint is used unless a regional one was asked for.
+func stsEndpoint() string {
+	region := STSRegion
+	if region == "" && strings.EqualFold(os.Getenv(envSTSRegionalEndpoints), "regional") {
+		region = os.Getenv(envRegion)
+		if region == "" {
+			region = os.Getenv(envDefaultRegion)
+		}
+	}
+
+	if region == "" {
+		return "sts.amazonaws.com"
+	}
+	return "sts." + region + ".amazonaws.com"
+}
+
+// newSTSRequest builds a request for an STS action and signs it with the
+// keys for the region of the endpoint it is sent to.
+func newSTSRequest(action string, params url.Values, keys Credentials) (*http.Request, error) {
+	request, err := unsignedSTSRequest(action, params)
+	if err != nil {
+		return nil, err
+	}
+	return Sign4(request, keys), nil
+}
+
+// unsignedSTSRequest builds a request for an STS action that is sent without
+// a signature, such as AssumeRoleWithWebIdentity.
+func unsignedSTSRequest(action string, params url.Values) (*http.Request, error) {
+	values := url.Values{}
+	for key, value := range params {
+		values[key] = value
+	}
+	values.Set("Action", action)
+	values.Set("Version", stsVersion)
+
+	request, err := http.NewRequest("POST", "https://"+stsEndpoint()+"/", strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	return request, nil
+}
+
+// getSTSCredentials sends a request for an STS action that hands out
+// temporary credentials, and returns them.
+func getSTSCredentials(ctx context.Context, client *http.Client, action string, request *http.Request) (Credentials, error) {
+	if client == nil {
+		client = CredentialsClient
+	}
+	response, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		return Credentials{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		var failure struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		xml.NewDecoder(response.Body).Decode(&failure)
+		return Credentials{}, fmt.Errorf("awsauth: %s returned %s: %s %s", action, response.Status, failure.Code, failure.Message)
+	}
+
+	// The result element is named after the action
+	var result struct {
+		Result struct {
+			AccessKeyID     string    `xml:"Credentials>AccessKeyId"`
+			SecretAccessKey string    `xml:"Credentials>SecretAccessKey"`
+			SessionToken    string    `xml:"Credentials>SessionToken"`
+			Expiration      time.Time `xml:"Credentials>Expiration"`
+		} `xml:",any"`
+	}
+	if err := xml.NewDecoder(response.Body).Decode(&result); err != nil {
+		return Credentials{}, fmt.Errorf("awsauth: cannot decode %s response: %w", action, err)
+	}
+
+	return Credentials{
+		AccessKeyID:     result.Result.AccessKeyID,
+		SecretAccessKey: result.Result.SecretAccessKey,
+		SecurityToken:   result.Result.SessionToken,
+		Expiration:      result.Result.Expiration,
+	}, nil
+}
+
+// AssumeRoleProvider provides temporary credentials for a role, assumed with
+// the STS AssumeRole action. The credentials are kept until shortly before
+// they expire, when the role is assumed again.
+type AssumeRoleProvider struct {
+	// RoleARN is the role to assume.
+	RoleARN string
+
+	// RoleSessionName identifies the session in CloudTrail. If empty, one
+	// is made up.
+	RoleSessionName string
+
+	// ExternalID, if set, is passed on to satisfy the role's trust policy.
+	ExternalID string
+
+	// Duration is how long the credentials are valid for. If zero, STS
+	// decides, which is usually an hour.
+	Duration time.Duration
+
+	// Source provides the credentials the role is assumed with. If nil,
+	// they are looked up with the default providers, the way they are
+	// when signing without credentials.
+	Source CredentialProvider
+
+	// Client sends the requests to STS. If nil, CredentialsClient is used.
+	Client *http.Client
+
+	credentials Credentials
+	sync.RWMutex
+}
+
+func (p *AssumeRoleProvider) Retrieve() (Credentials, error) {
+	return p.RetrieveCtx(context.Background())
+}
+
+func (p *AssumeRoleProvider) RetrieveCtx(ctx context.Context) (Credentials, error) {
+	keys, err := sourceCredentials(ctx, p.Source)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	params := url.Values{}
+	params.Set("RoleArn", p.RoleARN)
+	params.Set("RoleSessionName", sessionName(p.RoleSessionName))
+	if p.ExternalID != "" {
+		params.Set("ExternalId", p.ExternalID)
+	}
+	if p.Duration > 0 {
+		params.Set("DurationSeconds", strconv.Itoa(int(p.Duration/time.Second)))
+	}
+
+	request, err := newSTSRequest("AssumeRole", params, keys)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	credentials, err := getSTSCredentials(ctx, p.Client, "AssumeRole", request)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	p.Lock()
+	p.credentials = credentials
+	p.Unlock()
+	return credentials, nil
+}
+
+func (p *AssumeRoleProvider) IsExpired() bool {
+	p.RLock()
+	defer p.RUnlock()
+	return p.credentials.blank() || p.credentials.Expired()
+}
+
+// sourceCredentials returns the credentials STS is called with, from source
+// or else the default providers. They are not taken from the credentials
+// store, which the calling provider may be part of.
+func sourceCredentials(ctx context.Context, source CredentialProvider) (Credentials, error) {
+	if source != nil {
+		return retrieveCtx(ctx, source)
+	}
+
+	for _, provider := range defaultProviders() {
+		keys, err := retrieveCtx(ctx, provider)
+		if err == nil && !keys.blank() {
+			return keys, nil
+		}
+		if err != nil && err != ErrNoCredentials {
+			return Credentials{}, err
+		}
+	}
+	return Credentials{}, ErrNoCredentials
+}
+
+// WebIdentityProvider provides temporary credentials for a role, assumed with
+// the STS AssumeRoleWithWebIdentity action in exchange for an OpenID Connect
+// token, as pods on EKS do with IAM roles for service accounts. The token is
+// read again from its file, which is rotated, whenever the credentials are
+// about to expire. It is part of the default providers, configured by the
+// AWS_ROLE_ARN, AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_SESSION_NAME
+// environment variables.
+type WebIdentityProvider struct {
+	// RoleARN is the role to assume. If empty, AWS_ROLE_ARN is used.
+	RoleARN string
+
+	// TokenFile holds the web identity token. If empty,
+	// AWS_WEB_IDENTITY_TOKEN_FILE is used.
+	TokenFile string
+
+	// RoleSessionName identifies the session in CloudTrail. If empty,
+	// AWS_ROLE_SESSION_NAME is used, or else one is made up.
+	RoleSessionName string
+
+	// Client sends the requests to STS. If nil, CredentialsClient is used.
+	Client *http.Client
+
+	credentials Credentials
+	sync.RWMutex
+}
+
+func (p *WebIdentityProvider) Retrieve() (Credentials, error) {
+	return p.RetrieveCtx(context.Background())
+}
+
+func (p *WebIdentityProvider) RetrieveCtx(ctx context.Context) (Credentials, error) {
+	roleARN, tokenFile, session := p.RoleARN, p.TokenFile, p.RoleSessionName
+	if roleARN == "" {
+		roleARN = os.Getenv(envRoleARN)
+	}
+	if tokenFile == "" {
+		tokenFile = os.Getenv(envWebIdentityTokenFile)
+	}
+	if session == "" {
+		session = os.Getenv(envRoleSessionName)
+	}
+	if roleARN == "" || tokenFile == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("awsauth: cannot read web identity token: %w", err)
+	}
+
+	params := url.Values{}
+	params.Set("RoleArn", roleARN)
+	params.Set("RoleSessionName", sessionName(session))
+	params.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+
+	request, err := unsignedSTSRequest("AssumeRoleWithWebIdentity", params)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	credentials, err := getSTSCredentials(ctx, p.Client, "AssumeRoleWithWebIdentity", request)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	p.Lock()
+	p.credentials = credentials
+	p.Unlock()
+	return credentials, nil
+}
+
+func (p *WebIdentityProvider) IsExpired() bool {
+	p.RLock()
+	defer p.RUnlock()
+	return p.credentials.blank() || p.credentials.Expired()
+}
+
+// FederationTokenProvider provides temporary credentials for a federated
+// user, got with the STS GetFederationToken action. Their permissions are
+// those of the source credentials scoped down by an inline session policy,
+// which makes them suited to handing out to worker processes that should
+// only reach part of what the caller can. The source credentials must be the
+// long-term ones of an IAM user, or those of the account's root user; STS
+// refuses temporary ones.
+type FederationTokenProvider struct {
+	// Name is the name of the federated user, shown in CloudTrail. If
+	// empty, one is made up.
+	Name string
+
+	// Policy is the inline session policy, a JSON IAM policy document. The
+	// credentials are allowed only what both it and the source credentials
+	// allow.
+	Policy string
+
+	// PolicyARNs name managed policies to scope the credentials down with
+	// as well.
+	PolicyARNs []string
+
+	// Duration is how long the credentials are valid for. If zero, STS
+	// decides, which is usually 12 hours.
+	Duration time.Duration
+
+	// Source provides the credentials the token is got with. If nil, they
+	// are looked up with the default providers.
+	Source CredentialProvider
+
+	// Client sends the requests to STS. If nil, CredentialsClient is used.
+	Client *http.Client
+
+	credentials Credentials
+	sync.RWMutex
+}
+
+func (p *FederationTokenProvider) Retrieve() (Credentials, error) {
+	return p.RetrieveCtx(context.Background())
+}
+
+func (p *FederationTokenProvider) RetrieveCtx(ctx context.Context) (Credentials, error) {
+	keys, err := sourceCredentials(ctx, p.Source)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	params := url.Values{}
+	params.Set("Name", sessionName(p.Name))
+	if p.Policy != "" {
+		params.Set("Policy", p.Policy)
+	}
+	for i, arn := range p.PolicyARNs {
+		params.Set("PolicyArns.member."+strconv.Itoa(i+1)+".arn", arn)
+	}
+	if p.Duration > 0 {
+		params.Set("DurationSeconds", strconv.Itoa(int(p.Duration/time.Second)))
+	}
+
+	request, err := newSTSRequest("GetFederationToken", params, keys)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	credentials, err := getSTSCredentials(ctx, p.Client, "GetFederationToken", request)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	p.Lock()
+	p.credentials = credentials
+	p.Unlock()
+	return credentials, nil
+}
+
+func (p *FederationTokenProvider) IsExpired() bool {
+	p.RLock()
+	defer p.RUnlock()
+	return p.credentials.blank() || p.credentials.Expired()
+}
+
+// sessionName returns the given role session name, or makes one up.
+func sessionName(name string) string {
+	if name != "" {
+		return name
+	}
+	return "awsauth-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+const stsVersion = "2011-06-15"
@@ -0,0 +1,291 @@
+package awsauth
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSTSEndpoint(t *testing.T) {
+	Convey("By default STS requests should go to the global endpoint", t, func() {
+		t.Setenv(envSTSRegionalEndpoints, "")
+
+		request, err := newSTSRequest("GetCallerIdentity", nil, *testCredV4)
+		So(err, ShouldBeNil)
+		So(request.URL.Host, ShouldEqual, "sts.amazonaws.com")
+		So(request.Header.Get("Authorization"), ShouldContainSubstring, "/us-east-1/sts/aws4_request")
+	})
+
+	Convey("Given regional STS endpoints are asked for in the environment", t, func() {
+		t.Setenv(envSTSRegionalEndpoints, "regional")
+		t.Setenv(envRegion, "ap-southeast-2")
+
+		Convey("STS requests should be sent to and signed for that region", func() {
+			request, err := newSTSRequest("GetCallerIdentity", nil, *testCredV4)
+			So(err, ShouldBeNil)
+			So(request.URL.Host, ShouldEqual, "sts.ap-southeast-2.amazonaws.com")
+			So(request.Header.Get("Authorization"), ShouldContainSubstring, "/ap-southeast-2/sts/aws4_request")
+		})
+	})
+
+	Convey("Given an explicit STS region", t, func() {
+		STSRegion = "eu-west-1"
+		defer func() { STSRegion = "" }()
+
+		Convey("STS requests should be sent to and signed for that region", func() {
+			request, err := newSTSRequest("AssumeRole", url.Values{"RoleArn": {"arn:aws:iam::123456789012:role/demo"}}, *testCredV4)
+			So(err, ShouldBeNil)
+			So(request.URL.Host, ShouldEqual, "sts.eu-west-1.amazonaws.com")
+			So(request.Header.Get("Authorization"), ShouldContainSubstring, "/eu-west-1/sts/aws4_request")
+		})
+	})
+}
+
+func TestAssumeRoleProvider(t *testing.T) {
+	Convey("Given a role that can be assumed", t, func() {
+		defer test_mockNowV4("20230101T000000Z")()
+
+		var form url.Values
+		calls := 0
+		expiration := "2023-01-01T01:00:00.000Z"
+		client := test_stsClient(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			r.ParseForm()
+			form = r.PostForm
+			fmt.Fprintf(w, test_assumeRoleResponse, calls, expiration)
+		})
+
+		provider := &AssumeRoleProvider{
+			RoleARN:         "arn:aws:iam::123456789012:role/demo",
+			RoleSessionName: "session",
+			ExternalID:      "external",
+			Duration:        15 * time.Minute,
+			Source:          EnvProvider{},
+			Client:          client,
+		}
+		t.Setenv(envAccessKeyID, "AKIDSOURCE")
+		t.Setenv(envSecretAccessKey, "source-secret")
+
+		Convey("Its temporary credentials should be provided", func() {
+			credentials, err := provider.Retrieve()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "ASIAROLE1")
+			So(credentials.SecretAccessKey, ShouldEqual, "role-secret")
+			So(credentials.SecurityToken, ShouldEqual, "role-token")
+			So(credentials.Expiration, ShouldEqual, time.Date(2023, time.January, 1, 1, 0, 0, 0, time.UTC))
+		})
+
+		Convey("It should be assumed with the given parameters", func() {
+			provider.Retrieve()
+			So(form.Get("Action"), ShouldEqual, "AssumeRole")
+			So(form.Get("RoleArn"), ShouldEqual, "arn:aws:iam::123456789012:role/demo")
+			So(form.Get("RoleSessionName"), ShouldEqual, "session")
+			So(form.Get("ExternalId"), ShouldEqual, "external")
+			So(form.Get("DurationSeconds"), ShouldEqual, "900")
+		})
+
+		Convey("Requests should be signed with its credentials until they are about to expire", func() {
+			defer test_restoreCredentials()()
+			SetCredentialProviders(provider)
+
+			request := Sign4(test_plainRequestV4(true))
+			So(request.Header.Get("Authorization"), ShouldContainSubstring, "Credential=ASIAROLE1/")
+			So(request.Header.Get("X-Amz-Security-Token"), ShouldEqual, "role-token")
+
+			Sign4(test_plainRequestV4(true))
+			So(calls, ShouldEqual, 1)
+
+			expiration = "2023-01-01T02:00:00Z"
+			now = func() time.Time { return time.Date(2023, time.January, 1, 0, 57, 0, 0, time.UTC) }
+
+			request = Sign4(test_plainRequestV4(true))
+			So(request.Header.Get("Authorization"), ShouldContainSubstring, "Credential=ASIAROLE2/")
+			So(calls, ShouldEqual, 2)
+		})
+	})
+
+	Convey("Given a role that cannot be assumed", t, func() {
+		client := test_stsClient(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<ErrorResponse><Error><Code>AccessDenied</Code><Message>Not authorized</Message></Error></ErrorResponse>`)
+		})
+		provider := &AssumeRoleProvider{RoleARN: "arn:aws:iam::123456789012:role/demo", Source: &test_provider{credentials: *testCredV4}, Client: client}
+
+		Convey("The error from STS should be reported", func() {
+			_, err := provider.Retrieve()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "AccessDenied")
+			So(provider.IsExpired(), ShouldBeTrue)
+		})
+	})
+}
+
+func TestWebIdentityProvider(t *testing.T) {
+	Convey("Given a web identity token and role in the environment", t, func() {
+		defer test_restoreCredentials()()
+		tokenFile := filepath.Join(t.TempDir(), "token")
+		os.WriteFile(tokenFile, []byte("oidc-token\n"), 0600)
+
+		t.Setenv(envAccessKeyID, "")
+		t.Setenv(envAccessKey, "")
+		t.Setenv(envSharedCredentialsFile, filepath.Join(t.TempDir(), "credentials"))
+		t.Setenv(envConfigFile, filepath.Join(t.TempDir(), "config"))
+		t.Setenv(envRoleARN, "arn:aws:iam::123456789012:role/pod")
+		t.Setenv(envWebIdentityTokenFile, tokenFile)
+		t.Setenv(envRoleSessionName, "pod-session")
+
+		var request *http.Request
+		var form url.Values
+		client := test_stsClient(func(w http.ResponseWriter, r *http.Request) {
+			request = r
+			r.ParseForm()
+			form = r.PostForm
+			fmt.Fprint(w, test_webIdentityResponse)
+		})
+
+		Convey("The token should be exchanged for the role's credentials", func() {
+			credentials, err := (&WebIdentityProvider{Client: client}).Retrieve()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "ASIAPOD")
+			So(credentials.SecurityToken, ShouldEqual, "pod-token")
+
+			So(form.Get("Action"), ShouldEqual, "AssumeRoleWithWebIdentity")
+			So(form.Get("RoleArn"), ShouldEqual, "arn:aws:iam::123456789012:role/pod")
+			So(form.Get("RoleSessionName"), ShouldEqual, "pod-session")
+			So(form.Get("WebIdentityToken"), ShouldEqual, "oidc-token")
+		})
+
+		Convey("The exchange should not be signed", func() {
+			(&WebIdentityProvider{Client: client}).Retrieve()
+			So(request.Header.Get("Authorization"), ShouldBeBlank)
+		})
+
+		Convey("It should be part of the default providers", func() {
+			saved := CredentialsClient
+			CredentialsClient = client
+			defer func() { CredentialsClient = saved }()
+			SetCredentialProviders()
+
+			credentials, err := CurrentCredentials()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "ASIAPOD")
+		})
+	})
+
+	Convey("Given no web identity in the environment", t, func() {
+		t.Setenv(envRoleARN, "")
+		t.Setenv(envWebIdentityTokenFile, "")
+
+		Convey("There should be no credentials", func() {
+			_, err := (&WebIdentityProvider{}).Retrieve()
+			So(err, ShouldEqual, ErrNoCredentials)
+		})
+	})
+}
+
+func TestFederationTokenProvider(t *testing.T) {
+	Convey("Given an IAM user that can get federation tokens", t, func() {
+		var request *http.Request
+		var form url.Values
+		client := test_stsClient(func(w http.ResponseWriter, r *http.Request) {
+			request = r
+			r.ParseForm()
+			form = r.PostForm
+			fmt.Fprint(w, test_federationTokenResponse)
+		})
+
+		provider := &FederationTokenProvider{
+			Name:       "worker",
+			Policy:     `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:GetObject","Resource":"arn:aws:s3:::examplebucket/*"}]}`,
+			PolicyARNs: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"},
+			Duration:   time.Hour,
+			Source:     &test_provider{credentials: *testCredV4},
+			Client:     client,
+		}
+
+		Convey("Its scoped-down credentials should be provided", func() {
+			credentials, err := provider.Retrieve()
+			So(err, ShouldBeNil)
+			So(credentials.AccessKeyID, ShouldEqual, "ASIAFEDERATED")
+			So(credentials.SecurityToken, ShouldEqual, "federated-token")
+			So(credentials.Expiration, ShouldEqual, time.Date(2100, time.January, 1, 0, 0, 0, 0, time.UTC))
+			So(provider.IsExpired(), ShouldBeFalse)
+		})
+
+		Convey("The token should be got with the policy, signed by the user", func() {
+			provider.Retrieve()
+			So(form.Get("Action"), ShouldEqual, "GetFederationToken")
+			So(form.Get("Name"), ShouldEqual, "worker")
+			So(form.Get("Policy"), ShouldEqual, provider.Policy)
+			So(form.Get("PolicyArns.member.1.arn"), ShouldEqual, "arn:aws:iam::aws:policy/ReadOnlyAccess")
+			So(form.Get("DurationSeconds"), ShouldEqual, "3600")
+			So(request.Header.Get("Authorization"), ShouldContainSubstring, "Credential=AKIDEXAMPLE/")
+		})
+
+		Convey("Signers should sign with its credentials", func() {
+			signed, err := NewSigner(provider).Sign4(test_plainRequestV4(true))
+			So(err, ShouldBeNil)
+			So(signed.Header.Get("Authorization"), ShouldContainSubstring, "Credential=ASIAFEDERATED/")
+			So(signed.Header.Get("X-Amz-Security-Token"), ShouldEqual, "federated-token")
+		})
+	})
+}
+
+// test_stsClient returns a client that serves every request with the handler.
+func test_stsClient(handler http.HandlerFunc) *http.Client {
+	return &http.Client{Transport: test_roundTripper(func(r *http.Request) (*http.Response, error) {
+		recorder := httptest.NewRecorder()
+		handler(recorder, r)
+		return recorder.Result(), nil
+	})}
+}
+
+type test_roundTripper func(*http.Request) (*http.Response, error)
+
+func (f test_roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+const test_assumeRoleResponse = `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASIAROLE%d</AccessKeyId>
+      <SecretAccessKey>role-secret</SecretAccessKey>
+      <SessionToken>role-token</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`
+
+const test_webIdentityResponse = `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>ASIAPOD</AccessKeyId>
+      <SecretAccessKey>pod-secret</SecretAccessKey>
+      <SessionToken>pod-token</SessionToken>
+      <Expiration>2100-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`
+
+const test_federationTokenResponse = `<GetFederationTokenResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <GetFederationTokenResult>
+    <Credentials>
+      <AccessKeyId>ASIAFEDERATED</AccessKeyId>
+      <SecretAccessKey>federated-secret</SecretAccessKey>
+      <SessionToken>federated-token</SessionToken>
+      <Expiration>2100-01-01T00:00:00Z</Expiration>
+    </Credentials>
+    <FederatedUser>
+      <Arn>arn:aws:sts::123456789012:federated-user/worker</Arn>
+      <FederatedUserId>123456789012:worker</FederatedUserId>
+    </FederatedUser>
+  </GetFederationTokenResult>
+</GetFederationTokenResponse>`
@@ -0,0 +1,353 @@
+package awsauth
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// SigningTransport is an http.RoundTripper that signs every outgoing request
+// before handing it to the base transport. Use it, or one made with
+// NewTransport, as the Transport of an http.Client to sign all AWS traffic:
+//
+//	client := &http.Client{Transport: &awsauth.SigningTransport{}}
+type SigningTransport struct {
+	// clockOffset is how far ahead of the local clock AWS's is, in
+	// nanoseconds, accessed atomically. It comes first to be 64-bit aligned
+	// on 32-bit platforms.
+	clockOffset int64
+
+	// Base is the transport that sends the signed requests.
+	// If nil, http.DefaultTransport is used.
+	Base http.RoundTripper
+
+	// Credentials, if set, are used to sign every request not carrying
+	// credentials of its own in its context (see ContextWithCredentials).
+	// Otherwise credentials are looked up the same way the Sign functions do.
+	Credentials *Credentials
+
+	// Version is the signature version requests are signed with, one of
+	// Version2, Version3, Version4 or VersionS3. If zero, Version 4 is used.
+	Version int
+
+	// Region and Service, if set, are the region and service requests are
+	// signed for with Version 4, rather than the ones named by their host.
+	// Set them for hosts they can't be read from, such as VPC endpoints,
+	// API Gateway custom domains and reverse proxies.
+	Region  string
+	Service string
+
+	// SignedHeaders names headers to sign with Version 4 besides the ones
+	// signed automatically (Host, Content-Type, Content-MD5 and X-Amz-*),
+	// and UnsignedHeaders names ones not to sign, such as headers a proxy
+	// rewrites. Host and X-Amz-Date are always signed.
+	SignedHeaders   []string
+	UnsignedHeaders []string
+
+	// PayloadHash, if set, is signed with Version 4 in place of the hash of
+	// the body of each request, which is then left unread, such as
+	// UNSIGNED-PAYLOAD. URLs are presigned with it instead of the payload
+	// hash the service is presigned with by default.
+	PayloadHash string
+
+	// CorrectClockSkew makes the transport learn how far the local clock is
+	// from AWS's when a request is refused for being signed at the wrong
+	// time, from the Date header of the response, and send the request
+	// again signed at AWS's time. Later requests are signed at AWS's time
+	// too. Only Version 4 signatures are corrected.
+	CorrectClockSkew bool
+
+	// DisablePathNormalization makes Version 4 signatures cover the paths of
+	// requests as they are, rather than with empty and dot segments removed.
+	// Set it for services that, like S3, take paths literally; S3 itself
+	// is recognized without it.
+	DisablePathNormalization bool
+
+	// DisableDoubleEncoding makes Version 4 signatures cover the paths of
+	// requests encoded once, rather than the paths as sent encoded again.
+	// Set it for services that, like S3, expect that; S3 itself is
+	// recognized without it.
+	DisableDoubleEncoding bool
+
+	// DisablePathEscaping makes Version 4 signatures cover the paths of
+	// requests exactly as they are sent, from URL.EscapedPath or
+	// URL.Opaque, without encoding them. Set it when paths are already
+	// encoded the way the service expects, such as S3 keys encoded by hand.
+	DisablePathEscaping bool
+
+	// Logger, if set, receives the log messages about the requests the
+	// transport signs, instead of DefaultLogger.
+	Logger Logger
+
+	// refreshWindow is the refresh window of the credentials of signers, set
+	// by WithRefreshWindow: zero for the default, negative for none.
+	refreshWindow time.Duration
+
+	// auto makes each request be signed with the version Sign would choose
+	// for its service, unless Version is set.
+	auto bool
+}
+
+// Option configures a transport made by NewTransport, a signer made by
+// NewSigner, or a single signature made by SignWithOptions or
+// PresignURL4WithOptions.
+type Option func(*SigningTransport)
+
+// applyOptions returns the settings the options make.
+func applyOptions(opts []Option) *SigningTransport {
+	settings := new(SigningTransport)
+	for _, opt := range opts {
+		opt(settings)
+	}
+	return settings
+}
+
+// WithCredentials makes the transport sign every request with the given
+// credentials instead of looking them up.
+func WithCredentials(credentials Credentials) Option {
+	return func(t *SigningTransport) {
+		t.Credentials = &credentials
+	}
+}
+
+// WithVersion makes the transport sign every request with the given signature
+// version instead of the one chosen for its service.
+func WithVersion(version int) Option {
+	return func(t *SigningTransport) {
+		t.Version = version
+	}
+}
+
+// WithRegion makes requests be signed for the given region instead of the one
+// named by their host.
+func WithRegion(region string) Option {
+	return func(t *SigningTransport) {
+		t.Region = region
+	}
+}
+
+// WithService makes requests be signed for the given service instead of the
+// one named by their host.
+func WithService(service string) Option {
+	return func(t *SigningTransport) {
+		t.Service = service
+	}
+}
+
+// WithSignedHeaders makes the named headers be signed, along with the ones
+// that are signed automatically, when requests have them.
+func WithSignedHeaders(headers ...string) Option {
+	return func(t *SigningTransport) {
+		t.SignedHeaders = append(t.SignedHeaders, headers...)
+	}
+}
+
+// WithUnsignedHeaders keeps the named headers from being signed.
+func WithUnsignedHeaders(headers ...string) Option {
+	return func(t *SigningTransport) {
+		t.UnsignedHeaders = append(t.UnsignedHeaders, headers...)
+	}
+}
+
+// WithPayloadHash makes requests be signed, or URLs presigned, with the given
+// payload hash; see PayloadHash.
+func WithPayloadHash(payloadHash string) Option {
+	return func(t *SigningTransport) {
+		t.PayloadHash = payloadHash
+	}
+}
+
+// WithClockSkewCorrection makes the transport correct for a local clock that
+// is out of step with AWS's; see CorrectClockSkew.
+func WithClockSkewCorrection() Option {
+	return func(t *SigningTransport) {
+		t.CorrectClockSkew = true
+	}
+}
+
+// WithoutPathNormalization makes the transport sign paths as they are; see
+// DisablePathNormalization.
+func WithoutPathNormalization() Option {
+	return func(t *SigningTransport) {
+		t.DisablePathNormalization = true
+	}
+}
+
+// WithoutDoubleEncoding makes the transport sign paths encoded once; see
+// DisableDoubleEncoding.
+func WithoutDoubleEncoding() Option {
+	return func(t *SigningTransport) {
+		t.DisableDoubleEncoding = true
+	}
+}
+
+// WithoutPathEscaping makes the transport sign paths exactly as they are
+// sent; see DisablePathEscaping.
+func WithoutPathEscaping() Option {
+	return func(t *SigningTransport) {
+		t.DisablePathEscaping = true
+	}
+}
+
+// WithRefreshWindow makes a signer refresh its credentials in the background
+// once they are within window of expiring, instead of 15 minutes; zero or
+// less turns that off. Transports sign with the package's credentials, whose
+// window SetCredentialsRefreshWindow sets.
+func WithRefreshWindow(window time.Duration) Option {
+	return func(t *SigningTransport) {
+		if window <= 0 {
+			window = -1
+		}
+		t.refreshWindow = window
+	}
+}
+
+// WithLogger makes the transport, or signer, log to l instead of
+// DefaultLogger.
+func WithLogger(l Logger) Option {
+	return func(t *SigningTransport) {
+		t.Logger = l
+	}
+}
+
+// NewTransport returns a transport that signs every request and sends it with
+// base, or http.DefaultTransport if base is nil. Like Sign, it signs each
+// request with the signature version the service it is going to expects,
+// unless told otherwise by an option. Requests are signed as copies, with
+// their bodies buffered so that the originals can be sent again.
+func NewTransport(base http.RoundTripper, opts ...Option) http.RoundTripper {
+	t := &SigningTransport{Base: base, auto: true}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// RoundTrip signs a copy of the request and sends it with the base transport.
+// The caller's request is left untouched so it can safely be reused.
+func (t *SigningTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	// Sign copies of a copy, so that a body that can't be rewound is
+	// buffered on the copy rather than swapped on the caller's request
+	outgoing := request.Clone(request.Context())
+	signed, err := t.sign(outgoing)
+	if request.Body != nil {
+		request.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := t.base().RoundTrip(signed)
+	if err != nil || !t.CorrectClockSkew || !clockSkewed(response) {
+		return response, err
+	}
+	serverTime, err := http.ParseTime(response.Header.Get("Date"))
+	if err != nil {
+		return response, nil
+	}
+
+	// Sign again at AWS's time
+	atomic.StoreInt64(&t.clockOffset, int64(serverTime.Sub(now())))
+	if signed, err = t.sign(outgoing); err != nil {
+		return response, nil
+	}
+	response.Body.Close()
+	return t.base().RoundTrip(signed)
+}
+
+// clockSkewed reports whether a request was refused for having been signed at
+// a time too far from AWS's. The body of the response is left readable.
+func clockSkewed(response *http.Response) bool {
+	if response.StatusCode != http.StatusForbidden && response.StatusCode != http.StatusBadRequest {
+		return false
+	}
+
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	return bytes.Contains(body, []byte("RequestTimeTooSkewed")) || bytes.Contains(body, []byte("Signature expired"))
+}
+
+// sign returns a signed copy of the request, or the reason no credentials
+// could be found to sign it with.
+func (t *SigningTransport) sign(request *http.Request) (*http.Request, error) {
+	meta := t.meta()
+	version := t.Version
+	if version == 0 && t.auto {
+		version = signVersion(requestScope(request, meta))
+	}
+	if version == 0 {
+		version = Version4
+	}
+
+	keys, err := t.keys(request, version, meta)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := cloneRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	if signWithMeta(signed, version, meta, []Credentials{keys}) == nil {
+		return nil, fmt.Errorf("awsauth: unknown signature version %d", version)
+	}
+	return signed, nil
+}
+
+// RefreshCredentials retrieves the credentials the transport signs a request
+// with again, when it signs with the current credentials. Credentials of its
+// own, attached to the request's context or picked by CredentialsForRequest
+// are left alone.
+func (t *SigningTransport) RefreshCredentials(request *http.Request) error {
+	if t.Credentials != nil {
+		return nil
+	}
+	if _, ok := CredentialsFromContext(request.Context()); ok {
+		return nil
+	}
+	version := t.Version
+	if version == 0 && t.auto {
+		version = signVersion(requestScope(request, t.meta()))
+	}
+	if (version == 0 || version == Version4) && CredentialsForRequest != nil {
+		return nil
+	}
+	return gCredentialsStore.RefreshCtx(request.Context())
+}
+
+// keys returns the credentials to sign a request with: the transport's own,
+// or else those attached to its context, or else those looked up for it.
+func (t *SigningTransport) keys(request *http.Request, version int, meta *metadata) (Credentials, error) {
+	if t.Credentials != nil {
+		return *t.Credentials, nil
+	}
+	if keys, ok := CredentialsFromContext(request.Context()); ok {
+		return keys, nil
+	}
+	service, region := requestScope(request, meta)
+	return lookupCredentials(request.Context(), request, version, service, region)
+}
+
+// meta returns the signing metadata for the transport's settings.
+func (t *SigningTransport) meta() *metadata {
+	meta := new(metadata)
+	meta.region, meta.service = t.Region, t.Service
+	meta.includeHeaders, meta.excludeHeaders = t.SignedHeaders, t.UnsignedHeaders
+	meta.payloadHash = t.PayloadHash
+	meta.clockOffset = time.Duration(atomic.LoadInt64(&t.clockOffset))
+	meta.rawPath = t.DisablePathNormalization
+	meta.singleEncode = t.DisableDoubleEncoding
+	meta.escapedPath = t.DisablePathEscaping
+	meta.logger = t.Logger
+	return meta
+}
+
+func (t *SigningTransport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
@@ -0,0 +1,341 @@
+package awsauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSigningTransport(t *testing.T) {
+	Convey("Given a signing transport with explicit credentials", t, func() {
+		base := &recordingTransport{}
+		transport := &SigningTransport{Base: base, Credentials: testCredV4}
+
+		Convey("And a request with a body", func() {
+			request := test_plainRequestV4(true)
+
+			_, err := transport.RoundTrip(request)
+			So(err, ShouldBeNil)
+
+			Convey("The request that is sent should be signed", func() {
+				So(base.request.Header.Get("Authorization"), ShouldContainSubstring, "Credential="+testCredV4.AccessKeyID)
+				So(base.request.Header.Get("X-Amz-Date"), ShouldNotBeBlank)
+			})
+
+			Convey("The request that is sent should carry the whole body", func() {
+				So(base.body, ShouldEqual, requestValuesV4.Encode())
+			})
+
+			Convey("The caller's request should not be modified", func() {
+				So(request.Header.Get("Authorization"), ShouldBeBlank)
+				So(request.Header.Get("X-Amz-Date"), ShouldBeBlank)
+			})
+
+			Convey("The caller's request should still be replayable", func() {
+				body, err := request.GetBody()
+				So(err, ShouldBeNil)
+				payload, _ := ioutil.ReadAll(body)
+				So(string(payload), ShouldEqual, requestValuesV4.Encode())
+			})
+		})
+
+		Convey("And a request whose body cannot be rewound", func() {
+			request, _ := http.NewRequest("PUT", "https://s3.amazonaws.com/bucket/key", ioutil.NopCloser(strings.NewReader("payload")))
+
+			_, err := transport.RoundTrip(request)
+			So(err, ShouldBeNil)
+
+			Convey("The request that is sent should carry the whole body", func() {
+				So(base.body, ShouldEqual, "payload")
+			})
+
+			Convey("The payload hash should be signed", func() {
+				So(base.request.Header.Get("X-Amz-Content-Sha256"), ShouldEqual, hashSHA256([]byte("payload")))
+			})
+
+			Convey("The caller's request should keep its own body", func() {
+				So(request.GetBody, ShouldBeNil)
+				So(request.Header.Get("X-Amz-Content-Sha256"), ShouldBeBlank)
+			})
+		})
+	})
+}
+
+func TestNewTransport(t *testing.T) {
+	Convey("Given a transport made with NewTransport", t, func() {
+		base := &recordingTransport{}
+		transport := NewTransport(base, WithCredentials(*testCredV4))
+
+		Convey("Requests should be signed with the version their service expects", func() {
+			ec2, _ := http.NewRequest("GET", "https://ec2.us-west-2.amazonaws.com/?Action=DescribeInstances", nil)
+			_, err := transport.RoundTrip(ec2)
+			So(err, ShouldBeNil)
+			So(base.request.URL.Query().Get("SignatureVersion"), ShouldEqual, "2")
+			So(base.request.URL.Query().Get("AWSAccessKeyId"), ShouldEqual, testCredV4.AccessKeyID)
+
+			sqs, _ := http.NewRequest("GET", "https://sqs.us-west-2.amazonaws.com/", nil)
+			_, err = transport.RoundTrip(sqs)
+			So(err, ShouldBeNil)
+			So(base.request.Header.Get("Authorization"), ShouldStartWith, "AWS4-HMAC-SHA256 Credential="+testCredV4.AccessKeyID+"/")
+		})
+
+		Convey("The caller's request should not be modified", func() {
+			ec2, _ := http.NewRequest("GET", "https://ec2.us-west-2.amazonaws.com/?Action=DescribeInstances", nil)
+			transport.RoundTrip(ec2)
+			So(ec2.URL.RawQuery, ShouldEqual, "Action=DescribeInstances")
+		})
+
+		Convey("Bodies should be buffered so the caller's request can be sent again", func() {
+			request := test_plainRequestV4(true)
+			_, err := transport.RoundTrip(request)
+			So(err, ShouldBeNil)
+			So(base.body, ShouldEqual, requestValuesV4.Encode())
+
+			body, _ := request.GetBody()
+			payload, _ := ioutil.ReadAll(body)
+			So(string(payload), ShouldEqual, requestValuesV4.Encode())
+		})
+	})
+
+	Convey("Given a transport made with a fixed version", t, func() {
+		base := &recordingTransport{}
+		transport := NewTransport(base, WithCredentials(*testCredV4), WithVersion(Version4))
+
+		Convey("Every request should be signed with that version", func() {
+			ec2, _ := http.NewRequest("GET", "https://ec2.us-west-2.amazonaws.com/?Action=DescribeInstances", nil)
+			_, err := transport.RoundTrip(ec2)
+			So(err, ShouldBeNil)
+			So(base.request.Header.Get("Authorization"), ShouldStartWith, "AWS4-HMAC-SHA256")
+		})
+	})
+
+	Convey("Given a transport pinned to a region and service", t, func() {
+		base := &recordingTransport{}
+		transport := NewTransport(base, WithCredentials(*testCredV4), WithRegion("eu-central-1"), WithService("execute-api"))
+
+		Convey("Requests to hosts that don't name them should be signed for them", func() {
+			request, _ := http.NewRequest("GET", "https://api.example.com/orders", nil)
+			_, err := transport.RoundTrip(request)
+			So(err, ShouldBeNil)
+			So(base.request.Header.Get("Authorization"), ShouldContainSubstring, "/eu-central-1/execute-api/aws4_request")
+		})
+
+		Convey("Requests to a custom domain should be signed for its host and path", func() {
+			request, _ := http.NewRequest("GET", "https://api.example.com/v1/orders?status=open", nil)
+			_, err := transport.RoundTrip(request)
+			So(err, ShouldBeNil)
+
+			received := httptest.NewRequest("GET", "https://api.example.com/v1/orders?status=open", nil)
+			received.Header = base.request.Header.Clone()
+			So(Verify4(received, func(string) (string, bool) { return testCredV4.SecretAccessKey, true }), ShouldBeNil)
+		})
+	})
+
+	Convey("Given a transport told which headers to sign", t, func() {
+		base := &recordingTransport{}
+		transport := NewTransport(base, WithCredentials(*testCredV4), WithSignedHeaders("Authorization-Token", "X-Forwarded-Path"), WithUnsignedHeaders("X-Amz-Meta-Rewritten"))
+
+		Convey("The named headers should be signed or left out", func() {
+			request, _ := http.NewRequest("GET", "https://abc123.execute-api.us-east-1.amazonaws.com/prod/orders", nil)
+			request.Header.Set("Authorization-Token", "custom")
+			request.Header.Set("X-Amz-Meta-Rewritten", "by the proxy")
+			request.Header.Set("User-Agent", "test")
+
+			_, err := transport.RoundTrip(request)
+			So(err, ShouldBeNil)
+			So(base.request.Header.Get("Authorization"), ShouldContainSubstring, "SignedHeaders=authorization-token;host;x-amz-content-sha256;x-amz-date,")
+		})
+	})
+
+	Convey("Given a transport with anonymous credentials", t, func() {
+		base := &recordingTransport{}
+		transport := NewTransport(base, WithCredentials(AnonymousCredentials))
+
+		Convey("Requests should be sent unsigned", func() {
+			request, _ := http.NewRequest("GET", "https://examplebucket.s3.amazonaws.com/public.txt", nil)
+			_, err := transport.RoundTrip(request)
+			So(err, ShouldBeNil)
+			So(base.request.Header.Get("Authorization"), ShouldBeBlank)
+			So(base.request.Header.Get("X-Amz-Date"), ShouldBeBlank)
+		})
+	})
+
+	Convey("Given a transport and no credentials to be found", t, func() {
+		defer test_restoreCredentials()()
+		SetCredentialProviders(&test_provider{err: ErrNoCredentials})
+		base := &recordingTransport{}
+
+		Convey("Requests should fail rather than be signed with empty keys", func() {
+			for _, transport := range []http.RoundTripper{&SigningTransport{Base: base}, NewTransport(base)} {
+				request, _ := http.NewRequest("GET", "https://sqs.us-west-2.amazonaws.com/", nil)
+				_, err := transport.RoundTrip(request)
+				So(errors.Is(err, ErrNoCredentials), ShouldBeTrue)
+				So(base.request, ShouldBeNil)
+			}
+		})
+	})
+
+	Convey("Given a transport made with an unknown version", t, func() {
+		transport := NewTransport(&recordingTransport{}, WithCredentials(*testCredV4), WithVersion(42))
+
+		Convey("Requests should fail rather than be sent unsigned", func() {
+			request, _ := http.NewRequest("GET", "https://sqs.us-west-2.amazonaws.com/", nil)
+			_, err := transport.RoundTrip(request)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestContextCredentials(t *testing.T) {
+	Convey("Given a transport shared by several tenants", t, func() {
+		var mu sync.Mutex
+		authorizations := map[string]string{}
+		base := test_roundTripper(func(request *http.Request) (*http.Response, error) {
+			mu.Lock()
+			authorizations[request.URL.Query().Get("tenant")] = request.Header.Get("Authorization")
+			mu.Unlock()
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: request}, nil
+		})
+		transport := NewTransport(base)
+
+		Convey("Each request should be signed with the credentials in its context", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					tenant := fmt.Sprint("tenant", i)
+					ctx := ContextWithCredentials(context.Background(), Credentials{AccessKeyID: "AKID" + tenant, SecretAccessKey: "secret"})
+					request, _ := http.NewRequestWithContext(ctx, "GET", "https://sqs.us-east-1.amazonaws.com/?tenant="+tenant, nil)
+					transport.RoundTrip(request)
+				}(i)
+			}
+			wg.Wait()
+
+			So(len(authorizations), ShouldEqual, 10)
+			for i := 0; i < 10; i++ {
+				So(authorizations[fmt.Sprint("tenant", i)], ShouldStartWith, fmt.Sprintf("AWS4-HMAC-SHA256 Credential=AKIDtenant%d/", i))
+			}
+		})
+
+		Convey("A transport given credentials should sign with its own", func() {
+			ctx := ContextWithCredentials(context.Background(), *testCredS3)
+			request, _ := http.NewRequestWithContext(ctx, "GET", "https://sqs.us-east-1.amazonaws.com/?tenant=own", nil)
+			NewTransport(base, WithCredentials(*testCredV4)).RoundTrip(request)
+			So(authorizations["own"], ShouldStartWith, "AWS4-HMAC-SHA256 Credential="+testCredV4.AccessKeyID+"/")
+		})
+	})
+
+	Convey("Given a request carrying credentials in its context", t, func() {
+		ctx := ContextWithCredentials(context.Background(), *testCredS3)
+
+		Convey("The Sign functions should sign with them", func() {
+			request, _ := http.NewRequestWithContext(ctx, "GET", "https://johnsmith.s3.amazonaws.com/photos/puppy.jpg", nil)
+			SignS3(request)
+			So(request.Header.Get("Authorization"), ShouldStartWith, "AWS "+testCredS3.AccessKeyID+":")
+
+			request, _ = http.NewRequestWithContext(ctx, "GET", "https://sqs.us-east-1.amazonaws.com/", nil)
+			Sign4(request)
+			So(request.Header.Get("Authorization"), ShouldStartWith, "AWS4-HMAC-SHA256 Credential="+testCredS3.AccessKeyID+"/")
+		})
+
+		Convey("Credentials passed in should take precedence", func() {
+			request, _ := http.NewRequestWithContext(ctx, "GET", "https://sqs.us-east-1.amazonaws.com/", nil)
+			Sign4(request, *testCredV4)
+			So(request.Header.Get("Authorization"), ShouldStartWith, "AWS4-HMAC-SHA256 Credential="+testCredV4.AccessKeyID+"/")
+		})
+
+		Convey("A signer of the default chain should sign with them", func() {
+			request, _ := http.NewRequestWithContext(ctx, "GET", "https://sqs.us-east-1.amazonaws.com/", nil)
+			_, err := NewSigner(nil).Sign4(request)
+			So(err, ShouldBeNil)
+			So(request.Header.Get("Authorization"), ShouldStartWith, "AWS4-HMAC-SHA256 Credential="+testCredS3.AccessKeyID+"/")
+		})
+
+		Convey("A signer given credentials should sign with its own", func() {
+			request, _ := http.NewRequestWithContext(ctx, "GET", "https://sqs.us-east-1.amazonaws.com/", nil)
+			_, err := NewSigner(nil, WithCredentials(*testCredV4)).Sign4(request)
+			So(err, ShouldBeNil)
+			So(request.Header.Get("Authorization"), ShouldStartWith, "AWS4-HMAC-SHA256 Credential="+testCredV4.AccessKeyID+"/")
+		})
+	})
+}
+
+func TestClockSkewCorrection(t *testing.T) {
+	Convey("Given a local clock an hour behind AWS's", t, func() {
+		defer test_mockNowV4("20230101T000000Z")()
+		serverTime := time.Date(2023, time.January, 1, 1, 0, 0, 0, time.UTC)
+
+		var dates []string
+		base := test_roundTripper(func(r *http.Request) (*http.Response, error) {
+			dates = append(dates, r.Header.Get("X-Amz-Date"))
+			var body []byte
+			if r.Body != nil {
+				body, _ = ioutil.ReadAll(r.Body)
+			}
+			recorder := httptest.NewRecorder()
+			recorder.Header().Set("Date", serverTime.Format(http.TimeFormat))
+			if r.Header.Get("X-Amz-Date") != serverTime.Format(timeFormatV4) {
+				recorder.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(recorder, "<Error><Code>RequestTimeTooSkewed</Code></Error>")
+			} else {
+				recorder.Write(body)
+			}
+			return recorder.Result(), nil
+		})
+
+		Convey("A correcting transport should sign again at AWS's time", func() {
+			transport := NewTransport(base, WithCredentials(*testCredV4), WithClockSkewCorrection())
+			request, _ := http.NewRequest("PUT", "https://examplebucket.s3.amazonaws.com/object", strings.NewReader("payload"))
+
+			response, err := transport.RoundTrip(request)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			payload, _ := ioutil.ReadAll(response.Body)
+			So(string(payload), ShouldEqual, "payload")
+			So(dates, ShouldResemble, []string{"20230101T000000Z", "20230101T010000Z"})
+
+			Convey("And sign later requests at AWS's time straight away", func() {
+				request, _ := http.NewRequest("GET", "https://examplebucket.s3.amazonaws.com/object", nil)
+				response, _ := transport.RoundTrip(request)
+				So(response.StatusCode, ShouldEqual, http.StatusOK)
+				So(len(dates), ShouldEqual, 3)
+			})
+		})
+
+		Convey("Other transports should pass the refusal on", func() {
+			transport := NewTransport(base, WithCredentials(*testCredV4))
+			request, _ := http.NewRequest("GET", "https://examplebucket.s3.amazonaws.com/object", nil)
+
+			response, err := transport.RoundTrip(request)
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusForbidden)
+			So(len(dates), ShouldEqual, 1)
+		})
+	})
+}
+
+// recordingTransport captures the last request it was asked to send.
+type recordingTransport struct {
+	request *http.Request
+	body    string
+}
+
+func (t *recordingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	t.request = request
+	t.body = ""
+	if request.Body != nil {
+		payload, _ := ioutil.ReadAll(request.Body)
+		t.body = string(payload)
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: request}, nil
+}
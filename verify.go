@@ -0,0 +1,221 @@
+package awsauth
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Verify4 checks the Signed Signature Version 4 signature of a request
+// received by a server, in its Authorization header or, for presigned URLs,
+// in its query string. The secret key is looked up by the access key ID the
+// request was signed with. The request must have been signed within
+// MaxClockSkew of the current time, and a presigned URL must not have
+// expired.
+//
+// Unless it is unsigned, the body is checked to be the one signed, and
+// replaced so that it can be read again. When the request names the hash of
+// its body in X-Amz-Content-Sha256, as S3 requires, the signature is checked
+// first and the body only read once it is accepted. Otherwise the body must
+// be read to check the signature at all, and requests whose body is larger
+// than MaxUnclaimedBodySize are refused. Chunked uploads signed as they are
+// sent (STREAMING-* payloads) are refused, since their chunks can't be
+// checked here.
+func Verify4(request *http.Request, lookup func(accessKeyID string) (secret string, ok bool)) error {
+	auth, err := parseAuthorizationV4(request)
+	if err != nil {
+		return err
+	}
+
+	secret, ok := lookup(auth.accessKeyID)
+	if !ok {
+		return ErrUnknownAccessKey
+	}
+
+	signedAt, err := time.Parse(timeFormatV4, auth.timestamp)
+	if err != nil || auth.date != tsDateV4(auth.timestamp) {
+		return fmt.Errorf("%w: bad request time %q", ErrInvalidSignature, auth.timestamp)
+	}
+	current := now()
+	if signedAt.After(current.Add(MaxClockSkew)) || (auth.expires == 0 && signedAt.Before(current.Add(-MaxClockSkew))) {
+		return ErrRequestTimeSkewed
+	}
+	if auth.expires > 0 && current.After(signedAt.Add(auth.expires)) {
+		return ErrRequestExpired
+	}
+
+	payloadHash, checkBody, err := payloadHashV4(request, auth)
+	if err != nil {
+		return err
+	}
+
+	// Go moves Content-Length out of the headers of requests it receives
+	received := *request
+	received.Header = request.Header.Clone()
+	if received.Header.Get("Content-Length") == "" && request.ContentLength > 0 {
+		received.Header.Set("Content-Length", strconv.FormatInt(request.ContentLength, 10))
+	}
+
+	query := request.URL.Query()
+	query.Del("X-Amz-Signature")
+	canonicalRequest := concat("\n", request.Method, canonicalURIV4(request, &metadata{service: auth.service}), normquery(query), canonicalHeadersV4(&received, auth.signedHeaders), concat(";", auth.signedHeaders...), payloadHash)
+
+	stringToSign := concat("\n", auth.algorithm, auth.timestamp, auth.scope, hashSHA256([]byte(canonicalRequest)))
+	signature := signatureV4(signingKeyV4(secret, auth.date, auth.region, auth.service), stringToSign)
+	if !hmac.Equal([]byte(signature), []byte(auth.signature)) {
+		return ErrInvalidSignature
+	}
+
+	if checkBody && !strings.EqualFold(hashBody(request), payloadHash) {
+		return fmt.Errorf("%w: body does not match X-Amz-Content-Sha256", ErrInvalidSignature)
+	}
+	return nil
+}
+
+// MaxClockSkew is how far the time a request was signed at may be from the
+// current time for Verify4 to accept it.
+var MaxClockSkew = 15 * time.Minute
+
+// MaxUnclaimedBodySize is the largest body Verify4 reads into memory to check
+// the signature of a request that doesn't name the hash of its body in
+// X-Amz-Content-Sha256.
+var MaxUnclaimedBodySize int64 = 10 << 20
+
+// authorizationV4 holds the parts of a Version 4 signature.
+type authorizationV4 struct {
+	algorithm     string
+	accessKeyID   string
+	scope         string
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	timestamp     string
+
+	presigned bool
+	expires   time.Duration
+}
+
+// parseAuthorizationV4 reads the signature of a request from its
+// Authorization header, or from its query string if it has none.
+func parseAuthorizationV4(request *http.Request) (*authorizationV4, error) {
+	auth := new(authorizationV4)
+	var credential, signedHeaders string
+
+	if header := request.Header.Get("Authorization"); header != "" {
+		algorithm, fields, _ := strings.Cut(header, " ")
+		auth.algorithm = algorithm
+		for _, field := range strings.Split(fields, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch key {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				auth.signature = value
+			}
+		}
+		auth.timestamp = request.Header.Get("X-Amz-Date")
+		if auth.timestamp == "" {
+			if date, err := http.ParseTime(request.Header.Get("Date")); err == nil {
+				auth.timestamp = date.UTC().Format(timeFormatV4)
+			}
+		}
+	} else {
+		query := request.URL.Query()
+		if query.Get("X-Amz-Signature") == "" {
+			return nil, fmt.Errorf("%w: request is not signed", ErrInvalidSignature)
+		}
+		auth.presigned = true
+		auth.algorithm = query.Get("X-Amz-Algorithm")
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		auth.signature = query.Get("X-Amz-Signature")
+		auth.timestamp = query.Get("X-Amz-Date")
+
+		seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || seconds < 1 || time.Duration(seconds)*time.Second > maxExpiryV4 {
+			return nil, fmt.Errorf("%w: bad expiry %q", ErrInvalidSignature, query.Get("X-Amz-Expires"))
+		}
+		auth.expires = time.Duration(seconds) * time.Second
+	}
+
+	if auth.algorithm != "AWS4-HMAC-SHA256" {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidSignature, auth.algorithm)
+	}
+
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return nil, fmt.Errorf("%w: bad credential %q", ErrInvalidSignature, credential)
+	}
+	auth.accessKeyID, auth.date, auth.region, auth.service = parts[0], parts[1], parts[2], parts[3]
+	auth.scope = concat("/", parts[1:]...)
+
+	if signedHeaders == "" || auth.signature == "" {
+		return nil, fmt.Errorf("%w: signed headers or signature missing", ErrInvalidSignature)
+	}
+	auth.signedHeaders = strings.Split(signedHeaders, ";")
+	return auth, nil
+}
+
+// payloadHashV4 returns the payload hash a request was signed with, and
+// whether the body is yet to be checked against it once the signature is
+// accepted. Bodies whose hash isn't claimed are hashed right away, up to
+// MaxUnclaimedBodySize.
+func payloadHashV4(request *http.Request, auth *authorizationV4) (string, bool, error) {
+	claimed := request.Header.Get("X-Amz-Content-Sha256")
+	if auth.presigned && claimed == "" {
+		claimed = request.URL.Query().Get("X-Amz-Content-Sha256")
+	}
+	switch {
+	case auth.presigned && claimed == "":
+		return presignedPayloadHashV4(auth.service), false, nil
+	case claimed == unsignedPayload:
+		return claimed, false, nil
+	case strings.HasPrefix(claimed, "STREAMING-"):
+		return "", false, fmt.Errorf("%w: streaming payloads can't be verified", ErrInvalidSignature)
+	case claimed != "":
+		if !isPayloadHashV4(claimed) {
+			return "", false, fmt.Errorf("%w: bad X-Amz-Content-Sha256 %q", ErrInvalidSignature, claimed)
+		}
+		return claimed, true, nil
+	case request.Body == nil || request.Body == http.NoBody:
+		return emptyPayloadHash, false, nil
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(request.Body, MaxUnclaimedBodySize+1))
+	request.Body.Close()
+	if err != nil {
+		return "", false, err
+	}
+	if int64(len(payload)) > MaxUnclaimedBodySize {
+		return "", false, fmt.Errorf("%w: body too large to verify without X-Amz-Content-Sha256", ErrInvalidSignature)
+	}
+	replaceBody(request, payload)
+	return hashSHA256(payload), false, nil
+}
+
+// Errors returned by Verify4 for requests whose signature is not accepted.
+var (
+	// ErrInvalidSignature means that a request is not signed, is signed in
+	// a way that can't be checked, or has a signature that doesn't match.
+	ErrInvalidSignature = errors.New("awsauth: invalid request signature")
+
+	// ErrUnknownAccessKey means that the lookup didn't know the access key
+	// a request was signed with.
+	ErrUnknownAccessKey = errors.New("awsauth: unknown access key")
+
+	// ErrRequestTimeSkewed means that a request was signed too long before
+	// or after the current time.
+	ErrRequestTimeSkewed = errors.New("awsauth: request time is too far from the current time")
+
+	// ErrRequestExpired means that a presigned URL has expired.
+	ErrRequestExpired = errors.New("awsauth: presigned request has expired")
+)
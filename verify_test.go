@@ -0,0 +1,141 @@
+package awsauth
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestVerify4(t *testing.T) {
+	lookup := func(accessKeyID string) (string, bool) {
+		if accessKeyID == testCredV4.AccessKeyID {
+			return testCredV4.SecretAccessKey, true
+		}
+		return "", false
+	}
+
+	Convey("Given a request signed with Version 4 as it is received", t, func() {
+		defer test_mockNowV4("20150830T123600Z")()
+		received := test_receivedRequestV4("PUT", "https://examplebucket.s3.amazonaws.com/photos/puppy.jpg?acl", "some data")
+
+		Convey("Its signature should be accepted", func() {
+			So(Verify4(received, lookup), ShouldBeNil)
+		})
+
+		Convey("Its body should still be readable", func() {
+			Verify4(received, lookup)
+			payload, _ := io.ReadAll(received.Body)
+			So(string(payload), ShouldEqual, "some data")
+		})
+
+		Convey("A signed header that was changed should be caught", func() {
+			received.Header.Set("X-Amz-Date", "20150830T123500Z")
+			So(Verify4(received, lookup), ShouldEqual, ErrInvalidSignature)
+		})
+
+		Convey("A body that was changed should be caught", func() {
+			received.Body = http.NoBody
+			So(errors.Is(Verify4(received, lookup), ErrInvalidSignature), ShouldBeTrue)
+		})
+
+		Convey("A forged signature should be refused before the body is read", func() {
+			received.Header.Set("Authorization", strings.Replace(received.Header.Get("Authorization"), "Signature=", "Signature=0", 1))
+			body := &test_readTracker{Reader: strings.NewReader("some data")}
+			received.Body = io.NopCloser(body)
+			So(Verify4(received, lookup), ShouldEqual, ErrInvalidSignature)
+			So(body.read, ShouldBeFalse)
+		})
+
+		Convey("A streaming payload should be refused", func() {
+			received.Header.Set("X-Amz-Content-Sha256", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+			So(errors.Is(Verify4(received, lookup), ErrInvalidSignature), ShouldBeTrue)
+		})
+
+		Convey("A body too large to hash without a claimed hash should be refused", func() {
+			defer func(size int64) { MaxUnclaimedBodySize = size }(MaxUnclaimedBodySize)
+			MaxUnclaimedBodySize = 4
+			received.Header.Del("X-Amz-Content-Sha256")
+			err := Verify4(received, lookup)
+			So(errors.Is(err, ErrInvalidSignature), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "too large")
+		})
+
+		Convey("An unknown access key should be refused", func() {
+			So(Verify4(received, func(string) (string, bool) { return "", false }), ShouldEqual, ErrUnknownAccessKey)
+		})
+
+		Convey("A request signed too long ago should be refused", func() {
+			now = func() time.Time { return time.Date(2015, time.August, 30, 12, 52, 0, 0, time.UTC) }
+			So(Verify4(received, lookup), ShouldEqual, ErrRequestTimeSkewed)
+		})
+	})
+
+	Convey("Given a presigned URL", t, func() {
+		defer test_mockNowV4("20150830T123600Z")()
+		request, _ := http.NewRequest("GET", "https://examplebucket.s3.amazonaws.com/photos/puppy.jpg", nil)
+		presigned, _ := PresignURL4(request, time.Hour, *testCredV4)
+
+		Convey("It should be accepted until it expires", func() {
+			So(Verify4(httptest.NewRequest("GET", presigned, nil), lookup), ShouldBeNil)
+
+			now = func() time.Time { return time.Date(2015, time.August, 30, 13, 37, 0, 0, time.UTC) }
+			So(Verify4(httptest.NewRequest("GET", presigned, nil), lookup), ShouldEqual, ErrRequestExpired)
+		})
+
+		Convey("Its query string should not be changed", func() {
+			tampered := strings.Replace(presigned, "puppy.jpg", "kitten.jpg", 1)
+			So(Verify4(httptest.NewRequest("GET", tampered, nil), lookup), ShouldEqual, ErrInvalidSignature)
+		})
+	})
+
+	Convey("Given a presigned API Gateway URL", t, func() {
+		defer test_mockNowV4("20150830T123600Z")()
+		request, _ := http.NewRequest("GET", "https://abc123.execute-api.us-east-1.amazonaws.com/prod/items", nil)
+		presigned, _ := PresignURL4(request, time.Hour, *testCredV4)
+
+		Convey("It should be accepted with the empty payload it was signed with", func() {
+			So(Verify4(httptest.NewRequest("GET", presigned, nil), lookup), ShouldBeNil)
+		})
+
+		Convey("It should be accepted when presigned with another payload hash", func() {
+			presigned, _ := PresignURL4WithOptions(request, time.Hour, WithPayloadHash(unsignedPayload), WithCredentials(*testCredV4))
+			So(Verify4(httptest.NewRequest("GET", presigned, nil), lookup), ShouldBeNil)
+		})
+	})
+
+	Convey("An unsigned request should be refused", t, func() {
+		err := Verify4(httptest.NewRequest("GET", "https://examplebucket.s3.amazonaws.com/", nil), lookup)
+		So(errors.Is(err, ErrInvalidSignature), ShouldBeTrue)
+	})
+}
+
+// test_receivedRequestV4 signs a request and returns it the way a server
+// would receive it.
+func test_receivedRequestV4(method, url, body string) *http.Request {
+	request, _ := http.NewRequest(method, url, strings.NewReader(body))
+	request.Header.Set("Content-Type", "text/plain")
+	Sign4(request, *testCredV4)
+
+	received := httptest.NewRequest(method, url, strings.NewReader(body))
+	for key, values := range request.Header {
+		received.Header[key] = values
+	}
+	return received
+}
+
+// test_readTracker records whether a body was read.
+type test_readTracker struct {
+	io.Reader
+	read bool
+}
+
+func (r *test_readTracker) Read(p []byte) (int, error) {
+	r.read = true
+	return r.Reader.Read(p)
+}